@@ -1,10 +1,22 @@
 module github.com/leobrada/ztsfc_proxy
 
-go 1.21.7
+go 1.24.0
 
-require github.com/sirupsen/logrus v1.9.3
+require (
+	github.com/google/cel-go v0.20.1
+	github.com/sirupsen/logrus v1.9.3
+)
 
-require gopkg.in/yaml.v3 v3.0.1 // indirect
+require (
+	github.com/antlr4-go/antlr/v4 v4.13.0 // indirect
+	github.com/stoewer/go-strcase v1.2.0 // indirect
+	golang.org/x/exp v0.0.0-20230515195305-f3d0a9c9a5cc // indirect
+	golang.org/x/text v0.9.0 // indirect
+	google.golang.org/genproto/googleapis/api v0.0.0-20230803162519-f966b187b2e5 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230803162519-f966b187b2e5 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
 
 require (
 	github.com/leobrada/golang_convenience_tools v0.0.0-20240314174659-e9af822637cd
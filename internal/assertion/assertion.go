@@ -0,0 +1,259 @@
+// Package assertion mints the signed identity assertions of the ZTSFC proxy. An assertion is a short-lived JWT telling a
+// service who the verified client is and why the PDP permitted the request, so services can authorize on claims the proxy
+// verified instead of parsing X.509 certificates themselves.
+package assertion
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+// Defaults if the configuration leaves them unset
+const (
+	defaultIssuer   = "ztsfc_proxy"
+	defaultTTL      = 60 * time.Second
+	defaultHeader   = "X-Ztsfc-Assertion"
+	defaultJWKSPath = "/.well-known/ztsfc/jwks.json"
+)
+
+// Claims are the claims of an assertion
+type Claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  string   `json:"aud"`
+	IssuedAt  int64    `json:"iat"`
+	NotBefore int64    `json:"nbf"`
+	ExpiresAt int64    `json:"exp"`
+	ID        string   `json:"jti"`
+	Groups    []string `json:"groups,omitempty"`
+	// ID of the PDP decision that permitted the request
+	DecisionID string `json:"decision_id"`
+	// Trust score of the request (0 if the service does not evaluate trust)
+	TrustScore int `json:"trust_score"`
+}
+
+// Signer signs assertions with the configured key
+type Signer struct {
+	key      crypto.Signer
+	alg      string
+	keyID    string
+	issuer   string
+	ttl      time.Duration
+	header   string
+	jwksPath string
+	// JSON Web Key Set of the public key, served to services
+	jwks []byte
+}
+
+// NewSigner creates the signer of the configured key.
+// Parameters:
+//   - assertionConfig: A pointer to the assertion configuration.
+//
+// Returns:
+//   - *Signer: A pointer to the created signer, or nil if no signing key is configured.
+//   - error: An error if the key cannot be loaded or has an unsupported type.
+func NewSigner(assertionConfig *configs.AssertionConfig) (*Signer, error) {
+	if assertionConfig.SigningKeyFile == "" {
+		return nil, nil
+	}
+
+	key, err := loadKey(assertionConfig.SigningKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("assertion.NewSigner(): %v", err)
+	}
+
+	s := &Signer{
+		key:      key,
+		keyID:    assertionConfig.KeyID,
+		issuer:   assertionConfig.Issuer,
+		ttl:      assertionConfig.TTL,
+		header:   http.CanonicalHeaderKey(assertionConfig.Header),
+		jwksPath: assertionConfig.JWKSPath,
+	}
+	if s.issuer == "" {
+		s.issuer = defaultIssuer
+	}
+	if s.ttl <= 0 {
+		s.ttl = defaultTTL
+	}
+	if s.header == "" {
+		s.header = defaultHeader
+	}
+	if s.jwksPath == "" {
+		s.jwksPath = defaultJWKSPath
+	}
+
+	jwk, err := s.publicJWK()
+	if err != nil {
+		return nil, fmt.Errorf("assertion.NewSigner(): %v", err)
+	}
+	s.jwks, err = json.Marshal(map[string]interface{}{"keys": []map[string]string{jwk}})
+	if err != nil {
+		return nil, fmt.Errorf("assertion.NewSigner(): %v", err)
+	}
+	return s, nil
+}
+
+// loadKey reads a PEM encoded PKCS#8, SEC 1 or PKCS#1 private key
+func loadKey(keyFile string) (crypto.Signer, error) {
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signing key: %v", err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("signing key file '%s' contains no PEM block", keyFile)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse signing key: %v", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+	return signer, nil
+}
+
+// publicJWK sets the algorithm and key ID of the signer and returns its public key as JSON Web Key
+func (s *Signer) publicJWK() (map[string]string, error) {
+	var jwk map[string]string
+	switch pub := s.key.Public().(type) {
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported curve %s, only P-256 is supported", pub.Curve.Params().Name)
+		}
+		s.alg = "ES256"
+		jwk = map[string]string{"kty": "EC", "crv": "P-256", "x": encodeFixed(pub.X, 32), "y": encodeFixed(pub.Y, 32)}
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key of %d bits is too short", pub.N.BitLen())
+		}
+		s.alg = "RS256"
+		jwk = map[string]string{"kty": "RSA", "n": encode(pub.N.Bytes()), "e": encode(big.NewInt(int64(pub.E)).Bytes())}
+	case ed25519.PublicKey:
+		s.alg = "EdDSA"
+		jwk = map[string]string{"kty": "OKP", "crv": "Ed25519", "x": encode(pub)}
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+
+	if s.keyID == "" {
+		der, err := x509.MarshalPKIXPublicKey(s.key.Public())
+		if err != nil {
+			return nil, err
+		}
+		thumbprint := sha256.Sum256(der)
+		s.keyID = encode(thumbprint[:12])
+	}
+
+	jwk["kid"], jwk["alg"], jwk["use"] = s.keyID, s.alg, "sig"
+	return jwk, nil
+}
+
+// Header returns the name of the request header carrying the assertion
+func (s *Signer) Header() string {
+	return s.header
+}
+
+// JWKSPath returns the path the JSON Web Key Set is served at
+func (s *Signer) JWKSPath() string {
+	return s.jwksPath
+}
+
+// ServeHTTP serves the JSON Web Key Set services verify assertions with
+func (s *Signer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(s.jwks)
+}
+
+// Sign returns a signed JWT carrying the given claims. Issuer, lifetime and token ID are set by the signer.
+func (s *Signer) Sign(claims Claims) (string, error) {
+	now := time.Now()
+	claims.Issuer = s.issuer
+	claims.IssuedAt = now.Unix()
+	claims.NotBefore = now.Unix()
+	claims.ExpiresAt = now.Add(s.ttl).Unix()
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", fmt.Errorf("assertion.Signer.Sign(): %v", err)
+	}
+	claims.ID = encode(jti)
+
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "typ": "JWT", "kid": s.keyID})
+	if err != nil {
+		return "", fmt.Errorf("assertion.Signer.Sign(): %v", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("assertion.Signer.Sign(): %v", err)
+	}
+	signingInput := encode(header) + "." + encode(payload)
+
+	signature, err := s.sign([]byte(signingInput))
+	if err != nil {
+		return "", fmt.Errorf("assertion.Signer.Sign(): %v", err)
+	}
+	return signingInput + "." + encode(signature), nil
+}
+
+// sign signs the input as required by the JWS algorithm of the key
+func (s *Signer) sign(input []byte) ([]byte, error) {
+	switch s.alg {
+	case "EdDSA":
+		return s.key.Sign(rand.Reader, input, crypto.Hash(0))
+	case "RS256":
+		digest := sha256.Sum256(input)
+		return s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default:
+		// JWS requires the raw R || S encoding instead of ASN.1
+		digest := sha256.Sum256(input)
+		r, sig, err := ecdsa.Sign(rand.Reader, s.key.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			return nil, err
+		}
+		return append(fixed(r, 32), fixed(sig, 32)...), nil
+	}
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func encodeFixed(n *big.Int, size int) string {
+	return encode(fixed(n, size))
+}
+
+// fixed returns n as big-endian byte slice of the given size
+func fixed(n *big.Int, size int) []byte {
+	b := make([]byte, size)
+	return n.FillBytes(b)
+}
@@ -0,0 +1,167 @@
+package assertion
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+// writeKey writes the PEM block of a private key to a temporary file and returns its path
+func writeKey(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("os.WriteFile(): %v", err)
+	}
+	return keyFile
+}
+
+func decode(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatalf("%q is not base64url encoded: %v", s, err)
+	}
+	return b
+}
+
+// verify checks the signature of the token with the JSON Web Key, the way a service would
+func verify(t *testing.T, jwk map[string]string, signingInput string, signature []byte) bool {
+	t.Helper()
+	digest := sha256.Sum256([]byte(signingInput))
+
+	switch jwk["alg"] {
+	case "ES256":
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(decode(t, jwk["x"])),
+			Y:     new(big.Int).SetBytes(decode(t, jwk["y"])),
+		}
+		if len(signature) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(pub, digest[:], r, s)
+	case "RS256":
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(decode(t, jwk["n"])),
+			E: int(new(big.Int).SetBytes(decode(t, jwk["e"])).Int64()),
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	case "EdDSA":
+		return ed25519.Verify(ed25519.PublicKey(decode(t, jwk["x"])), []byte(signingInput), signature)
+	}
+	t.Fatalf("JWK has unknown alg '%s'", jwk["alg"])
+	return false
+}
+
+func TestSignVerifiesWithJWKS(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edKey)
+
+	tests := []struct {
+		alg       string
+		blockType string
+		der       []byte
+		kty       string
+	}{
+		{"ES256", "EC PRIVATE KEY", ecDER, "EC"},
+		{"RS256", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), "RSA"},
+		{"EdDSA", "PRIVATE KEY", edDER, "OKP"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.alg, func(t *testing.T) {
+			signer, err := NewSigner(&configs.AssertionConfig{SigningKeyFile: writeKey(t, tt.blockType, tt.der), TTL: time.Minute})
+			if err != nil {
+				t.Fatalf("NewSigner(): %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			signer.ServeHTTP(w, httptest.NewRequest("GET", signer.JWKSPath(), nil))
+			var jwks struct {
+				Keys []map[string]string `json:"keys"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &jwks); err != nil || len(jwks.Keys) != 1 {
+				t.Fatalf("JWKS %s holds no single key: %v", w.Body.String(), err)
+			}
+			jwk := jwks.Keys[0]
+			if jwk["alg"] != tt.alg || jwk["kty"] != tt.kty || jwk["use"] != "sig" || jwk["kid"] == "" {
+				t.Errorf("JWK = %v, want alg %s, kty %s, use sig and a kid", jwk, tt.alg, tt.kty)
+			}
+
+			token, err := signer.Sign(Claims{Subject: "alice", Audience: "service.example.de", DecisionID: "d-1", TrustScore: 42})
+			if err != nil {
+				t.Fatalf("Sign(): %v", err)
+			}
+			parts := strings.Split(token, ".")
+			if len(parts) != 3 {
+				t.Fatalf("token %q has %d parts, want 3", token, len(parts))
+			}
+
+			var header map[string]string
+			if err := json.Unmarshal(decode(t, parts[0]), &header); err != nil {
+				t.Fatalf("header is no JSON: %v", err)
+			}
+			if header["alg"] != tt.alg || header["kid"] != jwk["kid"] || header["typ"] != "JWT" {
+				t.Errorf("header = %v, want alg %s and kid %s", header, tt.alg, jwk["kid"])
+			}
+
+			if !verify(t, jwk, parts[0]+"."+parts[1], decode(t, parts[2])) {
+				t.Fatal("signature does not verify with the served JWK")
+			}
+			if verify(t, jwk, parts[0]+"."+parts[1]+"x", decode(t, parts[2])) {
+				t.Error("signature verifies for a modified token")
+			}
+
+			var claims Claims
+			if err := json.Unmarshal(decode(t, parts[1]), &claims); err != nil {
+				t.Fatalf("payload is no JSON: %v", err)
+			}
+			if claims.Issuer != defaultIssuer || claims.Subject != "alice" || claims.ExpiresAt-claims.IssuedAt != 60 || claims.ID == "" {
+				t.Errorf("claims = %+v, want default issuer, subject alice, a lifetime of 60s and an ID", claims)
+			}
+		})
+	}
+}
+
+func TestNewSignerRejectsWeakKeys(t *testing.T) {
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p384DER, _ := x509.MarshalECPrivateKey(p384Key)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	tests := []struct {
+		name      string
+		blockType string
+		der       []byte
+	}{
+		{"P-384", "EC PRIVATE KEY", p384DER},
+		{"RSA 1024", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewSigner(&configs.AssertionConfig{SigningKeyFile: writeKey(t, tt.blockType, tt.der)}); err == nil {
+			t.Errorf("NewSigner() with %s key succeeded, want error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Package celexpr compiles and evaluates access expressions written in the Common Expression Language (CEL).
+package celexpr
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+)
+
+// Attributes holds the request attributes an access expression is evaluated against.
+// Every field is exposed to the expression as the variable named in its comment.
+type Attributes struct {
+	ClientCertPresent    bool              // client.cert.present
+	ClientSubjectCN      string            // client.cert.subject.cn
+	ClientSubjectO       []string          // client.cert.subject.o
+	ClientSubjectOU      []string          // client.cert.subject.ou
+	ClientIssuerCN       string            // client.cert.issuer.cn
+	ClientDNSNames       []string          // client.cert.dns_names
+	ClientURIs           []string          // client.cert.uris
+	ClientEmailAddresses []string          // client.cert.email_addresses
+	ClientFingerprint    string            // client.cert.fingerprint (hex encoded SHA-256 of the certificate)
+	RequestMethod        string            // request.method
+	RequestPath          string            // request.path
+	RequestHost          string            // request.host
+	RequestSNI           string            // request.sni
+	RequestProtocol      string            // request.protocol (negotiated via ALPN, "h2" or "http/1.1")
+	RequestHeaders       map[string]string // request.headers (canonical header names, multiple values joined by ", ")
+	RequestGRPCService   string            // request.grpc.service (fully qualified, "" if the request is no gRPC call)
+	RequestGRPCMethod    string            // request.grpc.method ("" if the request is no gRPC call)
+	SourceIP             string            // source.ip
+}
+
+// Expression is a compiled and type-checked access expression
+type Expression struct {
+	source  string
+	program cel.Program
+}
+
+// env declares all variables an access expression may refer to. Referring to any other variable fails compilation.
+var env *cel.Env
+
+func init() {
+	var err error
+	env, err = cel.NewEnv(
+		cel.Variable("client.cert.present", cel.BoolType),
+		cel.Variable("client.cert.subject.cn", cel.StringType),
+		cel.Variable("client.cert.subject.o", cel.ListType(cel.StringType)),
+		cel.Variable("client.cert.subject.ou", cel.ListType(cel.StringType)),
+		cel.Variable("client.cert.issuer.cn", cel.StringType),
+		cel.Variable("client.cert.dns_names", cel.ListType(cel.StringType)),
+		cel.Variable("client.cert.uris", cel.ListType(cel.StringType)),
+		cel.Variable("client.cert.email_addresses", cel.ListType(cel.StringType)),
+		cel.Variable("client.cert.fingerprint", cel.StringType),
+		cel.Variable("request.method", cel.StringType),
+		cel.Variable("request.path", cel.StringType),
+		cel.Variable("request.host", cel.StringType),
+		cel.Variable("request.sni", cel.StringType),
+		cel.Variable("request.protocol", cel.StringType),
+		cel.Variable("request.headers", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("request.grpc.service", cel.StringType),
+		cel.Variable("request.grpc.method", cel.StringType),
+		cel.Variable("source.ip", cel.StringType),
+	)
+	if err != nil {
+		panic(fmt.Sprintf("celexpr.init(): could not create CEL environment: %v", err))
+	}
+}
+
+// Compile parses and type-checks the given access expression. The expression must evaluate to a bool.
+// Parameters:
+//   - source: The access expression, e.g., `client.cert.subject.cn == "alice" && request.method == "GET"`.
+//
+// Returns:
+//   - *Expression: A pointer to the compiled expression.
+//   - error: An error if the expression is syntactically invalid, refers to unknown variables or does not evaluate to a bool.
+func Compile(source string) (*Expression, error) {
+	ast, issues := env.Compile(source)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("celexpr.Compile(): %v", issues.Err())
+	}
+
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("celexpr.Compile(): expression must evaluate to bool, not %v", ast.OutputType())
+	}
+
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("celexpr.Compile(): %v", err)
+	}
+
+	return &Expression{source: source, program: program}, nil
+}
+
+// Eval evaluates the expression against the given attributes. Evaluation errors, e.g., accessing a missing
+// header, are returned as error and must be treated as deny by the caller.
+func (e *Expression) Eval(attrs *Attributes) (bool, error) {
+	out, _, err := e.program.Eval(map[string]any{
+		"client.cert.present":         attrs.ClientCertPresent,
+		"client.cert.subject.cn":      attrs.ClientSubjectCN,
+		"client.cert.subject.o":       nonNil(attrs.ClientSubjectO),
+		"client.cert.subject.ou":      nonNil(attrs.ClientSubjectOU),
+		"client.cert.issuer.cn":       attrs.ClientIssuerCN,
+		"client.cert.dns_names":       nonNil(attrs.ClientDNSNames),
+		"client.cert.uris":            nonNil(attrs.ClientURIs),
+		"client.cert.email_addresses": nonNil(attrs.ClientEmailAddresses),
+		"client.cert.fingerprint":     attrs.ClientFingerprint,
+		"request.method":              attrs.RequestMethod,
+		"request.path":                attrs.RequestPath,
+		"request.host":                attrs.RequestHost,
+		"request.sni":                 attrs.RequestSNI,
+		"request.protocol":            attrs.RequestProtocol,
+		"request.headers":             nonNilMap(attrs.RequestHeaders),
+		"request.grpc.service":        attrs.RequestGRPCService,
+		"request.grpc.method":         attrs.RequestGRPCMethod,
+		"source.ip":                   attrs.SourceIP,
+	})
+	if err != nil {
+		return false, fmt.Errorf("celexpr.Expression.Eval(): %v", err)
+	}
+
+	result, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("celexpr.Expression.Eval(): expression evaluated to %v instead of bool", out.Value())
+	}
+	return result, nil
+}
+
+// String returns the source of the expression
+func (e *Expression) String() string {
+	return e.source
+}
+
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+func nonNilMap(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
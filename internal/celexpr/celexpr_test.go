@@ -0,0 +1,76 @@
+package celexpr
+
+import "testing"
+
+func TestCompileRejectsInvalidExpressions(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{"syntax error", `request.method == `},
+		{"unknown variable", `request.verb == "GET"`},
+		{"typo in nested variable", `client.cert.subjct.cn == "alice"`},
+		{"string compared to int", `request.method == 1`},
+		{"list used as string", `client.cert.uris == "spiffe://example.de/alice"`},
+		{"non-bool result", `request.path`},
+		{"int result", `size(request.headers)`},
+		{"unknown function", `request.path.startsWithh("/api")`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Compile(tt.source); err == nil {
+				t.Errorf("Compile(%q) succeeded, want error", tt.source)
+			}
+		})
+	}
+}
+
+func TestEval(t *testing.T) {
+	attrs := &Attributes{
+		ClientCertPresent: true,
+		ClientSubjectCN:   "alice",
+		ClientSubjectOU:   []string{"Security"},
+		ClientURIs:        []string{"spiffe://example.de/alice"},
+		RequestMethod:     "GET",
+		RequestPath:       "/api/users",
+		RequestSNI:        "app.example.de",
+		RequestProtocol:   "h2",
+		RequestHeaders:    map[string]string{"X-Tenant": "a"},
+		SourceIP:          "10.0.0.1",
+	}
+
+	tests := []struct {
+		name    string
+		source  string
+		want    bool
+		wantErr bool
+	}{
+		{"subject cn", `client.cert.subject.cn == "alice"`, true, false},
+		{"ou membership", `"Security" in client.cert.subject.ou`, true, false},
+		{"uri membership", `"spiffe://example.de/bob" in client.cert.uris`, false, false},
+		{"method and path", `request.method == "GET" && request.path.startsWith("/api/")`, true, false},
+		{"header present", `request.headers["X-Tenant"] == "a"`, true, false},
+		{"header absent guarded", `"X-Missing" in request.headers && request.headers["X-Missing"] == "a"`, false, false},
+		{"header absent unguarded", `request.headers["X-Missing"] == "a"`, false, true},
+		{"source ip", `source.ip.startsWith("10.")`, true, false},
+		{"protocol", `request.protocol == "http/1.1"`, false, false},
+		{"empty lists", `size(client.cert.dns_names) == 0 && size(client.cert.email_addresses) == 0`, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := Compile(tt.source)
+			if err != nil {
+				t.Fatalf("Compile(%q): %v", tt.source, err)
+			}
+			got, err := expr.Eval(attrs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Eval(%q) error = %v, want error %t", tt.source, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Eval(%q) = %t, want %t", tt.source, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package configs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AssertionConfig configures the signed identity assertions (JWTs) the PEP adds to every request it forwards for a client
+// with a verified certificate. Services verify them with the public keys served at JWKSPath.
+type AssertionConfig struct {
+	SigningKeyFile string        `yaml:"signing_key_file"` // SigningKeyFile is the PEM file of the ECDSA P-256, RSA or Ed25519 private key. Empty disables assertions.
+	KeyID          string        `yaml:"key_id"`           // KeyID is the "kid" of the key. Defaults to a thumbprint of the public key.
+	Issuer         string        `yaml:"issuer"`           // Issuer is the "iss" claim of all assertions. Defaults to "ztsfc_proxy".
+	TTL            time.Duration `yaml:"ttl"`              // TTL is the lifetime of an assertion. Defaults to 60s.
+	Header         string        `yaml:"header"`           // Header is the request header carrying the assertion. Defaults to "X-Ztsfc-Assertion".
+	JWKSPath       string        `yaml:"jwks_path"`        // JWKSPath is the absolute path the frontend serves the JSON Web Key Set at. Defaults to "/.well-known/ztsfc/jwks.json".
+}
+
+// validateJWKSPath checks that the JWKS can be served at the path. It must be absolute and must not be "/", where the PEP
+// is served, or contain whitespace or wildcards. An empty path selects the default.
+func validateJWKSPath(path string) error {
+	if path == "" {
+		return nil
+	}
+	if !strings.HasPrefix(path, "/") || path == "/" || strings.ContainsAny(path, " \t\n{}") {
+		return fmt.Errorf("invalid jwks_path '%s': must be an absolute path other than '/' without whitespace or wildcards", path)
+	}
+	return nil
+}
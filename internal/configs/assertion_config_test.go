@@ -0,0 +1,25 @@
+package configs
+
+import "testing"
+
+func TestValidateJWKSPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		valid bool
+	}{
+		{"", true},
+		{"/.well-known/ztsfc/jwks.json", true},
+		{"/jwks", true},
+		{"jwks.json", false},
+		{".well-known/jwks.json", false},
+		{"/", false},
+		{"/keys/{kid}", false},
+		{"GET /jwks", false},
+	}
+
+	for _, tt := range tests {
+		if err := validateJWKSPath(tt.path); (err == nil) != tt.valid {
+			t.Errorf("validateJWKSPath(%q) error = %v, want valid %t", tt.path, err, tt.valid)
+		}
+	}
+}
@@ -4,15 +4,18 @@ import (
 	"fmt"
 
 	"github.com/leobrada/yaml_tools"
+	"github.com/leobrada/ztsfc_proxy/internal/celexpr"
 )
 
 // Config is a central structure that encapsulates configuration settings for various components of the application.
 // It aggregates multiple sub-configuration structures, each corresponding to a different component.
 type Config struct {
-	Frontend           frontendConfig `yaml:"frontend"`             // Configuration specific to the frontend component.
-	DataPlaneLogger    LoggerConfig   `yaml:"data_plane_logger"`    // Configuration for logging within the data plane.
-	ControlPlaneLogger LoggerConfig   `yaml:"control_plane_logger"` // Configuration for logging within the control plane.
-	Services           ServicesConfig `yaml:"services"`             // Configuration for various services the PEP serves.
+	Frontend           frontendConfig  `yaml:"frontend"`             // Configuration specific to the frontend component.
+	DataPlaneLogger    LoggerConfig    `yaml:"data_plane_logger"`    // Configuration for logging within the data plane.
+	ControlPlaneLogger LoggerConfig    `yaml:"control_plane_logger"` // Configuration for logging within the control plane.
+	Services           ServicesConfig  `yaml:"services"`             // Configuration for various services the PEP serves.
+	PDP                PDPConfig       `yaml:"pdp"`                  // Configuration for the policy decision point authorizing requests.
+	Assertion          AssertionConfig `yaml:"assertion"`            // Configuration of the signed identity assertions passed to services.
 }
 
 // NewConfig creates a new Config instance by loading configuration settings from a specified YAML file.
@@ -33,5 +36,20 @@ func NewConfig(confFilePath string) (*Config, error) {
 		return nil, fmt.Errorf("configs.InitConfig(): could not load yaml file: %v", err)
 	}
 
+	// Type-check all access expressions so invalid expressions fail at startup and not at request time.
+	for sni, serviceConf := range config.Services.ServicePool {
+		if serviceConf.AccessExpression == "" {
+			continue
+		}
+		if _, err = celexpr.Compile(serviceConf.AccessExpression); err != nil {
+			return nil, fmt.Errorf("configs.NewConfig(): invalid access_expression of service '%s': %v", sni, err)
+		}
+	}
+
+	// The JWKS is served by the frontend's request multiplexer next to the PEP, which panics on invalid paths.
+	if err = validateJWKSPath(config.Assertion.JWKSPath); err != nil {
+		return nil, fmt.Errorf("configs.NewConfig(): %v", err)
+	}
+
 	return config, nil
 }
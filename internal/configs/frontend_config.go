@@ -5,4 +5,5 @@ package configs
 type frontendConfig struct {
 	Addr string    `yaml:"addr"` // Addr specifies the IP address and port on which the frontend server should listen. Example: "127.0.0.1:443".
 	TLS  TLSConfig `yaml:"tls"`  // TLS configures the Transport Layer Security settings for the frontend server to ensure secure communication.
+	ALPN []string  `yaml:"alpn"` // ALPN lists the application protocols offered to clients in order of preference {h2,http/1.1}. Defaults to ["h2", "http/1.1"].
 }
@@ -0,0 +1,110 @@
+package configs
+
+import "time"
+
+// PDPConfig holds the settings of the Policy Decision Point (PDP) that authorizes every request before it is forwarded.
+type PDPConfig struct {
+	Mode       string          `yaml:"mode"`        // Mode is either "local" (default), evaluating PolicyFile, or "remote", asking the PDP service configured in Remote.
+	PolicyFile string          `yaml:"policy_file"` // PolicyFile is the path to the YAML file holding the attribute-based access control rules.
+	Remote     RemotePDPConfig `yaml:"remote"`      // Remote configures the external PDP service used in "remote" mode.
+	Trust      TrustConfig     `yaml:"trust"`       // Trust holds the weighted signals the per-request trust score is calculated from.
+	Shadow     ShadowConfig    `yaml:"shadow"`      // Shadow configures a candidate policy that is evaluated without affecting any decision.
+}
+
+// ShadowConfig configures the shadow (dry-run) policy. It is evaluated on every request in place of the enforced policy,
+// under the same access expression and trust threshold, and every shadow decision is recorded in the control plane log.
+type ShadowConfig struct {
+	PolicyFile     string        `yaml:"policy_file"`     // PolicyFile is the path to the candidate policy in the format of PDPConfig.PolicyFile. Empty disables shadow evaluation.
+	ReportInterval time.Duration `yaml:"report_interval"` // ReportInterval is the period the per-service mismatch counts are logged in. Defaults to 5m. SIGUSR1 logs them immediately.
+}
+
+// RemotePDPConfig configures an external PDP service providing an OPA-compatible decision API.
+// The service is contacted via mTLS using the client TLS settings of the services section.
+type RemotePDPConfig struct {
+	URL      string        `yaml:"url"`       // URL of the decision endpoint, e.g., "https://opa.example.de:8181/v1/data/ztsfc/authz".
+	Timeout  time.Duration `yaml:"timeout"`   // Timeout limits the time a single decision request may take. Defaults to 1s.
+	CacheTTL time.Duration `yaml:"cache_ttl"` // CacheTTL is the period a remote decision is reused for identical requests. 0 disables caching.
+}
+
+// TrustConfig defines the weights of all signals contributing to the trust score of a request.
+// The score is compared against the trust_threshold of the requested service. Signals without a weight are ignored.
+type TrustConfig struct {
+	Issuers       map[string]int      `yaml:"issuers"`        // Issuers maps the CN of a client certificate issuer to the points it grants.
+	Networks      map[string]int      `yaml:"networks"`       // Networks maps a source network in CIDR notation to the points it grants. The most specific match counts.
+	BusinessHours BusinessHoursConfig `yaml:"business_hours"` // BusinessHours grants points to requests sent during business hours.
+	TLS           TLSSignalConfig     `yaml:"tls"`            // TLS grants points to connections using preferred TLS parameters.
+	AuthFailures  AuthFailuresConfig  `yaml:"auth_failures"`  // AuthFailures deducts points for recent failed access attempts of the client.
+	RequestRate   RequestRateConfig   `yaml:"request_rate"`   // RequestRate deducts points from clients sending requests at a high rate.
+}
+
+// BusinessHoursConfig grants Weight points to requests sent between the hours Start (inclusive) and End (exclusive) in local time.
+// A Start after End spans midnight, e.g., 22 to 6 for a night shift.
+type BusinessHoursConfig struct {
+	Start  int `yaml:"start"`  // Start is the first hour of the business day, e.g., 7.
+	End    int `yaml:"end"`    // End is the hour the business day ends, e.g., 19.
+	Weight int `yaml:"weight"` // Weight is the number of points granted during business hours.
+}
+
+// TLSSignalConfig grants Weight points to connections that negotiated one of the listed cipher suites.
+type TLSSignalConfig struct {
+	CipherSuites []string `yaml:"cipher_suites"` // CipherSuites lists the preferred cipher suites, e.g., "TLS_AES_256_GCM_SHA384".
+	Weight       int      `yaml:"weight"`        // Weight is the number of points granted if a preferred cipher suite is used.
+}
+
+// AuthFailuresConfig deducts Penalty points for every failed access attempt of the client's source IP within Window.
+type AuthFailuresConfig struct {
+	Window  time.Duration `yaml:"window"`  // Window is the period failures are remembered for, e.g., "10m".
+	Penalty int           `yaml:"penalty"` // Penalty is the number of points deducted per failure.
+}
+
+// RequestRateConfig deducts Penalty points if the client's source IP sent more than Limit requests within Window.
+type RequestRateConfig struct {
+	Window  time.Duration `yaml:"window"`  // Window is the period requests are counted in, e.g., "1m".
+	Limit   int           `yaml:"limit"`   // Limit is the number of requests within Window that is considered normal.
+	Penalty int           `yaml:"penalty"` // Penalty is the number of points deducted if Limit is exceeded.
+}
+
+// PolicyConfig is the structure of the YAML policy file referenced by PDPConfig.PolicyFile.
+// The rules are evaluated against every request and combined according to CombiningAlgorithm.
+type PolicyConfig struct {
+	CombiningAlgorithm string       `yaml:"combining_algorithm"` // CombiningAlgorithm is either "deny-overrides" (default) or "permit-overrides".
+	Rules              []RuleConfig `yaml:"rules"`               // Rules lists all access control rules of the policy.
+}
+
+// RuleConfig defines a single access control rule. A rule applies to a request if all of its non-empty conditions match.
+// Within a single condition list it is sufficient if one of the listed values matches.
+type RuleConfig struct {
+	ID             string        `yaml:"id"`              // ID identifies the rule in the control plane log.
+	Effect         string        `yaml:"effect"`          // Effect is either "permit" or "deny".
+	SNIs           []string      `yaml:"snis"`            // SNIs lists the target services (TLS SNI) the rule applies to.
+	Methods        []string      `yaml:"methods"`         // Methods lists the HTTP methods the rule applies to, e.g., "GET".
+	PathPrefixes   []string      `yaml:"path_prefixes"`   // PathPrefixes lists the URL path prefixes the rule applies to, e.g., "/api". Prefixes match whole path segments.
+	GRPCMethods    []string      `yaml:"grpc_methods"`    // GRPCMethods lists the gRPC methods the rule applies to, e.g., "helloworld.Greeter/SayHello" or "helloworld.Greeter/*".
+	SourceNetworks []string      `yaml:"source_networks"` // SourceNetworks lists the client networks in CIDR notation the rule applies to.
+	Subject        SubjectConfig `yaml:"subject"`         // Subject holds conditions on the subject of the client certificate.
+	SANs           SANConfig     `yaml:"sans"`            // SANs holds conditions on the subject alternative names of the client certificate.
+	// Obligations lists the actions the PEP must carry out if the rule determines the decision.
+	Obligations []ObligationConfig `yaml:"obligations"`
+	// Chain lists the names of the service functions (see ServicesConfig.ServiceFunctions) a permitted request passes in order.
+	Chain []string `yaml:"chain"`
+}
+
+// ObligationConfig defines an action the PEP must carry out before forwarding a request, e.g., injecting a header.
+type ObligationConfig struct {
+	Type   string            `yaml:"type"`   // Type names the obligation handler, e.g., "inject_header".
+	Params map[string]string `yaml:"params"` // Params holds the handler specific parameters, e.g., "name" and "value".
+}
+
+// SubjectConfig holds the accepted values of the client certificate's subject attributes.
+type SubjectConfig struct {
+	CommonNames         []string `yaml:"common_names"`         // CommonNames lists accepted subject CNs.
+	Organizations       []string `yaml:"organizations"`        // Organizations lists accepted subject Os.
+	OrganizationalUnits []string `yaml:"organizational_units"` // OrganizationalUnits lists accepted subject OUs.
+}
+
+// SANConfig holds the accepted subject alternative names of the client certificate.
+type SANConfig struct {
+	DNSNames       []string `yaml:"dns_names"`       // DNSNames lists accepted DNS SANs.
+	URIs           []string `yaml:"uris"`            // URIs lists accepted URI SANs, e.g., "spiffe://example.de/client".
+	EmailAddresses []string `yaml:"email_addresses"` // EmailAddresses lists accepted email SANs.
+}
@@ -1,14 +1,238 @@
 package configs
 
+import "time"
+
 // ServicesConfig holds configurations applicable to all services managed by the Policy Enforcement Point (PEP).
 // It includes a global TLS configuration to secure communications and a map of service-specific configurations.
 type ServicesConfig struct {
-	TLS         TLSConfig                `yaml:"tls"`          // TLS specifies the common Transport Layer Security settings applied to all services.
-	ServicePool map[string]ServiceConfig `yaml:"service_pool"` // ServicePool maps service identifiers to their respective configurations.
+	TLS              TLSConfig                        `yaml:"tls"`               // TLS specifies the common Transport Layer Security settings applied to all services.
+	ServicePool      map[string]ServiceConfig         `yaml:"service_pool"`      // ServicePool maps service identifiers to their respective configurations.
+	ServiceFunctions map[string]ServiceFunctionConfig `yaml:"service_functions"` // ServiceFunctions maps names to the service functions a PDP decision may chain a request through.
+	RetryBudget      RetryBudgetConfig                `yaml:"retry_budget"`      // RetryBudget limits the retries of all services together.
+	RateLimits       []RateLimitConfig                `yaml:"rate_limits"`       // RateLimits apply to the requests to all services.
+}
+
+// RateLimitConfig defines a token bucket limiting the requests per client identity or SNI.
+// Every distinct key gets its own bucket of Burst tokens, refilled with Requests tokens per Period.
+type RateLimitConfig struct {
+	Key      string        `yaml:"key"`      // Key selects what requests are counted by: "fingerprint" or "cn" of the client certificate, "source_ip" or "sni".
+	Requests int           `yaml:"requests"` // Requests is the number of requests allowed per Period.
+	Period   time.Duration `yaml:"period"`   // Period is the time Requests are allowed in, e.g., "1s" for a rate or "1h" for a quota. Defaults to 1s.
+	Burst    int           `yaml:"burst"`    // Burst is the number of requests allowed at once. Defaults to Requests.
+}
+
+// RetryBudgetConfig limits retries to a share of all forwarded requests, so a retry storm cannot overload a struggling backend.
+type RetryBudgetConfig struct {
+	Percent    float64       `yaml:"percent"`     // Percent is the number of retries allowed per 100 forwarded requests. Defaults to 20.
+	MinRetries int           `yaml:"min_retries"` // MinRetries is the number of retries always allowed per window, regardless of traffic. Defaults to 10.
+	Window     time.Duration `yaml:"window"`      // Window is the period requests and retries are counted over. Defaults to 10s.
+}
+
+// ServiceFunctionConfig defines a single service function, e.g., an IDS or a DLP inspector, requests can be chained through.
+// A service function receives the remaining chain in a request header and forwards the request to the next hop.
+type ServiceFunctionConfig struct {
+	URL string `yaml:"url"` // URL is the endpoint where the service function is accessible, e.g., "https://ids.example.de:8443".
 }
 
 // ServiceConfig defines the configuration details for a single service managed by the PEP.
 // It primarily contains the URL where the service can be accessed.
 type ServiceConfig struct {
-	ServiceURL string `yaml:"service_url"` // ServiceURL is the endpoint URL where the service is accessible, e.g., "https://api.example.com/service".
+	ServiceURL     string `yaml:"service_url"`     // ServiceURL is the endpoint URL where the service is accessible, e.g., "https://api.example.com/service". Requests matching no route go here.
+	TrustThreshold int    `yaml:"trust_threshold"` // TrustThreshold is the minimum trust score a request needs to reach the service. 0 disables the trust evaluation.
+	PDPFailMode    string `yaml:"pdp_fail_mode"`   // PDPFailMode is either "closed" (default), denying requests if the remote PDP fails, or "open", permitting them.
+	// AccessExpression is a CEL expression every request to the service must satisfy, e.g., `request.method == "GET"`.
+	AccessExpression string `yaml:"access_expression"`
+	// Functions lists the in-process service functions the PEP runs in order on every request to the service.
+	Functions []FunctionConfig `yaml:"functions"`
+	// WAF configures the built-in web application firewall. It runs before all other functions of the service.
+	WAF WAFConfig `yaml:"waf"`
+	// Routes lists the routes of the service in the order they are matched. The first matching route selects the upstream.
+	Routes []RouteConfig `yaml:"routes"`
+	// Upstreams lists the replicas of the service requests matching no route are balanced across. Alternative to ServiceURL.
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+	// LoadBalancing selects the policy balancing requests across the upstreams of the service and its routes:
+	// "round_robin" (default), "least_outstanding", "random_two_choices" or "consistent_hash" on the client certificate fingerprint.
+	LoadBalancing string `yaml:"load_balancing"`
+	// UpstreamProtocol selects the protocol spoken to the upstreams of the service and its routes: "auto" (default) negotiates
+	// HTTP/2 via ALPN and falls back to HTTP/1.1, "h1" only speaks HTTP/1.1, "h2" only HTTP/2 over TLS and "h2c" HTTP/2
+	// over cleartext connections with prior knowledge.
+	UpstreamProtocol string `yaml:"upstream_protocol"`
+	// HealthCheck configures how unhealthy upstreams of the service and its routes are detected and removed from selection.
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
+	// CircuitBreaker configures the circuit breaker every upstream of the service and its routes is wrapped in.
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	// Retry configures the retries of failed requests to the service. Retries are subject to the global retry budget.
+	Retry RetryConfig `yaml:"retry"`
+	// RateLimits apply to the requests to the service in addition to the global rate limits.
+	RateLimits []RateLimitConfig `yaml:"rate_limits"`
+	// ClientCertHeader forwards the verified client certificate to the service.
+	ClientCertHeader ClientCertHeaderConfig `yaml:"client_cert_header"`
+	// HeaderRules modify the headers of all requests to the service and their responses.
+	HeaderRules HeaderRulesConfig `yaml:"header_rules"`
+	// SecurityHeaders lists the security headers added to all responses of the service. Only HSTS is added by default.
+	SecurityHeaders SecurityHeadersConfig `yaml:"security_headers"`
+	// Upgrade allows WebSocket connections to the service and limits their lifetime.
+	Upgrade UpgradeConfig `yaml:"upgrade"`
+	// CORS defines which other origins browsers may call the service from. Routes with a CORS policy of their own replace it.
+	CORS CORSConfig `yaml:"cors"`
+}
+
+// UpgradeConfig defines whether clients may open WebSocket tunnels to a service, via the HTTP/1.1 Upgrade handshake or
+// extended CONNECT over HTTP/2 (RFC 8441), and how long such a tunnel may stay open.
+type UpgradeConfig struct {
+	Enabled             bool          `yaml:"enabled"`              // Enabled allows WebSocket tunnels. Upgrade requests to other services are rejected.
+	IdleTimeout         time.Duration `yaml:"idle_timeout"`         // IdleTimeout closes tunnels without traffic in either direction. Defaults to 5m, -1 disables it.
+	MaxLifetime         time.Duration `yaml:"max_lifetime"`         // MaxLifetime closes tunnels open for longer. Defaults to 1h, -1 disables it.
+	ReauthorizeInterval time.Duration `yaml:"reauthorize_interval"` // ReauthorizeInterval is the period the PDP is asked again whether the tunnel may stay open. Defaults to 1m, -1 disables it.
+}
+
+// CORSConfig defines a Cross-Origin Resource Sharing (CORS) policy. It is enforced if any origin is allowed.
+// The PEP answers preflight requests itself and rejects requests from other origins before they reach the PDP.
+type CORSConfig struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins"`   // AllowedOrigins lists the allowed origins, e.g., "https://app.example.de", "https://*.example.de" or "*".
+	AllowedMethods   []string      `yaml:"allowed_methods"`   // AllowedMethods lists the methods allowed in cross-origin requests. Defaults to GET, HEAD and POST.
+	AllowedHeaders   []string      `yaml:"allowed_headers"`   // AllowedHeaders lists the request headers allowed in cross-origin requests. "*" allows all.
+	ExposedHeaders   []string      `yaml:"exposed_headers"`   // ExposedHeaders lists the response headers scripts of other origins may read.
+	AllowCredentials bool          `yaml:"allow_credentials"` // AllowCredentials allows cookies and client certificates in cross-origin requests. Not allowed with origin "*".
+	MaxAge           time.Duration `yaml:"max_age"`           // MaxAge is the period browsers may cache preflight results, e.g., "10m". 0 omits the header.
+}
+
+// SecurityHeadersConfig defines the security headers added to the responses of a service.
+// Headers other than HSTS are only added if a value is configured.
+type SecurityHeadersConfig struct {
+	HSTS                      HSTSConfig           `yaml:"hsts"`                         // HSTS configures the Strict-Transport-Security header.
+	ContentSecurityPolicy     SecurityHeaderConfig `yaml:"content_security_policy"`      // ContentSecurityPolicy configures the Content-Security-Policy header.
+	XFrameOptions             SecurityHeaderConfig `yaml:"x_frame_options"`              // XFrameOptions configures the X-Frame-Options header, e.g., "DENY".
+	XContentTypeOptions       SecurityHeaderConfig `yaml:"x_content_type_options"`       // XContentTypeOptions configures the X-Content-Type-Options header, e.g., "nosniff".
+	ReferrerPolicy            SecurityHeaderConfig `yaml:"referrer_policy"`              // ReferrerPolicy configures the Referrer-Policy header.
+	PermissionsPolicy         SecurityHeaderConfig `yaml:"permissions_policy"`           // PermissionsPolicy configures the Permissions-Policy header.
+	CrossOriginOpenerPolicy   SecurityHeaderConfig `yaml:"cross_origin_opener_policy"`   // CrossOriginOpenerPolicy configures the Cross-Origin-Opener-Policy header.
+	CrossOriginEmbedderPolicy SecurityHeaderConfig `yaml:"cross_origin_embedder_policy"` // CrossOriginEmbedderPolicy configures the Cross-Origin-Embedder-Policy header.
+	CrossOriginResourcePolicy SecurityHeaderConfig `yaml:"cross_origin_resource_policy"` // CrossOriginResourcePolicy configures the Cross-Origin-Resource-Policy header.
+}
+
+// SecurityHeaderConfig defines the value of a security header and whether it replaces a value set by the service.
+type SecurityHeaderConfig struct {
+	Value string `yaml:"value"` // Value of the header. Empty values are not added.
+	Mode  string `yaml:"mode"`  // Mode is either "override" (default), replacing the value of the service, or "if_absent", keeping it.
+}
+
+// HSTSConfig defines the Strict-Transport-Security header. Without configuration it is "max-age=63072000; includeSubDomains".
+type HSTSConfig struct {
+	Disabled          bool          `yaml:"disabled"`           // Disabled omits the header.
+	MaxAge            time.Duration `yaml:"max_age"`            // MaxAge is the period browsers only use HTTPS, e.g., "8760h". Defaults to two years.
+	IncludeSubDomains *bool         `yaml:"include_subdomains"` // IncludeSubDomains extends the policy to all subdomains. Defaults to true.
+	Preload           bool          `yaml:"preload"`            // Preload requests inclusion in the browsers' preload lists. Requires subdomains and a max_age of a year.
+	Mode              string        `yaml:"mode"`               // Mode is either "override" (default) or "if_absent".
+}
+
+// HeaderRulesConfig declares header modifications of requests toward a service and of responses toward the client.
+// Values may contain the template variables ${client_cn}, ${client_fingerprint}, ${request_hash}, ${sni}, ${source_ip},
+// ${method} and ${path}. Control characters in the values of variables are percent-encoded.
+type HeaderRulesConfig struct {
+	Request  HeaderOperationsConfig `yaml:"request"`  // Request modifies requests before they are forwarded.
+	Response HeaderOperationsConfig `yaml:"response"` // Response modifies responses before they are returned to the client.
+}
+
+// HeaderOperationsConfig lists header modifications. Headers are removed first, then set, then added.
+type HeaderOperationsConfig struct {
+	Remove []string          `yaml:"remove"` // Remove lists headers to delete, e.g., ["Server", "X-Powered-By"].
+	Set    map[string]string `yaml:"set"`    // Set replaces all values of a header with the given value.
+	Add    map[string]string `yaml:"add"`    // Add appends the given value to a header.
+}
+
+// ClientCertHeaderConfig defines the header, in the style of Envoy's X-Forwarded-Client-Cert, passing the verified client
+// certificate on to a service, e.g., `Hash=...;Subject="CN=alice,OU=Security";URI=spiffe://example.de/alice;DNS=alice.example.de`.
+// Copies of the header sent by clients are always removed.
+type ClientCertHeaderConfig struct {
+	Enabled    bool   `yaml:"enabled"`     // Enabled adds the header to requests with a verified client certificate.
+	Name       string `yaml:"name"`        // Name is the name of the header. Defaults to "X-Forwarded-Client-Cert".
+	IncludePEM bool   `yaml:"include_pem"` // IncludePEM adds the URL encoded PEM of the certificate as Cert element.
+}
+
+// RetryConfig defines which failed requests to a service are retried.
+// Requests with idempotent methods are retried, others only if marked safe by the SafeHeader.
+type RetryConfig struct {
+	MaxRetries  int           `yaml:"max_retries"`  // MaxRetries is the number of retries after the first attempt. 0 disables retries.
+	RetryOn     []int         `yaml:"retry_on"`     // RetryOn lists the status codes triggering a retry, e.g., [502, 503, 504]. Connect failures (dial or TLS handshake) are always retried, other transport errors never.
+	SafeHeader  string        `yaml:"safe_header"`  // SafeHeader is a request header marking requests with any method as safe to retry, e.g., "Idempotency-Key".
+	BaseBackoff time.Duration `yaml:"base_backoff"` // BaseBackoff is the backoff before the first retry. It doubles with every retry and is jittered. Defaults to 25ms.
+	MaxBackoff  time.Duration `yaml:"max_backoff"`  // MaxBackoff caps the backoff. Defaults to 250ms.
+	Failover    bool          `yaml:"failover"`     // Failover sends retries to a different upstream than the failed attempt if one is available.
+	BodyLimit   int64         `yaml:"body_limit"`   // BodyLimit is the size up to which request bodies are buffered for replay. Larger requests are not retried. Defaults to 64 KiB.
+}
+
+// CircuitBreakerConfig defines when the circuit breaker of an upstream opens. While it is open, requests fail fast with a 503.
+// After OpenDuration the breaker is half-open and lets a few trial requests through, which decide whether it closes again.
+// Only requests sent directly to an upstream count, not those chained through service functions.
+type CircuitBreakerConfig struct {
+	ErrorRateThreshold   float64       `yaml:"error_rate_threshold"`   // ErrorRateThreshold is the percentage of failed requests (connect errors and 5xx) opening the breaker. 0 disables it.
+	SlowRequestThreshold time.Duration `yaml:"slow_request_threshold"` // SlowRequestThreshold is the time to response headers above which a request counts as slow. 0 disables latency tracking.
+	SlowRateThreshold    float64       `yaml:"slow_rate_threshold"`    // SlowRateThreshold is the percentage of slow requests opening the breaker. 0 disables it.
+	Window               time.Duration `yaml:"window"`                 // Window is the period the rates are calculated over. Defaults to 10s.
+	MinRequests          int           `yaml:"min_requests"`           // MinRequests is the number of requests in a window before the rates are evaluated. Defaults to 20.
+	OpenDuration         time.Duration `yaml:"open_duration"`          // OpenDuration is the period the breaker stays open. Defaults to 30s.
+	HalfOpenRequests     int           `yaml:"half_open_requests"`     // HalfOpenRequests is the number of trial requests that must succeed to close the breaker. Defaults to 3.
+}
+
+// HealthCheckConfig combines the active and passive health checking of a service's upstreams.
+// An upstream is only selected if it passes both.
+type HealthCheckConfig struct {
+	Active  ActiveHealthCheckConfig  `yaml:"active"`  // Active configures periodic probes of every upstream.
+	Passive PassiveHealthCheckConfig `yaml:"passive"` // Passive configures the ejection of upstreams based on the outcome of forwarded requests.
+}
+
+// ActiveHealthCheckConfig defines the HTTP GET probes sent to every upstream using the services TLS configuration.
+type ActiveHealthCheckConfig struct {
+	Path               string        `yaml:"path"`                // Path is the path probed on every upstream, e.g., "/healthz". Empty disables active health checks.
+	Interval           time.Duration `yaml:"interval"`            // Interval is the period between two probes. Defaults to 10s.
+	Timeout            time.Duration `yaml:"timeout"`             // Timeout is the time a probe may take. Defaults to 2s.
+	HealthyThreshold   int           `yaml:"healthy_threshold"`   // HealthyThreshold is the number of consecutive successful probes marking an upstream healthy. Defaults to 2.
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"` // UnhealthyThreshold is the number of consecutive failed probes marking an upstream unhealthy. Defaults to 3.
+}
+
+// PassiveHealthCheckConfig defines when an upstream is ejected based on the requests forwarded to it.
+// Only requests sent directly to an upstream count, not those chained through service functions.
+type PassiveHealthCheckConfig struct {
+	Consecutive5xx           int           `yaml:"consecutive_5xx"`            // Consecutive5xx is the number of 5xx responses in a row ejecting an upstream. 0 disables the check.
+	ConsecutiveConnectErrors int           `yaml:"consecutive_connect_errors"` // ConsecutiveConnectErrors is the number of failed connection attempts (dial or TLS handshake) in a row ejecting an upstream. 0 disables the check.
+	EjectionTime             time.Duration `yaml:"ejection_time"`              // EjectionTime is the period an ejected upstream is not selected. Defaults to 30s.
+}
+
+// UpstreamConfig defines a single instance of a backend.
+type UpstreamConfig struct {
+	URL    string `yaml:"url"`    // URL is the endpoint of the instance, e.g., "http://django-1.ztsfc.com:8000".
+	Weight int    `yaml:"weight"` // Weight is the share of requests the instance receives relative to the other instances. Defaults to 1.
+}
+
+// WAFConfig configures the built-in web application firewall (WAF) service function of a service.
+type WAFConfig struct {
+	Enabled   bool   `yaml:"enabled"`    // Enabled turns the WAF on for the service.
+	Mode      string `yaml:"mode"`       // Mode is either "detect" (default), only logging matches, or "block", rejecting matching requests.
+	RuleFile  string `yaml:"rule_file"`  // RuleFile is the path to a file with SecRule directives. Defaults to the built-in rule set.
+	BodyLimit int64  `yaml:"body_limit"` // BodyLimit is the number of body bytes inspected. Defaults to 128 KiB, -1 disables body inspection.
+}
+
+// FunctionConfig selects an in-process service function compiled into the proxy by the name it is registered under.
+type FunctionConfig struct {
+	Name   string            `yaml:"name"`   // Name is the name the function is registered under, e.g., "require_headers".
+	Params map[string]string `yaml:"params"` // Params holds the function specific parameters.
+}
+
+// RouteConfig defines a route of a service sending matching requests to their own upstream.
+// All configured match conditions of a route must hold. A route without conditions matches every request.
+type RouteConfig struct {
+	Name          string            `yaml:"name"`           // Name identifies the route in logs. Defaults to "route-<index>".
+	PathPrefix    string            `yaml:"path_prefix"`    // PathPrefix matches paths starting with the prefix, e.g., "/api". Prefixes match whole path segments.
+	Path          string            `yaml:"path"`           // Path matches exactly this path.
+	PathRegex     string            `yaml:"path_regex"`     // PathRegex matches paths matching the regular expression.
+	Methods       []string          `yaml:"methods"`        // Methods matches any of the listed HTTP methods.
+	Headers       map[string]string `yaml:"headers"`        // Headers matches if every listed header has the given value. An empty value only requires the header to be present.
+	UpstreamURL   string            `yaml:"upstream_url"`   // UpstreamURL is the endpoint matching requests are forwarded to.
+	Upstreams     []UpstreamConfig  `yaml:"upstreams"`      // Upstreams lists the instances matching requests are balanced across. Alternative to UpstreamURL.
+	StripPrefix   bool              `yaml:"strip_prefix"`   // StripPrefix removes PathPrefix from the path before the request is forwarded.
+	RewritePrefix string            `yaml:"rewrite_prefix"` // RewritePrefix replaces PathPrefix in the path before the request is forwarded.
+	RateLimits    []RateLimitConfig `yaml:"rate_limits"`    // RateLimits apply to the requests matching the route in addition to those of the service.
+	HeaderRules   HeaderRulesConfig `yaml:"header_rules"`   // HeaderRules apply to the requests matching the route after those of the service.
+	CORS          CORSConfig        `yaml:"cors"`           // CORS replaces the CORS policy of the service for the requests matching the route.
 }
@@ -1,5 +1,7 @@
 package configs
 
+import "time"
+
 type TLSConfig struct {
 	// For server side Certificates stores certificates shown by the server to the client
 	// For client side Certificates stores certificates shown by client to the server
@@ -10,6 +12,8 @@ type TLSConfig struct {
 	CAs []string `yaml:"cas"`
 	// certificate revocation list checked for client certificates provided by a client
 	CRL string `yaml:"crl"`
+	// period the CRL file is reloaded in, e.g., "5m". 0 loads it only once at startup
+	CRLRefreshInterval time.Duration `yaml:"crl_refresh_interval"`
 }
 
 type certificateConfig struct {
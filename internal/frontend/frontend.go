@@ -5,15 +5,20 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/leobrada/ztsfc_proxy/internal/assertion"
 	"github.com/leobrada/ztsfc_proxy/internal/configs"
 	"github.com/leobrada/ztsfc_proxy/internal/logger"
 	"github.com/leobrada/ztsfc_proxy/internal/pdp"
 	"github.com/leobrada/ztsfc_proxy/internal/pep"
 	"github.com/leobrada/ztsfc_proxy/internal/security/tlsutil"
+	"github.com/leobrada/ztsfc_proxy/internal/service"
+	// Enables extended CONNECT (RFC 8441) in the HTTP/2 server for WebSocket tunnels. It must be set before net/http
+	// is initialized, which rules out os.Setenv in NewFrontend and is not possible with a //go:debug directive.
+	_ "github.com/leobrada/ztsfc_proxy/internal/xconnect"
 )
 
 // NewFrontend creates a new HTTP server instance for the frontend using the provided configuration.
-// It initializes necessary components such as logger, TLS configuration, and Policy Enforcement Point (PEP).
+// It initializes necessary components such as logger, TLS configuration, services, Policy Decision Point (PDP) and Policy Enforcement Point (PEP).
 // Parameters:
 //   - config: A pointer to the configuration struct holding frontend and logging settings.
 //
@@ -34,19 +39,31 @@ func NewFrontend(config *configs.Config) (*http.Server, error) {
 	}
 
 	// Initialize TLS configuration for the server.
-	tls, err := tlsutil.NewServerTLS(&config.Frontend.TLS)
+	tls, clientCRL, err := tlsutil.NewServerTLS(&config.Frontend.TLS, config.Frontend.ALPN)
+	if err != nil {
+		return nil, fmt.Errorf("frontend.NewFrontend(): %v", err)
+	}
+
+	// Initialize services based on the configuration. They are shared by PDP and PEP.
+	services, err := service.NewServices(&config.Services, dpLogger, cpLogger)
 	if err != nil {
 		return nil, fmt.Errorf("frontend.NewFrontend(): %v", err)
 	}
 
 	// Initialize Policy Decision Point (PDP).
-	pdp, err := pdp.NewPDP(config, cpLogger)
+	pdp, err := pdp.NewPDP(config, cpLogger, services)
+	if err != nil {
+		return nil, fmt.Errorf("frontend.NewFrontend(): %v", err)
+	}
+
+	// Initialize the signer of the identity assertions passed to services (nil if disabled).
+	signer, err := assertion.NewSigner(&config.Assertion)
 	if err != nil {
 		return nil, fmt.Errorf("frontend.NewFrontend(): %v", err)
 	}
 
 	// Initialize Policy Enforcement Point (PEP).
-	pep, err := pep.NewPEP(config, dpLogger)
+	pep, err := pep.NewPEP(config, dpLogger, pdp, services, signer, clientCRL)
 	if err != nil {
 		return nil, fmt.Errorf("frontend.NewFrontend(): %v", err)
 	}
@@ -55,15 +72,35 @@ func NewFrontend(config *configs.Config) (*http.Server, error) {
 	mux := http.NewServeMux()
 	// Register the PEP handler to serve all incoming requests.
 	mux.Handle("/", pep)
+	// Serve the public key services verify assertions with.
+	if signer != nil {
+		mux.Handle(signer.JWKSPath(), signer)
+	}
 
 	// Create the frontend HTTP server instance with configured settings.
 	frontend := &http.Server{
 		Addr:              config.Frontend.Addr,
 		Handler:           mux,
 		TLSConfig:         tls,
+		Protocols:         newProtocols(tls.NextProtos),
 		ReadHeaderTimeout: time.Second * 5,
 		ErrorLog:          dpLogger,
 	}
 
 	return frontend, nil
 }
+
+// newProtocols returns the HTTP versions the frontend serves. Without them, the HTTP server would add the
+// protocols missing in the ALPN list to it.
+func newProtocols(nextProtos []string) *http.Protocols {
+	protocols := new(http.Protocols)
+	for _, proto := range nextProtos {
+		switch proto {
+		case "h2":
+			protocols.SetHTTP2(true)
+		case "http/1.1":
+			protocols.SetHTTP1(true)
+		}
+	}
+	return protocols
+}
@@ -0,0 +1,123 @@
+package frontend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newALPNServer starts a TLS server announcing the ALPN protocols and serving the HTTP versions newProtocols derives from them
+func newALPNServer(t *testing.T, nextProtos []string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	server.TLS = &tls.Config{NextProtos: nextProtos}
+	server.Config.Protocols = newProtocols(nextProtos)
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// get requests the server with a client speaking the given HTTP versions and returns the protocol the server received
+func get(t *testing.T, server *httptest.Server, http1, http2 bool) (string, error) {
+	t.Helper()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(http1)
+	protocols.SetHTTP2(http2)
+	transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, Protocols: protocols}
+	defer transport.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestNewProtocols(t *testing.T) {
+	tests := []struct {
+		name       string
+		nextProtos []string
+		http1      bool
+		http2      bool
+		want       string
+	}{
+		{"h2 preferred", []string{"h2", "http/1.1"}, true, true, "HTTP/2.0"},
+		{"HTTP/1.1 client", []string{"h2", "http/1.1"}, true, false, "HTTP/1.1"},
+		{"HTTP/1.1 preferred", []string{"http/1.1", "h2"}, true, true, "HTTP/1.1"},
+		{"HTTP/1.1 preferred, h2 only client", []string{"http/1.1", "h2"}, false, true, "HTTP/2.0"},
+		{"h2 disabled", []string{"http/1.1"}, true, true, "HTTP/1.1"},
+		{"h2 disabled rejects h2 only clients", []string{"http/1.1"}, false, true, ""},
+		{"h2 only", []string{"h2"}, true, true, "HTTP/2.0"},
+		{"h2 only rejects HTTP/1.1 clients", []string{"h2"}, true, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newALPNServer(t, tt.nextProtos)
+			got, err := get(t, server, tt.http1, tt.http2)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("request succeeded with %s, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("server received %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Identifier of SETTINGS_ENABLE_CONNECT_PROTOCOL (RFC 8441)
+const settingsEnableConnectProtocol = 0x8
+
+// WebSocket tunnels over HTTP/2 need extended CONNECT, which the frontend's HTTP/2 server only announces if package
+// xconnect is initialized before net/http. The check fails if the import order changes.
+func TestFrontendAdvertisesExtendedConnect(t *testing.T) {
+	server := newALPNServer(t, []string{"h2", "http/1.1"})
+
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatalf("tls.Dial(): %v", err)
+	}
+	defer conn.Close()
+
+	// Client preface followed by an empty SETTINGS frame
+	conn.Write([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"))
+	conn.Write([]byte{0, 0, 0, 0x4, 0, 0, 0, 0, 0})
+
+	// The server starts with its SETTINGS frame
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("reading frame header: %v", err)
+	}
+	if header[3] != 0x4 {
+		t.Fatalf("first frame has type %d, want SETTINGS", header[3])
+	}
+	payload := make([]byte, int(header[0])<<16|int(header[1])<<8|int(header[2]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		t.Fatalf("reading SETTINGS frame: %v", err)
+	}
+
+	for i := 0; i+6 <= len(payload); i += 6 {
+		if binary.BigEndian.Uint16(payload[i:]) == settingsEnableConnectProtocol && binary.BigEndian.Uint32(payload[i+2:]) == 1 {
+			return
+		}
+	}
+	t.Error("frontend does not announce SETTINGS_ENABLE_CONNECT_PROTOCOL")
+}
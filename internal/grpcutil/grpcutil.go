@@ -0,0 +1,74 @@
+// Package grpcutil recognizes gRPC calls among HTTP requests and provides the gRPC status codes the PEP answers them with.
+package grpcutil
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Code is a gRPC status code as sent in the grpc-status trailer
+type Code int
+
+// gRPC status codes, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	DeadlineExceeded   Code = 4
+	NotFound           Code = 5
+	AlreadyExists      Code = 6
+	PermissionDenied   Code = 7
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Aborted            Code = 10
+	OutOfRange         Code = 11
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+	DataLoss           Code = 15
+	Unauthenticated    Code = 16
+)
+
+// IsRequest reports whether the request is a gRPC call, i.e., its content type is application/grpc or one of its subtypes
+func IsRequest(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "application/grpc") {
+		return false
+	}
+	rest := contentType[len("application/grpc"):]
+	return rest == "" || rest[0] == '+' || rest[0] == ';'
+}
+
+// ParseMethod splits the path of a gRPC call, e.g., "/helloworld.Greeter/SayHello", into the fully qualified
+// service ("helloworld.Greeter") and the method ("SayHello"). ok is false if the path is no valid gRPC path.
+func ParseMethod(path string) (service, method string, ok bool) {
+	if !strings.HasPrefix(path, "/") {
+		return "", "", false
+	}
+	service, method, ok = strings.Cut(path[1:], "/")
+	if !ok || service == "" || method == "" || strings.Contains(method, "/") {
+		return "", "", false
+	}
+	return service, method, true
+}
+
+// CodeFromHTTPStatus returns the gRPC status code for an HTTP status the PEP rejects a request with
+func CodeFromHTTPStatus(status int) Code {
+	switch status {
+	case http.StatusBadRequest:
+		return InvalidArgument
+	case http.StatusUnauthorized:
+		return Unauthenticated
+	case http.StatusForbidden:
+		return PermissionDenied
+	case http.StatusNotFound, http.StatusNotImplemented:
+		return Unimplemented
+	case http.StatusTooManyRequests, http.StatusRequestEntityTooLarge:
+		return ResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return Unavailable
+	default:
+		return Internal
+	}
+}
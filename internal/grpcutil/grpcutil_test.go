@@ -0,0 +1,82 @@
+package grpcutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCodeFromHTTPStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   Code
+	}{
+		{http.StatusBadRequest, InvalidArgument},
+		{http.StatusUnauthorized, Unauthenticated},
+		{http.StatusForbidden, PermissionDenied},
+		{http.StatusNotFound, Unimplemented},
+		{http.StatusRequestEntityTooLarge, ResourceExhausted},
+		{http.StatusTooManyRequests, ResourceExhausted},
+		{http.StatusInternalServerError, Internal},
+		{http.StatusNotImplemented, Unimplemented},
+		{http.StatusBadGateway, Unavailable},
+		{http.StatusServiceUnavailable, Unavailable},
+		{http.StatusGatewayTimeout, Unavailable},
+		{http.StatusTeapot, Internal},
+	}
+
+	for _, tt := range tests {
+		if got := CodeFromHTTPStatus(tt.status); got != tt.want {
+			t.Errorf("CodeFromHTTPStatus(%d) = %d, want %d", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestIsRequest(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/grpc", true},
+		{"application/grpc+proto", true},
+		{"application/grpc;charset=utf-8", true},
+		{"application/grpc-web", false},
+		{"application/grpcx", false},
+		{"application/json", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/helloworld.Greeter/SayHello", nil)
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		if got := IsRequest(r); got != tt.want {
+			t.Errorf("IsRequest() with content type '%s' = %t, want %t", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestParseMethod(t *testing.T) {
+	tests := []struct {
+		path        string
+		wantService string
+		wantMethod  string
+		wantOK      bool
+	}{
+		{"/helloworld.Greeter/SayHello", "helloworld.Greeter", "SayHello", true},
+		{"helloworld.Greeter/SayHello", "", "", false},
+		{"/helloworld.Greeter", "", "", false},
+		{"/helloworld.Greeter/", "", "", false},
+		{"//SayHello", "", "", false},
+		{"/helloworld.Greeter/SayHello/extra", "", "", false},
+	}
+
+	for _, tt := range tests {
+		service, method, ok := ParseMethod(tt.path)
+		if service != tt.wantService || method != tt.wantMethod || ok != tt.wantOK {
+			t.Errorf("ParseMethod('%s') = ('%s', '%s', %t), want ('%s', '%s', %t)",
+				tt.path, service, method, ok, tt.wantService, tt.wantMethod, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package pdp
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/leobrada/ztsfc_proxy/internal/celexpr"
+	"github.com/leobrada/ztsfc_proxy/internal/grpcutil"
+	"github.com/leobrada/ztsfc_proxy/internal/security/tlsutil"
+)
+
+// AccessRequest holds all attributes of an incoming request the PDP bases its decision on.
+type AccessRequest struct {
+	// Verified client certificate presented during the TLS handshake (nil if the client did not authenticate)
+	ClientCert *x509.Certificate
+	// Requested service (TLS SNI)
+	SNI string
+	// HTTP method of the request
+	Method string
+	// URL path of the request
+	Path string
+	// Host requested in the HTTP request
+	Host string
+	// Header of the HTTP request
+	Header http.Header
+	// IP address the request originates from
+	SourceIP net.IP
+	// TLS version and cipher suite negotiated with the client
+	TLSVersion  uint16
+	CipherSuite uint16
+	// Application protocol negotiated with the client via ALPN ("h2" or "http/1.1")
+	Protocol string
+	// Fully qualified gRPC service and method called, e.g., "helloworld.Greeter" and "SayHello" ("" if the request is no gRPC call)
+	GRPCService string
+	GRPCMethod  string
+	// Hash of the request used to match decisions with the data plane log
+	RequestHash string
+}
+
+// NewAccessRequest extracts the attributes relevant for access control from the given http.Request.
+// Parameters:
+//   - r: The incoming request. It must have been received over TLS.
+//   - rHash: The request hash calculated by the PEP via hashutil.CalcRequestHash.
+//
+// Returns:
+//   - AccessRequest: The access request the PDP decides on.
+func NewAccessRequest(r *http.Request, rHash string) AccessRequest {
+	ar := AccessRequest{
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Host:        r.Host,
+		Header:      r.Header.Clone(),
+		RequestHash: rHash,
+	}
+
+	if r.TLS != nil {
+		ar.SNI = r.TLS.ServerName
+		ar.TLSVersion = r.TLS.Version
+		ar.CipherSuite = r.TLS.CipherSuite
+		// Clients not using ALPN are served with HTTP/1.1
+		ar.Protocol = r.TLS.NegotiatedProtocol
+		if ar.Protocol == "" {
+			ar.Protocol = "http/1.1"
+		}
+		// Only a verified certificate identifies the client
+		ar.ClientCert = tlsutil.VerifiedClientCert(r.TLS)
+	}
+
+	if grpcutil.IsRequest(r) {
+		ar.GRPCService, ar.GRPCMethod, _ = grpcutil.ParseMethod(r.URL.Path)
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ar.SourceIP = net.ParseIP(host)
+
+	return ar
+}
+
+// clientCN returns the subject common name of the client certificate or "-" if no certificate was presented
+func (ar *AccessRequest) clientCN() string {
+	if ar.ClientCert == nil {
+		return "-"
+	}
+	return ar.ClientCert.Subject.CommonName
+}
+
+// ClientFingerprint returns the hex encoded SHA-256 hash of the client certificate or "" if no certificate was presented
+func (ar *AccessRequest) ClientFingerprint() string {
+	if ar.ClientCert == nil {
+		return ""
+	}
+	fingerprint := sha256.Sum256(ar.ClientCert.Raw)
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// celAttributes converts the access request into the attributes access expressions are evaluated against
+func (ar *AccessRequest) celAttributes() *celexpr.Attributes {
+	attrs := &celexpr.Attributes{
+		RequestMethod:      ar.Method,
+		RequestPath:        ar.Path,
+		RequestHost:        ar.Host,
+		RequestSNI:         ar.SNI,
+		RequestProtocol:    ar.Protocol,
+		RequestHeaders:     make(map[string]string, len(ar.Header)),
+		RequestGRPCService: ar.GRPCService,
+		RequestGRPCMethod:  ar.GRPCMethod,
+		SourceIP:           ar.SourceIP.String(),
+	}
+
+	for name, values := range ar.Header {
+		attrs.RequestHeaders[name] = strings.Join(values, ", ")
+	}
+
+	cert := ar.ClientCert
+	if cert == nil {
+		return attrs
+	}
+
+	attrs.ClientCertPresent = true
+	attrs.ClientSubjectCN = cert.Subject.CommonName
+	attrs.ClientSubjectO = cert.Subject.Organization
+	attrs.ClientSubjectOU = cert.Subject.OrganizationalUnit
+	attrs.ClientIssuerCN = cert.Issuer.CommonName
+	attrs.ClientDNSNames = cert.DNSNames
+	attrs.ClientEmailAddresses = cert.EmailAddresses
+	attrs.ClientFingerprint = ar.ClientFingerprint()
+	for _, uri := range cert.URIs {
+		attrs.ClientURIs = append(attrs.ClientURIs, uri.String())
+	}
+	return attrs
+}
@@ -0,0 +1,50 @@
+package pdp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Decision is the result of an access control evaluation performed by the PDP.
+type Decision struct {
+	// ID identifies the decision in the control plane log and in identity assertions passed to the service
+	ID string
+	// Allow states whether the request may be forwarded to the requested service
+	Allow bool
+	// ID of the rule that determined the decision (empty if no rule matched)
+	RuleID string
+	// Human readable explanation of the decision
+	Reason string
+	// Trust score of the request (only set if the requested service defines a trust threshold)
+	TrustScore int
+	// Obligations the PEP must carry out before forwarding a permitted request
+	Obligations []Obligation
+	// Names of the service functions a permitted request must pass in order before it reaches the service
+	Chain []string
+}
+
+// Obligation is an action attached to a decision that the PEP must carry out or otherwise fail the request.
+type Obligation struct {
+	// Type names the action, e.g., "inject_header"
+	Type string `json:"type"`
+	// Parameters of the action
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// String returns "permit" or "deny" according to the decision's outcome
+func (d Decision) String() string {
+	if d.Allow {
+		return "permit"
+	}
+	return "deny"
+}
+
+// newDecisionID returns a random 128 bit decision ID in hex
+func newDecisionID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
@@ -1,29 +1,289 @@
 package pdp
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"sync"
+	"time"
 
+	"github.com/leobrada/ztsfc_proxy/internal/celexpr"
 	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/security/tlsutil"
+	"github.com/leobrada/ztsfc_proxy/internal/service"
 )
 
+const (
+	// The PDP evaluates the local policy file
+	modeLocal = "local"
+	// The PDP forwards all decisions to an external PDP service
+	modeRemote = "remote"
+
+	// Requests are denied if the remote PDP fails
+	failClosed = "closed"
+	// Requests are permitted if the remote PDP fails
+	failOpen = "open"
+)
+
+// Rule ID of decisions determined by the access expression of a service
+const ruleIDAccessExpression = "access_expression"
+
+// Rule ID of decisions made according to the fail mode of a service because the decision engine failed
+const ruleIDFailMode = "fail_mode"
+
+// engine is implemented by all sources of access control decisions, i.e., the local policy and the remote PDP
+type engine interface {
+	evaluate(ctx context.Context, ar *AccessRequest) (Decision, error)
+}
+
 // Policy Decision Point (PDP) struct defining the main access control instance for the ZTSFC proxy
 type PDP struct {
 	// ControlPlane logger PDP uses for logging all its actions
 	cpLogger *log.Logger
+	// Source of the access control decisions (local policy or remote PDP). Nil if only access expressions are used.
+	engine engine
+	// Pointer to all services the PDP decides on, holding their access expressions
+	services *service.Services
+	// Services that are permitted if the engine fails, indexed by the service's SNI
+	failOpen map[string]bool
+	// Evaluator calculating the trust score of requests to services that define a trust threshold
+	trust *trustEvaluator
+	// Minimum trust score per service, indexed by the service's SNI
+	trustThresholds map[string]int
+	// Evaluator of the shadow policy (nil if no shadow policy is configured)
+	shadow *shadowEvaluator
 }
 
 // NewPDP creates a new Policy Decision Point (PDP) instance using the provided configuration and logger.
-// It initializes and returns the PDP instance.
+// It loads the access control policy or connects to the remote PDP and returns the PDP instance.
 // Parameters:
-//   - config: A pointer to the configuration struct holding PEP settings and service configurations.
-//   - dataPlaneLogger: A pointer to the logger instance for data plane logging.
+//   - config: A pointer to the configuration struct holding PDP settings and service configurations.
+//   - controlPlaneLogger: A pointer to the logger instance for control plane logging.
+//   - services: A pointer to the initialized services holding the compiled access expressions.
 //
 // Returns:
 //   - *PDP: A pointer to the created PDP instance.
 //   - error: An error if any occurred during initialization.
-func NewPDP(config *configs.Config, controlPlaneLogger *log.Logger) (*PDP, error) {
-	// Create a new PEP instance with the provided logger and initialized services.
+func NewPDP(config *configs.Config, controlPlaneLogger *log.Logger, services *service.Services) (*PDP, error) {
+	// Initialize the source of access control decisions according to the configured mode.
+	engine, err := newEngine(config)
+	if err != nil {
+		return nil, fmt.Errorf("pdp.NewPDP(): %v", err)
+	}
+
+	// Without a policy or remote PDP, the access expression is the only source of decisions. A service without one
+	// would deny every request, which is rejected at startup instead.
+	if engine == nil {
+		for sni, targetService := range services.ServicePool {
+			if targetService.AccessExpression == nil {
+				return nil, fmt.Errorf("pdp.NewPDP(): service '%s' would deny all requests: configure pdp.policy_file, pdp.mode 'remote' or an access_expression for the service", sni)
+			}
+		}
+	}
+
+	// Every service function a local policy chains requests through must be defined.
+	if policy, ok := engine.(*policy); ok && policy != nil {
+		err = policy.checkChains(func(name string) bool {
+			_, ok := services.ServiceFunctions[name]
+			return ok
+		})
+		if err != nil {
+			return nil, fmt.Errorf("pdp.NewPDP(): %v", err)
+		}
+	}
+
+	// Compile the weighted signals the trust score is calculated from.
+	trust, err := newTrustEvaluator(config.PDP.Trust)
+	if err != nil {
+		return nil, fmt.Errorf("pdp.NewPDP(): %v", err)
+	}
+
+	trustThresholds := make(map[string]int)
+	failOpenServices := make(map[string]bool)
+	for sni, serviceConf := range config.Services.ServicePool {
+		trustThresholds[sni] = serviceConf.TrustThreshold
+
+		switch serviceConf.PDPFailMode {
+		case "", failClosed:
+		case failOpen:
+			failOpenServices[sni] = true
+		default:
+			return nil, fmt.Errorf("pdp.NewPDP(): service '%s' has unsupported pdp_fail_mode '%s'", sni, serviceConf.PDPFailMode)
+		}
+	}
+
+	// Load the shadow policy evaluated next to the enforced policy and report its statistics periodically and on demand.
+	var shadow *shadowEvaluator
+	if config.PDP.Shadow.PolicyFile != "" {
+		shadowPolicy, err := loadPolicy(config.PDP.Shadow.PolicyFile)
+		if err != nil {
+			return nil, fmt.Errorf("pdp.NewPDP(): shadow policy: %v", err)
+		}
+		shadow = newShadowEvaluator(shadowPolicy, controlPlaneLogger)
+
+		reportInterval := config.PDP.Shadow.ReportInterval
+		if reportInterval <= 0 {
+			reportInterval = defaultShadowReportInterval
+		}
+		go shadow.report(reportInterval)
+	}
+
+	// Create a new PDP instance with the provided logger, decision engine, trust and shadow evaluator.
 	return &PDP{
-		cpLogger: controlPlaneLogger,
+		cpLogger:        controlPlaneLogger,
+		engine:          engine,
+		services:        services,
+		failOpen:        failOpenServices,
+		trust:           trust,
+		trustThresholds: trustThresholds,
+		shadow:          shadow,
 	}, nil
 }
+
+// newEngine creates the decision engine selected by the PDP mode in the configuration
+func newEngine(config *configs.Config) (engine, error) {
+	switch config.PDP.Mode {
+	case "", modeLocal:
+		// Without a policy file only the access expressions of the services decide
+		if config.PDP.PolicyFile == "" {
+			return nil, nil
+		}
+		return loadPolicy(config.PDP.PolicyFile)
+	case modeRemote:
+		// The remote PDP is contacted via mTLS using the client TLS settings of the services
+		clientTLS, err := tlsutil.NewClientTLS(&config.Services.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("pdp.newEngine(): %v", err)
+		}
+		return newRemoteEngine(&config.PDP.Remote, clientTLS)
+	default:
+		return nil, fmt.Errorf("pdp.newEngine(): unsupported mode '%s'", config.PDP.Mode)
+	}
+}
+
+// Decide evaluates the given access request against the access expression of the requested service and the PDP's
+// policy and returns the resulting decision. Both must permit the request if both are configured.
+// Permitted requests must additionally reach the trust threshold of the requested service.
+// Every decision is written to the control plane log. If a shadow policy is configured, it is evaluated in place of the
+// PDP's policy under the same access expression, fail mode and trust score, and its decision is compared with the enforced one.
+func (pdp *PDP) Decide(ctx context.Context, ar AccessRequest) Decision {
+	now := time.Now()
+	pdp.trust.recordRequest(&ar, now)
+	score := pdp.trustScorer(&ar, now)
+
+	decision := pdp.evaluate(ctx, &ar, pdp.engine)
+	// Only requests the policy denies count as failed access attempts. Trust denies would otherwise lower the
+	// score further with every attempt, and engine failures are not the client's fault.
+	failed := !decision.Allow && decision.RuleID != ruleIDFailMode
+	if decision.Allow {
+		decision = pdp.evaluateTrust(&ar, decision, score)
+	}
+
+	// The shadow decision is made before the failure is recorded, so that both see the same trust score
+	var shadow Decision
+	if pdp.shadow != nil {
+		shadow = pdp.evaluate(ctx, &ar, pdp.shadow.policy)
+		if shadow.Allow {
+			shadow = pdp.evaluateTrust(&ar, shadow, score)
+		}
+	}
+
+	if failed {
+		pdp.trust.recordFailure(&ar, now)
+	}
+
+	decision.ID = newDecisionID()
+	pdp.logDecision(&ar, decision)
+
+	if pdp.shadow != nil {
+		pdp.shadow.compare(&ar, decision, shadow)
+	}
+
+	return decision
+}
+
+// Reevaluate decides again on an access request that has already been permitted, e.g., the request that opened a
+// long-lived tunnel. Unlike Decide, it does not count the request towards the trust signals of its source and is not
+// compared with the shadow policy, since the client sent no new request. The decision is written to the control plane log.
+func (pdp *PDP) Reevaluate(ctx context.Context, ar AccessRequest) Decision {
+	decision := pdp.evaluate(ctx, &ar, pdp.engine)
+	if decision.Allow {
+		decision = pdp.evaluateTrust(&ar, decision, pdp.trustScorer(&ar, time.Now()))
+	}
+
+	decision.ID = newDecisionID()
+	pdp.logDecision(&ar, decision)
+	return decision
+}
+
+// evaluate checks the access expression of the requested service and asks the given decision engine for a decision.
+// If the engine fails, the fail mode of the requested service applies.
+func (pdp *PDP) evaluate(ctx context.Context, ar *AccessRequest, engine engine) Decision {
+	var accessExpression *celexpr.Expression
+	if targetService, ok := pdp.services.ServicePool[ar.SNI]; ok {
+		accessExpression = targetService.AccessExpression
+	}
+
+	if accessExpression != nil {
+		satisfied, err := accessExpression.Eval(ar.celAttributes())
+		if err != nil {
+			return Decision{Allow: false, RuleID: ruleIDAccessExpression, Reason: fmt.Sprintf("access expression failed: %v", err)}
+		}
+		if !satisfied {
+			return Decision{Allow: false, RuleID: ruleIDAccessExpression, Reason: "access expression not satisfied"}
+		}
+	}
+
+	if engine == nil {
+		if accessExpression != nil {
+			return Decision{Allow: true, RuleID: ruleIDAccessExpression, Reason: "access expression satisfied"}
+		}
+		return Decision{Allow: false, Reason: "no policy configured for service"}
+	}
+
+	decision, err := engine.evaluate(ctx, ar)
+	if err == nil {
+		return decision
+	}
+
+	pdp.cpLogger.Printf("pdp: could not evaluate %s request to %s%s: %v - [Hash:'%s']", ar.Method, ar.SNI, ar.Path, err, ar.RequestHash)
+	if pdp.failOpen[ar.SNI] {
+		return Decision{Allow: true, RuleID: ruleIDFailMode, Reason: "PDP failure, service fails open"}
+	}
+	return Decision{Allow: false, RuleID: ruleIDFailMode, Reason: "PDP failure, service fails closed"}
+}
+
+// trustScorer returns a function that calculates the trust score of the request on its first call and returns the
+// same score on every further call. The score breakdown is logged once.
+func (pdp *PDP) trustScorer(ar *AccessRequest, now time.Time) func() trustScore {
+	return sync.OnceValue(func() trustScore {
+		score := pdp.trust.evaluate(ar, now)
+		pdp.cpLogger.Printf("pdp: trust score %d (threshold %d) for %s request from %s (CN='%s') to %s%s - %s - [Hash:'%s']",
+			score.total, pdp.trustThresholds[ar.SNI], ar.Method, ar.SourceIP, ar.clientCN(), ar.SNI, ar.Path, score, ar.RequestHash)
+		return score
+	})
+}
+
+// evaluateTrust turns the decision into a deny if the requested service defines a trust threshold and the
+// score of the request falls below it. The score is only calculated for services with a threshold.
+func (pdp *PDP) evaluateTrust(ar *AccessRequest, decision Decision, score func() trustScore) Decision {
+	threshold := pdp.trustThresholds[ar.SNI]
+	if threshold <= 0 {
+		return decision
+	}
+
+	total := score().total
+	decision.TrustScore = total
+	if total < threshold {
+		decision.Allow = false
+		decision.Reason = fmt.Sprintf("trust score %d below threshold %d", total, threshold)
+	}
+	return decision
+}
+
+// logDecision writes the decision together with the relevant request attributes to the control plane log.
+// The log includes the request hash to match decisions with requests in the data plane log.
+func (pdp *PDP) logDecision(ar *AccessRequest, decision Decision) {
+	pdp.cpLogger.Printf("pdp: %s (decision %s) for %s request from %s (CN='%s') to %s%s - rule '%s': %s - obligations: %v - chain: %v - [Hash:'%s']",
+		decision, decision.ID, ar.Method, ar.SourceIP, ar.clientCN(), ar.SNI, ar.Path, decision.RuleID, decision.Reason, decision.Obligations, decision.Chain, ar.RequestHash)
+}
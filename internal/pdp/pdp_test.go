@@ -0,0 +1,55 @@
+package pdp
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/service"
+)
+
+// Re-authorizing an open tunnel must not count as a request of its client
+func TestReevaluateSkipsAccounting(t *testing.T) {
+	trust, err := newTrustEvaluator(configs.TrustConfig{
+		AuthFailures: configs.AuthFailuresConfig{Window: time.Minute, Penalty: 10},
+		RequestRate:  configs.RequestRateConfig{Window: time.Minute, Limit: 100, Penalty: 10},
+	})
+	if err != nil {
+		t.Fatalf("newTrustEvaluator(): %v", err)
+	}
+	cpLogger := log.New(io.Discard, "", 0)
+	deny := mustPolicy(t, &configs.PolicyConfig{Rules: []configs.RuleConfig{{ID: "deny-all", Effect: effectDeny}}})
+	pdp := &PDP{
+		cpLogger: cpLogger,
+		engine:   deny,
+		services: &service.Services{ServicePool: map[string]*service.Service{"service.example.de": {}}},
+		trust:    trust,
+		shadow:   newShadowEvaluator(deny, cpLogger),
+	}
+
+	ar := AccessRequest{Method: "GET", SNI: "service.example.de", Path: "/ws", SourceIP: net.ParseIP("192.0.2.1")}
+	if decision := pdp.Decide(context.Background(), ar); decision.Allow {
+		t.Fatal("Decide() permitted the request, want deny")
+	}
+	for range 5 {
+		decision := pdp.Reevaluate(context.Background(), ar)
+		if decision.Allow || decision.ID == "" {
+			t.Fatalf("Reevaluate() = %s with ID %q, want deny with ID", decision, decision.ID)
+		}
+	}
+
+	now := time.Now()
+	if n := trust.requests.count("192.0.2.1", now); n != 1 {
+		t.Errorf("%d requests counted, want 1", n)
+	}
+	if n := trust.failures.count("192.0.2.1", now); n != 1 {
+		t.Errorf("%d failures counted, want 1", n)
+	}
+	if n := pdp.shadow.stats()["service.example.de"].Evaluations; n != 1 {
+		t.Errorf("%d shadow evaluations, want 1", n)
+	}
+}
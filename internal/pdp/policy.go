@@ -0,0 +1,315 @@
+package pdp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/leobrada/yaml_tools"
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/grpcutil"
+)
+
+const (
+	// Any matching deny rule leads to a deny decision, otherwise any matching permit rule leads to a permit decision
+	denyOverrides = "deny-overrides"
+	// Any matching permit rule leads to a permit decision, otherwise any matching deny rule leads to a deny decision
+	permitOverrides = "permit-overrides"
+
+	effectPermit = "permit"
+	effectDeny   = "deny"
+)
+
+// policy is the compiled form of a configs.PolicyConfig
+type policy struct {
+	combiningAlgorithm string
+	rules              []*rule
+}
+
+// rule is the compiled form of a configs.RuleConfig
+type rule struct {
+	id             string
+	permit         bool
+	snis           []string
+	methods        []string
+	pathPrefixes   []string
+	grpcMethods    []string
+	sourceNetworks []*net.IPNet
+	subject        configs.SubjectConfig
+	sans           configs.SANConfig
+	obligations    []Obligation
+	chain          []string
+}
+
+// loadPolicy reads the policy file from the given path and compiles it.
+// Parameters:
+//   - policyFile: The path to the YAML policy file.
+//
+// Returns:
+//   - *policy: A pointer to the compiled policy.
+//   - error: An error if the file could not be loaded or holds an invalid policy.
+func loadPolicy(policyFile string) (*policy, error) {
+
+	policyConfig := new(configs.PolicyConfig)
+	err := yaml_tools.LoadYamlFileGeneric(policyFile, policyConfig)
+	if err != nil {
+		return nil, fmt.Errorf("pdp.loadPolicy(): could not load policy file '%s': %v", policyFile, err)
+	}
+
+	p, err := newPolicy(policyConfig)
+	if err != nil {
+		return nil, fmt.Errorf("pdp.loadPolicy(): invalid policy file '%s': %v", policyFile, err)
+	}
+	return p, nil
+}
+
+// newPolicy compiles the given policy configuration. It checks the combining algorithm and all rules for validity.
+func newPolicy(policyConfig *configs.PolicyConfig) (*policy, error) {
+	p := &policy{combiningAlgorithm: policyConfig.CombiningAlgorithm}
+
+	switch p.combiningAlgorithm {
+	case "":
+		p.combiningAlgorithm = denyOverrides
+	case denyOverrides, permitOverrides:
+	default:
+		return nil, fmt.Errorf("pdp.newPolicy(): unsupported combining algorithm '%s'", p.combiningAlgorithm)
+	}
+
+	for i, ruleConfig := range policyConfig.Rules {
+		r, err := newRule(&ruleConfig)
+		if err != nil {
+			return nil, fmt.Errorf("pdp.newPolicy(): rule %d: %v", i, err)
+		}
+		p.rules = append(p.rules, r)
+	}
+
+	return p, nil
+}
+
+func newRule(ruleConfig *configs.RuleConfig) (*rule, error) {
+	if ruleConfig.ID == "" {
+		return nil, fmt.Errorf("pdp.newRule(): rule has no id")
+	}
+
+	r := &rule{
+		id:           ruleConfig.ID,
+		snis:         ruleConfig.SNIs,
+		pathPrefixes: ruleConfig.PathPrefixes,
+		subject:      ruleConfig.Subject,
+		sans:         ruleConfig.SANs,
+		chain:        ruleConfig.Chain,
+	}
+
+	switch ruleConfig.Effect {
+	case effectPermit:
+		r.permit = true
+	case effectDeny:
+		r.permit = false
+	default:
+		return nil, fmt.Errorf("pdp.newRule(): rule '%s' has unsupported effect '%s'", ruleConfig.ID, ruleConfig.Effect)
+	}
+
+	for _, obligationConfig := range ruleConfig.Obligations {
+		if obligationConfig.Type == "" {
+			return nil, fmt.Errorf("pdp.newRule(): rule '%s' has an obligation without type", ruleConfig.ID)
+		}
+		r.obligations = append(r.obligations, Obligation{Type: obligationConfig.Type, Params: obligationConfig.Params})
+	}
+
+	for _, method := range ruleConfig.Methods {
+		r.methods = append(r.methods, strings.ToUpper(method))
+	}
+
+	for _, grpcMethod := range ruleConfig.GRPCMethods {
+		if _, _, ok := grpcutil.ParseMethod("/" + grpcMethod); !ok {
+			return nil, fmt.Errorf("pdp.newRule(): rule '%s' has invalid gRPC method '%s', expected '<package>.<Service>/<Method>' or '<package>.<Service>/*'", ruleConfig.ID, grpcMethod)
+		}
+		r.grpcMethods = append(r.grpcMethods, grpcMethod)
+	}
+
+	for _, cidr := range ruleConfig.SourceNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("pdp.newRule(): rule '%s' has invalid source network '%s': %v", ruleConfig.ID, cidr, err)
+		}
+		r.sourceNetworks = append(r.sourceNetworks, network)
+	}
+
+	return r, nil
+}
+
+// evaluate runs the access request against all rules and combines the results according to the policy's combining algorithm.
+// If no rule applies to the request, access is denied. A local policy never fails.
+func (p *policy) evaluate(ctx context.Context, ar *AccessRequest) (Decision, error) {
+	return p.combine(ar), nil
+}
+
+func (p *policy) combine(ar *AccessRequest) Decision {
+	var firstPermit, firstDeny *rule
+
+	for _, r := range p.rules {
+		if !r.applies(ar) {
+			continue
+		}
+		if r.permit && firstPermit == nil {
+			firstPermit = r
+		}
+		if !r.permit && firstDeny == nil {
+			firstDeny = r
+		}
+	}
+
+	switch {
+	case p.combiningAlgorithm == denyOverrides && firstDeny != nil:
+		return firstDeny.decision()
+	case p.combiningAlgorithm == permitOverrides && firstPermit != nil:
+		return firstPermit.decision()
+	case firstPermit != nil:
+		return firstPermit.decision()
+	case firstDeny != nil:
+		return firstDeny.decision()
+	default:
+		return Decision{Allow: false, Reason: "no rule applicable"}
+	}
+}
+
+// decision returns the decision of the rule including its obligations
+func (r *rule) decision() Decision {
+	if r.permit {
+		return Decision{Allow: true, RuleID: r.id, Reason: "permit rule matched", Obligations: r.obligations, Chain: r.chain}
+	}
+	return Decision{Allow: false, RuleID: r.id, Reason: "deny rule matched", Obligations: r.obligations}
+}
+
+// checkChains returns an error if a rule chains requests through a service function that is not known
+func (p *policy) checkChains(known func(name string) bool) error {
+	for _, r := range p.rules {
+		for _, name := range r.chain {
+			if !known(name) {
+				return fmt.Errorf("pdp.policy.checkChains(): rule '%s' chains unknown service function '%s'", r.id, name)
+			}
+		}
+	}
+	return nil
+}
+
+// applies reports whether all conditions of the rule are met by the access request
+func (r *rule) applies(ar *AccessRequest) bool {
+	if len(r.snis) > 0 && !contains(r.snis, ar.SNI) {
+		return false
+	}
+	if len(r.methods) > 0 && !contains(r.methods, ar.Method) {
+		return false
+	}
+	if len(r.pathPrefixes) > 0 && !hasAnyPrefix(ar.Path, r.pathPrefixes) {
+		return false
+	}
+	if len(r.grpcMethods) > 0 && !matchesGRPCMethod(r.grpcMethods, ar) {
+		return false
+	}
+	if len(r.sourceNetworks) > 0 && !inAnyNetwork(ar.SourceIP, r.sourceNetworks) {
+		return false
+	}
+	return r.appliesToCertificate(ar)
+}
+
+// appliesToCertificate checks the subject and SAN conditions of the rule against the client certificate
+func (r *rule) appliesToCertificate(ar *AccessRequest) bool {
+	certConditions := [][]string{
+		r.subject.CommonNames, r.subject.Organizations, r.subject.OrganizationalUnits,
+		r.sans.DNSNames, r.sans.URIs, r.sans.EmailAddresses,
+	}
+
+	cert := ar.ClientCert
+	if cert == nil {
+		// Without a client certificate only rules without certificate conditions apply
+		for _, condition := range certConditions {
+			if len(condition) > 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	if len(r.subject.CommonNames) > 0 && !contains(r.subject.CommonNames, cert.Subject.CommonName) {
+		return false
+	}
+	if len(r.subject.Organizations) > 0 && !containsAny(r.subject.Organizations, cert.Subject.Organization) {
+		return false
+	}
+	if len(r.subject.OrganizationalUnits) > 0 && !containsAny(r.subject.OrganizationalUnits, cert.Subject.OrganizationalUnit) {
+		return false
+	}
+	if len(r.sans.DNSNames) > 0 && !containsAny(r.sans.DNSNames, cert.DNSNames) {
+		return false
+	}
+	if len(r.sans.URIs) > 0 {
+		uris := make([]string, 0, len(cert.URIs))
+		for _, uri := range cert.URIs {
+			uris = append(uris, uri.String())
+		}
+		if !containsAny(r.sans.URIs, uris) {
+			return false
+		}
+	}
+	if len(r.sans.EmailAddresses) > 0 && !containsAny(r.sans.EmailAddresses, cert.EmailAddresses) {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, value string) bool {
+	for _, entry := range list {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(list []string, values []string) bool {
+	for _, value := range values {
+		if contains(list, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAnyPrefix reports whether the path lies below any of the prefixes. Prefixes match whole path segments only,
+// so "/admin" matches "/admin" and "/admin/users", but not "/administrator".
+func hasAnyPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesGRPCMethod reports whether the request calls any of the gRPC methods. "<Service>/*" matches all methods of a service.
+func matchesGRPCMethod(grpcMethods []string, ar *AccessRequest) bool {
+	if ar.GRPCService == "" {
+		return false
+	}
+	for _, grpcMethod := range grpcMethods {
+		service, method, _ := strings.Cut(grpcMethod, "/")
+		if service == ar.GRPCService && (method == "*" || method == ar.GRPCMethod) {
+			return true
+		}
+	}
+	return false
+}
+
+func inAnyNetwork(ip net.IP, networks []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
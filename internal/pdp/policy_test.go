@@ -0,0 +1,118 @@
+package pdp
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/service"
+)
+
+func mustPolicy(t *testing.T, policyConfig *configs.PolicyConfig) *policy {
+	t.Helper()
+	p, err := newPolicy(policyConfig)
+	if err != nil {
+		t.Fatalf("newPolicy(): %v", err)
+	}
+	return p
+}
+
+func TestPolicyCombiningAlgorithms(t *testing.T) {
+	rules := []configs.RuleConfig{
+		{ID: "permit-api", Effect: effectPermit, PathPrefixes: []string{"/api"}},
+		{ID: "deny-api-delete", Effect: effectDeny, Methods: []string{"delete"}, PathPrefixes: []string{"/api"}},
+	}
+
+	tests := []struct {
+		name      string
+		algorithm string
+		method    string
+		path      string
+		allow     bool
+		ruleID    string
+	}{
+		{"deny-overrides permits without deny", denyOverrides, "GET", "/api/users", true, "permit-api"},
+		{"deny-overrides prefers deny", denyOverrides, "DELETE", "/api/users", false, "deny-api-delete"},
+		{"default algorithm is deny-overrides", "", "DELETE", "/api/users", false, "deny-api-delete"},
+		{"permit-overrides prefers permit", permitOverrides, "DELETE", "/api/users", true, "permit-api"},
+		{"deny-overrides denies without applicable rule", denyOverrides, "GET", "/static/app.js", false, ""},
+		{"permit-overrides denies without applicable rule", permitOverrides, "GET", "/static/app.js", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := mustPolicy(t, &configs.PolicyConfig{CombiningAlgorithm: tt.algorithm, Rules: rules})
+			decision := p.combine(&AccessRequest{Method: tt.method, Path: tt.path})
+			if decision.Allow != tt.allow || decision.RuleID != tt.ruleID {
+				t.Errorf("combine() = allow %t by rule '%s', want allow %t by rule '%s'", decision.Allow, decision.RuleID, tt.allow, tt.ruleID)
+			}
+		})
+	}
+}
+
+func TestPolicyDecisionCarriesObligationsAndChain(t *testing.T) {
+	p := mustPolicy(t, &configs.PolicyConfig{Rules: []configs.RuleConfig{{
+		ID:          "permit-all",
+		Effect:      effectPermit,
+		Obligations: []configs.ObligationConfig{{Type: "inject_header", Params: map[string]string{"name": "X-A", "value": "1"}}},
+		Chain:       []string{"ids"},
+	}}})
+
+	decision := p.combine(&AccessRequest{Method: "GET", Path: "/"})
+	if !decision.Allow || len(decision.Obligations) != 1 || decision.Obligations[0].Type != "inject_header" || len(decision.Chain) != 1 {
+		t.Errorf("combine() = %+v, want permit with obligation and chain", decision)
+	}
+}
+
+func TestNewPolicyRejectsInvalidRules(t *testing.T) {
+	tests := []struct {
+		name       string
+		policyConf configs.PolicyConfig
+	}{
+		{"unknown algorithm", configs.PolicyConfig{CombiningAlgorithm: "first-applicable"}},
+		{"missing id", configs.PolicyConfig{Rules: []configs.RuleConfig{{Effect: effectPermit}}}},
+		{"unknown effect", configs.PolicyConfig{Rules: []configs.RuleConfig{{ID: "r", Effect: "allow"}}}},
+		{"invalid network", configs.PolicyConfig{Rules: []configs.RuleConfig{{ID: "r", Effect: effectPermit, SourceNetworks: []string{"10.0.0.0"}}}}},
+		{"obligation without type", configs.PolicyConfig{Rules: []configs.RuleConfig{{ID: "r", Effect: effectPermit, Obligations: []configs.ObligationConfig{{}}}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newPolicy(&tt.policyConf); err == nil {
+				t.Error("newPolicy() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestHasAnyPrefix(t *testing.T) {
+	tests := []struct {
+		path     string
+		prefixes []string
+		want     bool
+	}{
+		{"/admin", []string{"/admin"}, true},
+		{"/admin/users", []string{"/admin"}, true},
+		{"/administrator", []string{"/admin"}, false},
+		{"/admin-public", []string{"/admin"}, false},
+		{"/admin/users", []string{"/admin/"}, true},
+		{"/admin", []string{"/admin/"}, false},
+		{"/anything", []string{"/"}, true},
+		{"/public/index.html", []string{"/api", "/public/"}, true},
+	}
+
+	for _, tt := range tests {
+		if got := hasAnyPrefix(tt.path, tt.prefixes); got != tt.want {
+			t.Errorf("hasAnyPrefix(%q, %q) = %t, want %t", tt.path, tt.prefixes, got, tt.want)
+		}
+	}
+}
+
+func TestNewPDPRejectsServiceWithoutDecisionSource(t *testing.T) {
+	services := &service.Services{ServicePool: map[string]*service.Service{"app.example.de": {}}}
+
+	_, err := NewPDP(new(configs.Config), nil, services)
+	if err == nil || !strings.Contains(err.Error(), "app.example.de") {
+		t.Errorf("NewPDP() error = %v, want error naming the service", err)
+	}
+}
@@ -0,0 +1,291 @@
+package pdp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+// Timeout applied to remote decision requests if none is configured
+const defaultRemoteTimeout = time.Second
+
+// Maximum size of a decision response read from the remote PDP
+const maxRemoteResponseSize = 1 << 20
+
+// remoteEngine asks an external PDP service with an OPA-compatible decision API for decisions
+type remoteEngine struct {
+	url     string
+	timeout time.Duration
+	client  *http.Client
+	cache   *decisionCache
+}
+
+// remoteInput is the "input" document sent to the remote PDP
+type remoteInput struct {
+	Request remoteRequestInput `json:"request"`
+	Source  remoteSourceInput  `json:"source"`
+	TLS     remoteTLSInput     `json:"tls"`
+	Client  *remoteClientInput `json:"client,omitempty"`
+}
+
+type remoteRequestInput struct {
+	Method   string           `json:"method"`
+	Path     string           `json:"path"`
+	SNI      string           `json:"sni"`
+	Protocol string           `json:"protocol"`
+	GRPC     *remoteGRPCInput `json:"grpc,omitempty"`
+}
+
+type remoteGRPCInput struct {
+	Service string `json:"service"`
+	Method  string `json:"method"`
+}
+
+type remoteSourceInput struct {
+	IP string `json:"ip"`
+}
+
+type remoteTLSInput struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+}
+
+type remoteClientInput struct {
+	Cert remoteCertInput `json:"cert"`
+}
+
+type remoteCertInput struct {
+	Subject           remoteNameInput `json:"subject"`
+	Issuer            remoteNameInput `json:"issuer"`
+	SerialNumber      string          `json:"serial_number"`
+	FingerprintSHA256 string          `json:"fingerprint_sha256"`
+	DNSNames          []string        `json:"dns_names"`
+	URIs              []string        `json:"uris"`
+	EmailAddresses    []string        `json:"email_addresses"`
+}
+
+type remoteNameInput struct {
+	CN string   `json:"cn"`
+	O  []string `json:"o"`
+	OU []string `json:"ou"`
+}
+
+// remoteResponse is the decision document returned by the remote PDP
+type remoteResponse struct {
+	Result *struct {
+		Allow       bool         `json:"allow"`
+		Reason      string       `json:"reason"`
+		Obligations []Obligation `json:"obligations"`
+		Chain       []string     `json:"chain"`
+	} `json:"result"`
+}
+
+// newRemoteEngine creates an engine asking the PDP service configured in remoteConfig.
+// Parameters:
+//   - remoteConfig: A pointer to the configuration of the remote PDP.
+//   - clientTLS: The mTLS client configuration used to connect to the remote PDP (may be nil for plain HTTP).
+//
+// Returns:
+//   - *remoteEngine: A pointer to the created engine.
+//   - error: An error if the configuration is invalid.
+func newRemoteEngine(remoteConfig *configs.RemotePDPConfig, clientTLS *tls.Config) (*remoteEngine, error) {
+	transport := &http.Transport{
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConnsPerHost: 100,
+		ForceAttemptHTTP2:   true,
+	}
+	if clientTLS != nil {
+		transport.TLSClientConfig = clientTLS.Clone()
+		transport.TLSClientConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return newRemoteEngineWithClient(remoteConfig, &http.Client{Transport: transport})
+}
+
+// newRemoteEngineWithClient creates an engine sending its decision requests via the given HTTP client.
+// It allows to use the engine against a local stand-in of the remote PDP, e.g., an httptest.Server.
+func newRemoteEngineWithClient(remoteConfig *configs.RemotePDPConfig, client *http.Client) (*remoteEngine, error) {
+	if remoteConfig.URL == "" {
+		return nil, fmt.Errorf("pdp.newRemoteEngine(): no url for the remote PDP configured")
+	}
+
+	timeout := remoteConfig.Timeout
+	if timeout <= 0 {
+		timeout = defaultRemoteTimeout
+	}
+
+	return &remoteEngine{
+		url:     remoteConfig.URL,
+		timeout: timeout,
+		client:  client,
+		cache:   newDecisionCache(remoteConfig.CacheTTL),
+	}, nil
+}
+
+// evaluate sends the access request as input document to the remote PDP and returns its decision.
+// Decisions are cached for identical input documents. An error is returned if the remote PDP could not be asked.
+func (re *remoteEngine) evaluate(ctx context.Context, ar *AccessRequest) (Decision, error) {
+	body, err := json.Marshal(map[string]remoteInput{"input": newRemoteInput(ar)})
+	if err != nil {
+		return Decision{}, fmt.Errorf("pdp.remoteEngine.evaluate(): could not marshal input: %v", err)
+	}
+
+	key := sha256.Sum256(body)
+	cacheKey := hex.EncodeToString(key[:])
+	if decision, ok := re.cache.get(cacheKey); ok {
+		return decision, nil
+	}
+
+	decision, err := re.query(ctx, body)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	re.cache.put(cacheKey, decision)
+	return decision, nil
+}
+
+// query performs a single decision request against the remote PDP
+func (re *remoteEngine) query(ctx context.Context, body []byte) (Decision, error) {
+	ctx, cancel := context.WithTimeout(ctx, re.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, re.url, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, fmt.Errorf("pdp.remoteEngine.query(): %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := re.client.Do(req)
+	if err != nil {
+		return Decision{}, fmt.Errorf("pdp.remoteEngine.query(): %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Decision{}, fmt.Errorf("pdp.remoteEngine.query(): remote PDP responded with status %d", resp.StatusCode)
+	}
+
+	var decisionResp remoteResponse
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxRemoteResponseSize)).Decode(&decisionResp); err != nil {
+		return Decision{}, fmt.Errorf("pdp.remoteEngine.query(): could not decode response: %v", err)
+	}
+	// OPA omits the result if the queried document is undefined
+	if decisionResp.Result == nil {
+		return Decision{}, fmt.Errorf("pdp.remoteEngine.query(): response holds no result")
+	}
+
+	reason := decisionResp.Result.Reason
+	if reason == "" {
+		reason = "decided by remote PDP"
+	}
+	return Decision{
+		Allow:       decisionResp.Result.Allow,
+		Reason:      reason,
+		Obligations: decisionResp.Result.Obligations,
+		Chain:       decisionResp.Result.Chain,
+	}, nil
+}
+
+// newRemoteInput builds the input document for the remote PDP from the access request
+func newRemoteInput(ar *AccessRequest) remoteInput {
+	input := remoteInput{
+		Request: remoteRequestInput{Method: ar.Method, Path: ar.Path, SNI: ar.SNI, Protocol: ar.Protocol},
+		Source:  remoteSourceInput{IP: ar.SourceIP.String()},
+		TLS: remoteTLSInput{
+			Version:     tls.VersionName(ar.TLSVersion),
+			CipherSuite: tls.CipherSuiteName(ar.CipherSuite),
+		},
+	}
+	if ar.GRPCService != "" {
+		input.Request.GRPC = &remoteGRPCInput{Service: ar.GRPCService, Method: ar.GRPCMethod}
+	}
+
+	cert := ar.ClientCert
+	if cert == nil {
+		return input
+	}
+
+	uris := make([]string, 0, len(cert.URIs))
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+	input.Client = &remoteClientInput{Cert: remoteCertInput{
+		Subject:           remoteNameInput{CN: cert.Subject.CommonName, O: cert.Subject.Organization, OU: cert.Subject.OrganizationalUnit},
+		Issuer:            remoteNameInput{CN: cert.Issuer.CommonName, O: cert.Issuer.Organization, OU: cert.Issuer.OrganizationalUnit},
+		SerialNumber:      cert.SerialNumber.String(),
+		FingerprintSHA256: ar.ClientFingerprint(),
+		DNSNames:          cert.DNSNames,
+		URIs:              uris,
+		EmailAddresses:    cert.EmailAddresses,
+	}}
+	return input
+}
+
+// decisionCache stores decisions for a fixed time to live, indexed by the hash of the input document
+type decisionCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedDecision
+	// Time the expired entries were removed the last time
+	lastSweep time.Time
+}
+
+type cachedDecision struct {
+	decision Decision
+	expires  time.Time
+}
+
+func newDecisionCache(ttl time.Duration) *decisionCache {
+	return &decisionCache{
+		ttl:       ttl,
+		entries:   make(map[string]cachedDecision),
+		lastSweep: time.Now(),
+	}
+}
+
+func (dc *decisionCache) get(key string) (Decision, bool) {
+	if dc.ttl <= 0 {
+		return Decision{}, false
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	entry, ok := dc.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return Decision{}, false
+	}
+	return entry.decision, true
+}
+
+func (dc *decisionCache) put(key string, decision Decision) {
+	if dc.ttl <= 0 {
+		return
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	now := time.Now()
+	dc.entries[key] = cachedDecision{decision: decision, expires: now.Add(dc.ttl)}
+
+	// Remove expired entries once per TTL so the cache does not grow unbounded
+	if now.Sub(dc.lastSweep) > dc.ttl {
+		for k, entry := range dc.entries {
+			if now.After(entry.expires) {
+				delete(dc.entries, k)
+			}
+		}
+		dc.lastSweep = now
+	}
+}
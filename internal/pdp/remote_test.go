@@ -0,0 +1,241 @@
+package pdp
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/service"
+)
+
+// remotePDPStandIn answers decision requests with the given response document after the given delay and counts them
+type remotePDPStandIn struct {
+	*httptest.Server
+	requests atomic.Int32
+	// Input document of the last decision request
+	lastInput atomic.Value
+}
+
+func newRemotePDPStandIn(t *testing.T, response string, delay time.Duration) *remotePDPStandIn {
+	t.Helper()
+	standIn := new(remotePDPStandIn)
+	standIn.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		standIn.requests.Add(1)
+
+		var body map[string]remoteInput
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("stand-in: could not decode decision request: %v", err)
+		}
+		standIn.lastInput.Store(body["input"])
+
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, response)
+	}))
+	t.Cleanup(standIn.Close)
+	return standIn
+}
+
+func newTestRemoteEngine(t *testing.T, standIn *remotePDPStandIn, timeout, cacheTTL time.Duration) *remoteEngine {
+	t.Helper()
+	re, err := newRemoteEngineWithClient(&configs.RemotePDPConfig{URL: standIn.URL, Timeout: timeout, CacheTTL: cacheTTL}, standIn.Client())
+	if err != nil {
+		t.Fatalf("newRemoteEngineWithClient(): %v", err)
+	}
+	return re
+}
+
+func testAccessRequest() *AccessRequest {
+	return &AccessRequest{Method: "GET", Path: "/api/users", SNI: "app.example.de", Protocol: "h2", SourceIP: net.ParseIP("10.0.0.1")}
+}
+
+func TestRemoteEngineDecisions(t *testing.T) {
+	tests := []struct {
+		name        string
+		response    string
+		allow       bool
+		reason      string
+		obligations []Obligation
+		chain       []string
+		wantErr     bool
+	}{
+		{
+			name:     "permit",
+			response: `{"result": {"allow": true}}`,
+			allow:    true,
+			reason:   "decided by remote PDP",
+		},
+		{
+			name:     "deny with reason",
+			response: `{"result": {"allow": false, "reason": "outside office network"}}`,
+			allow:    false,
+			reason:   "outside office network",
+		},
+		{
+			name:        "obligations and chain",
+			response:    `{"result": {"allow": true, "obligations": [{"type": "inject_header", "params": {"name": "X-Tenant", "value": "a"}}], "chain": ["ids", "dlp"]}}`,
+			allow:       true,
+			reason:      "decided by remote PDP",
+			obligations: []Obligation{{Type: "inject_header", Params: map[string]string{"name": "X-Tenant", "value": "a"}}},
+			chain:       []string{"ids", "dlp"},
+		},
+		{
+			name:     "undefined result",
+			response: `{}`,
+			wantErr:  true,
+		},
+		{
+			name:     "malformed response",
+			response: `{"result": `,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			standIn := newRemotePDPStandIn(t, tt.response, 0)
+			re := newTestRemoteEngine(t, standIn, time.Second, 0)
+
+			decision, err := re.evaluate(context.Background(), testAccessRequest())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("evaluate() = %+v, want error", decision)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("evaluate(): %v", err)
+			}
+
+			if decision.Allow != tt.allow || decision.Reason != tt.reason {
+				t.Errorf("evaluate() = allow %t (%s), want allow %t (%s)", decision.Allow, decision.Reason, tt.allow, tt.reason)
+			}
+			if len(decision.Obligations) != len(tt.obligations) || len(decision.Chain) != len(tt.chain) {
+				t.Fatalf("evaluate() = obligations %v, chain %v, want %v, %v", decision.Obligations, decision.Chain, tt.obligations, tt.chain)
+			}
+			for i, obligation := range tt.obligations {
+				got := decision.Obligations[i]
+				if got.Type != obligation.Type || got.Params["name"] != obligation.Params["name"] || got.Params["value"] != obligation.Params["value"] {
+					t.Errorf("obligation %d = %+v, want %+v", i, got, obligation)
+				}
+			}
+			for i, name := range tt.chain {
+				if decision.Chain[i] != name {
+					t.Errorf("chain[%d] = %s, want %s", i, decision.Chain[i], name)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoteEngineSendsInput(t *testing.T) {
+	standIn := newRemotePDPStandIn(t, `{"result": {"allow": true}}`, 0)
+	re := newTestRemoteEngine(t, standIn, time.Second, 0)
+
+	if _, err := re.evaluate(context.Background(), testAccessRequest()); err != nil {
+		t.Fatalf("evaluate(): %v", err)
+	}
+
+	input := standIn.lastInput.Load().(remoteInput)
+	if input.Request.Method != "GET" || input.Request.Path != "/api/users" || input.Request.SNI != "app.example.de" ||
+		input.Request.Protocol != "h2" || input.Source.IP != "10.0.0.1" || input.Client != nil {
+		t.Errorf("input = %+v, want the attributes of the access request", input)
+	}
+}
+
+func TestRemoteEngineCache(t *testing.T) {
+	standIn := newRemotePDPStandIn(t, `{"result": {"allow": true}}`, 0)
+	re := newTestRemoteEngine(t, standIn, time.Second, 100*time.Millisecond)
+	ar := testAccessRequest()
+
+	for i := 0; i < 3; i++ {
+		if _, err := re.evaluate(context.Background(), ar); err != nil {
+			t.Fatalf("evaluate(): %v", err)
+		}
+	}
+	if n := standIn.requests.Load(); n != 1 {
+		t.Fatalf("remote PDP asked %d times for identical requests within the TTL, want 1", n)
+	}
+
+	other := testAccessRequest()
+	other.Path = "/api/orders"
+	if _, err := re.evaluate(context.Background(), other); err != nil {
+		t.Fatalf("evaluate(): %v", err)
+	}
+	if n := standIn.requests.Load(); n != 2 {
+		t.Fatalf("remote PDP asked %d times after a different request, want 2", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, err := re.evaluate(context.Background(), ar); err != nil {
+		t.Fatalf("evaluate(): %v", err)
+	}
+	if n := standIn.requests.Load(); n != 3 {
+		t.Fatalf("remote PDP asked %d times after the cached decision expired, want 3", n)
+	}
+}
+
+func TestRemoteEngineTimeout(t *testing.T) {
+	standIn := newRemotePDPStandIn(t, `{"result": {"allow": true}}`, time.Second)
+	re := newTestRemoteEngine(t, standIn, 50*time.Millisecond, time.Minute)
+
+	start := time.Now()
+	if _, err := re.evaluate(context.Background(), testAccessRequest()); err == nil {
+		t.Fatal("evaluate() succeeded, want timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("evaluate() returned after %s, want about the timeout of 50ms", elapsed)
+	}
+
+	// Failures must not be cached
+	if _, err := re.evaluate(context.Background(), testAccessRequest()); err == nil {
+		t.Fatal("evaluate() succeeded after a failure, want another timeout error")
+	}
+	if n := standIn.requests.Load(); n != 2 {
+		t.Errorf("remote PDP asked %d times, want 2", n)
+	}
+}
+
+func TestRemoteEngineFailMode(t *testing.T) {
+	standIn := newRemotePDPStandIn(t, `{"result": {"allow": true}}`, time.Second)
+	pdp := &PDP{
+		cpLogger: log.New(io.Discard, "", 0),
+		engine:   newTestRemoteEngine(t, standIn, 20*time.Millisecond, 0),
+		services: &service.Services{ServicePool: map[string]*service.Service{
+			"open.example.de":   {},
+			"closed.example.de": {},
+		}},
+		failOpen: map[string]bool{"open.example.de": true},
+	}
+
+	tests := []struct {
+		sni   string
+		allow bool
+	}{
+		{"open.example.de", true},
+		{"closed.example.de", false},
+		{"unknown.example.de", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sni, func(t *testing.T) {
+			ar := testAccessRequest()
+			ar.SNI = tt.sni
+			if decision := pdp.evaluate(context.Background(), ar, pdp.engine); decision.Allow != tt.allow {
+				t.Errorf("evaluate() = %s (%s), want allow %t", decision, decision.Reason, tt.allow)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package pdp
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Interval the shadow statistics are logged in if none is configured
+const defaultShadowReportInterval = 5 * time.Minute
+
+// ShadowStats holds the comparison results of the shadow policy and the enforced decisions for a single service
+type ShadowStats struct {
+	// Number of requests evaluated by the shadow policy
+	Evaluations uint64
+	// Number of requests the shadow policy decided differently
+	Mismatches uint64
+	// Number of permitted requests the shadow policy would have denied
+	WouldDeny uint64
+	// Number of denied requests the shadow policy would have permitted
+	WouldPermit uint64
+}
+
+// shadowCounters is the concurrency safe form of ShadowStats
+type shadowCounters struct {
+	evaluations atomic.Uint64
+	wouldDeny   atomic.Uint64
+	wouldPermit atomic.Uint64
+}
+
+// shadowEvaluator compares the decisions of a candidate policy with the enforced decisions without affecting them
+type shadowEvaluator struct {
+	cpLogger *log.Logger
+	policy   *policy
+
+	mu       sync.Mutex
+	counters map[string]*shadowCounters
+}
+
+func newShadowEvaluator(policy *policy, cpLogger *log.Logger) *shadowEvaluator {
+	return &shadowEvaluator{
+		cpLogger: cpLogger,
+		policy:   policy,
+		counters: make(map[string]*shadowCounters),
+	}
+}
+
+// compare records whether the shadow decision for the access request matches the enforced one.
+// Every shadow decision is logged together with the request hash.
+func (se *shadowEvaluator) compare(ar *AccessRequest, enforced, shadow Decision) {
+	counters := se.countersFor(ar.SNI)
+	counters.evaluations.Add(1)
+
+	result := "match"
+	if shadow.Allow != enforced.Allow {
+		result = "mismatch"
+		if enforced.Allow {
+			counters.wouldDeny.Add(1)
+		} else {
+			counters.wouldPermit.Add(1)
+		}
+	}
+
+	se.cpLogger.Printf("pdp: shadow policy %s for %s request from %s (CN='%s') to %s%s - enforced: %s (rule '%s'), shadow: %s (rule '%s': %s) - [Hash:'%s']",
+		result, ar.Method, ar.SourceIP, ar.clientCN(), ar.SNI, ar.Path, enforced, enforced.RuleID, shadow, shadow.RuleID, shadow.Reason, ar.RequestHash)
+}
+
+func (se *shadowEvaluator) countersFor(sni string) *shadowCounters {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+
+	counters, ok := se.counters[sni]
+	if !ok {
+		counters = new(shadowCounters)
+		se.counters[sni] = counters
+	}
+	return counters
+}
+
+// stats returns a snapshot of the statistics of all services, indexed by the service's SNI
+func (se *shadowEvaluator) stats() map[string]ShadowStats {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+
+	stats := make(map[string]ShadowStats, len(se.counters))
+	for sni, counters := range se.counters {
+		s := ShadowStats{
+			Evaluations: counters.evaluations.Load(),
+			WouldDeny:   counters.wouldDeny.Load(),
+			WouldPermit: counters.wouldPermit.Load(),
+		}
+		s.Mismatches = s.WouldDeny + s.WouldPermit
+		stats[sni] = s
+	}
+	return stats
+}
+
+// report writes the statistics of all services to the control plane log periodically and whenever the process
+// receives one of the shadowReportSignals, e.g., SIGUSR1
+func (se *shadowEvaluator) report(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	requested := make(chan os.Signal, 1)
+	if len(shadowReportSignals) > 0 {
+		signal.Notify(requested, shadowReportSignals...)
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-requested:
+		}
+		se.logStats()
+	}
+}
+
+// logStats writes the current statistics of all services to the control plane log
+func (se *shadowEvaluator) logStats() {
+	stats := se.stats()
+
+	snis := make([]string, 0, len(stats))
+	for sni := range stats {
+		snis = append(snis, sni)
+	}
+	sort.Strings(snis)
+
+	for _, sni := range snis {
+		s := stats[sni]
+		se.cpLogger.Printf("pdp: shadow policy report for %s: %d evaluations, %d mismatches (%d would be denied, %d would be permitted)",
+			sni, s.Evaluations, s.Mismatches, s.WouldDeny, s.WouldPermit)
+	}
+}
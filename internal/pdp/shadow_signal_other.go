@@ -0,0 +1,8 @@
+//go:build !unix
+
+package pdp
+
+import "os"
+
+// Statistics of the shadow policy are only reported periodically on platforms without SIGUSR1
+var shadowReportSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package pdp
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals that make the PDP write the shadow policy statistics to the control plane log immediately
+var shadowReportSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,108 @@
+package pdp
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/leobrada/ztsfc_proxy/internal/celexpr"
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/service"
+)
+
+func TestShadowEvaluatorCountsMismatches(t *testing.T) {
+	candidate := mustPolicy(t, &configs.PolicyConfig{Rules: []configs.RuleConfig{
+		{ID: "permit-api", Effect: effectPermit, PathPrefixes: []string{"/api"}},
+	}})
+	var cpLog bytes.Buffer
+	se := newShadowEvaluator(candidate, log.New(&cpLog, "", 0))
+
+	requests := []struct {
+		sni      string
+		path     string
+		enforced bool
+	}{
+		{"a.example.de", "/api/users", true},   // match
+		{"a.example.de", "/static", true},      // shadow would deny
+		{"a.example.de", "/api/orders", false}, // shadow would permit
+		{"b.example.de", "/static", false},     // match
+	}
+	for _, r := range requests {
+		ar := &AccessRequest{Method: "GET", SNI: r.sni, Path: r.path, RequestHash: "hash"}
+		shadow, _ := candidate.evaluate(context.Background(), ar)
+		se.compare(ar, Decision{Allow: r.enforced}, shadow)
+	}
+
+	want := map[string]ShadowStats{
+		"a.example.de": {Evaluations: 3, Mismatches: 2, WouldDeny: 1, WouldPermit: 1},
+		"b.example.de": {Evaluations: 1},
+	}
+	stats := se.stats()
+	for sni, s := range want {
+		if stats[sni] != s {
+			t.Errorf("stats()[%s] = %+v, want %+v", sni, stats[sni], s)
+		}
+	}
+	if n := strings.Count(cpLog.String(), "shadow policy mismatch"); n != 2 {
+		t.Errorf("%d mismatches logged, want 2", n)
+	}
+	if n := strings.Count(cpLog.String(), "shadow policy match"); n != 2 {
+		t.Errorf("%d matches logged, want 2", n)
+	}
+
+	cpLog.Reset()
+	se.logStats()
+	if !strings.Contains(cpLog.String(), "a.example.de: 3 evaluations, 2 mismatches (1 would be denied, 1 would be permitted)") {
+		t.Errorf("logStats() wrote %q, want the statistics of a.example.de", cpLog.String())
+	}
+}
+
+// The shadow policy replaces only the enforced policy, so the access expression and trust threshold of the service apply to it as well
+func TestShadowPolicyIsComparedUnderTheSameConditions(t *testing.T) {
+	permitAll := mustPolicy(t, &configs.PolicyConfig{Rules: []configs.RuleConfig{{ID: "permit-all", Effect: effectPermit}}})
+	trust, err := newTrustEvaluator(configs.TrustConfig{Networks: map[string]int{"10.0.0.0/8": 50}})
+	if err != nil {
+		t.Fatalf("newTrustEvaluator(): %v", err)
+	}
+	admins, err := celexpr.Compile(`client.cert.subject.cn == "admin"`)
+	if err != nil {
+		t.Fatalf("celexpr.Compile(): %v", err)
+	}
+	var cpLog bytes.Buffer
+	cpLogger := log.New(&cpLog, "", 0)
+	pdp := &PDP{
+		cpLogger: cpLogger,
+		engine:   permitAll,
+		services: &service.Services{ServicePool: map[string]*service.Service{
+			"trusted.example.de": {},
+			"admin.example.de":   {AccessExpression: admins},
+		}},
+		trust:           trust,
+		trustThresholds: map[string]int{"trusted.example.de": 40},
+		shadow:          newShadowEvaluator(permitAll, cpLogger),
+	}
+
+	requests := []AccessRequest{
+		{Method: "GET", SNI: "trusted.example.de", Path: "/", SourceIP: net.ParseIP("192.0.2.1")}, // trust deny
+		{Method: "GET", SNI: "admin.example.de", Path: "/", SourceIP: net.ParseIP("192.0.2.1")},   // access expression deny
+		{Method: "GET", SNI: "trusted.example.de", Path: "/", SourceIP: net.ParseIP("10.0.0.1")},  // permit
+	}
+	for _, ar := range requests {
+		pdp.Decide(context.Background(), ar)
+	}
+
+	for sni, s := range pdp.shadow.stats() {
+		if s.Mismatches != 0 {
+			t.Errorf("stats()[%s] = %+v, want no mismatches", sni, s)
+		}
+	}
+	if n := strings.Count(cpLog.String(), "shadow policy match"); n != len(requests) {
+		t.Errorf("%d shadow decisions logged, want %d:\n%s", n, len(requests), cpLog.String())
+	}
+	if n := strings.Count(cpLog.String(), "pdp: trust score"); n != 2 {
+		t.Errorf("trust score logged %d times, want once per request to trusted.example.de", n)
+	}
+}
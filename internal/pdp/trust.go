@@ -0,0 +1,250 @@
+package pdp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+// trustSignal is a single contribution to the trust score of a request
+type trustSignal struct {
+	name   string
+	points int
+}
+
+// trustScore is the result of a trust evaluation including the contribution of every signal
+type trustScore struct {
+	total   int
+	signals []trustSignal
+}
+
+// String returns the score breakdown in the form "issuer=+30 network=+20 ..."
+func (ts trustScore) String() string {
+	parts := make([]string, 0, len(ts.signals))
+	for _, signal := range ts.signals {
+		parts = append(parts, fmt.Sprintf("%s=%+d", signal.name, signal.points))
+	}
+	return strings.Join(parts, " ")
+}
+
+// trustEvaluator calculates the trust score of requests based on the weighted signals of a configs.TrustConfig
+type trustEvaluator struct {
+	config       configs.TrustConfig
+	networks     map[*net.IPNet]int
+	cipherSuites map[uint16]bool
+
+	// Timestamps of recent failed access attempts and requests, indexed by source IP
+	failures *slidingWindow
+	requests *slidingWindow
+}
+
+// newTrustEvaluator compiles the given trust configuration
+func newTrustEvaluator(trustConfig configs.TrustConfig) (*trustEvaluator, error) {
+	te := &trustEvaluator{
+		config:       trustConfig,
+		networks:     make(map[*net.IPNet]int),
+		cipherSuites: make(map[uint16]bool),
+	}
+
+	for cidr, weight := range trustConfig.Networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("pdp.newTrustEvaluator(): invalid network '%s': %v", cidr, err)
+		}
+		te.networks[network] = weight
+	}
+
+	for _, name := range trustConfig.TLS.CipherSuites {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("pdp.newTrustEvaluator(): unknown cipher suite '%s'", name)
+		}
+		te.cipherSuites[id] = true
+	}
+
+	bh := trustConfig.BusinessHours
+	if bh.Start < 0 || bh.Start > 24 || bh.End < 0 || bh.End > 24 {
+		return nil, fmt.Errorf("pdp.newTrustEvaluator(): business hours %d-%d are out of range", bh.Start, bh.End)
+	}
+
+	// Only as many events are kept per source as can still change its score: requests beyond the limit add no
+	// further penalty, and failures whose penalties exceed all points a request can gain keep every score negative
+	maxFailures := 0
+	if penalty := trustConfig.AuthFailures.Penalty; penalty > 0 {
+		maxFailures = te.maxPoints()/penalty + 1
+	}
+	maxRequests := 0
+	if trustConfig.RequestRate.Limit > 0 {
+		maxRequests = trustConfig.RequestRate.Limit + 1
+	}
+	te.failures = newSlidingWindow(trustConfig.AuthFailures.Window, maxFailures)
+	te.requests = newSlidingWindow(trustConfig.RequestRate.Window, maxRequests)
+
+	return te, nil
+}
+
+// maxPoints returns the highest trust score a request can reach
+func (te *trustEvaluator) maxPoints() int {
+	issuerPoints := 0
+	for _, weight := range te.config.Issuers {
+		issuerPoints = max(issuerPoints, weight)
+	}
+	networkPoints := 0
+	for _, weight := range te.networks {
+		networkPoints = max(networkPoints, weight)
+	}
+	return issuerPoints + networkPoints + max(te.config.BusinessHours.Weight, 0) + max(te.config.TLS.Weight, 0)
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// recordRequest remembers that the request's source sent a request. Must be called once per request.
+func (te *trustEvaluator) recordRequest(ar *AccessRequest, now time.Time) {
+	te.requests.add(ar.SourceIP.String(), now)
+}
+
+// recordFailure remembers a failed access attempt of the request's source
+func (te *trustEvaluator) recordFailure(ar *AccessRequest, now time.Time) {
+	te.failures.add(ar.SourceIP.String(), now)
+}
+
+// evaluate calculates the trust score of the access request
+func (te *trustEvaluator) evaluate(ar *AccessRequest, now time.Time) trustScore {
+	var score trustScore
+	add := func(name string, points int) {
+		score.signals = append(score.signals, trustSignal{name: name, points: points})
+		score.total += points
+	}
+
+	issuerPoints := 0
+	if ar.ClientCert != nil {
+		issuerPoints = te.config.Issuers[ar.ClientCert.Issuer.CommonName]
+	}
+	add("issuer", issuerPoints)
+
+	networkPoints, longestPrefix := 0, -1
+	for network, weight := range te.networks {
+		ones, _ := network.Mask.Size()
+		if ar.SourceIP != nil && network.Contains(ar.SourceIP) && ones > longestPrefix {
+			networkPoints, longestPrefix = weight, ones
+		}
+	}
+	add("network", networkPoints)
+
+	bh := te.config.BusinessHours
+	if inBusinessHours(bh, now.Hour()) {
+		add("business_hours", bh.Weight)
+	} else {
+		add("business_hours", 0)
+	}
+
+	if ar.TLSVersion == tls.VersionTLS13 && te.cipherSuites[ar.CipherSuite] {
+		add("tls", te.config.TLS.Weight)
+	} else {
+		add("tls", 0)
+	}
+
+	failures := te.failures.count(ar.SourceIP.String(), now)
+	add("auth_failures", -failures*te.config.AuthFailures.Penalty)
+
+	rateLimit := te.config.RequestRate.Limit
+	if rateLimit > 0 && te.requests.count(ar.SourceIP.String(), now) > rateLimit {
+		add("request_rate", -te.config.RequestRate.Penalty)
+	} else {
+		add("request_rate", 0)
+	}
+
+	return score
+}
+
+// inBusinessHours reports whether the hour lies within the business hours. Business hours with a start after
+// their end span midnight, e.g., 22-6. Equal start and end hours grant no points.
+func inBusinessHours(bh configs.BusinessHoursConfig, hour int) bool {
+	if bh.Start <= bh.End {
+		return hour >= bh.Start && hour < bh.End
+	}
+	return hour >= bh.Start || hour < bh.End
+}
+
+// slidingWindow counts events per key that happened within the configured window.
+// At most maxEvents of the most recent events are kept per key.
+type slidingWindow struct {
+	mu        sync.Mutex
+	window    time.Duration
+	maxEvents int
+	events    map[string][]time.Time
+	// Number of events added since stale keys were removed the last time
+	addsSinceSweep int
+}
+
+// Number of added events after which keys without recent events are removed
+const slidingWindowSweepInterval = 10000
+
+// newSlidingWindow returns a window that keeps at most maxEvents events per key. A window or maxEvents of 0 records nothing.
+func newSlidingWindow(window time.Duration, maxEvents int) *slidingWindow {
+	return &slidingWindow{
+		window:    window,
+		maxEvents: maxEvents,
+		events:    make(map[string][]time.Time),
+	}
+}
+
+func (sw *slidingWindow) add(key string, now time.Time) {
+	if sw.window <= 0 || sw.maxEvents <= 0 {
+		return
+	}
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	events := sw.prune(key, now)
+	if len(events) >= sw.maxEvents {
+		// Drop the oldest events, copying so that the backing array does not grow with every add
+		events = append(make([]time.Time, 0, sw.maxEvents), events[len(events)-sw.maxEvents+1:]...)
+	}
+	sw.events[key] = append(events, now)
+
+	sw.addsSinceSweep++
+	if sw.addsSinceSweep >= slidingWindowSweepInterval {
+		for k := range sw.events {
+			if len(sw.prune(k, now)) == 0 {
+				delete(sw.events, k)
+			}
+		}
+		sw.addsSinceSweep = 0
+	}
+}
+
+func (sw *slidingWindow) count(key string, now time.Time) int {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	return len(sw.prune(key, now))
+}
+
+// prune removes all events of the key that are older than the window. Caller must hold sw.mu.
+func (sw *slidingWindow) prune(key string, now time.Time) []time.Time {
+	events, ok := sw.events[key]
+	if !ok {
+		return nil
+	}
+	i := 0
+	for i < len(events) && now.Sub(events[i]) > sw.window {
+		i++
+	}
+	events = events[i:]
+	sw.events[key] = events
+	return events
+}
@@ -0,0 +1,197 @@
+package pdp
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/service"
+)
+
+func TestInBusinessHours(t *testing.T) {
+	tests := []struct {
+		name  string
+		start int
+		end   int
+		hour  int
+		want  bool
+	}{
+		{"day shift start", 7, 19, 7, true},
+		{"day shift end is exclusive", 7, 19, 19, false},
+		{"day shift before start", 7, 19, 6, false},
+		{"night shift before midnight", 22, 6, 23, true},
+		{"night shift after midnight", 22, 6, 0, true},
+		{"night shift end is exclusive", 22, 6, 6, false},
+		{"night shift during the day", 22, 6, 12, false},
+		{"whole day", 0, 24, 23, true},
+		{"empty window", 8, 8, 8, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bh := configs.BusinessHoursConfig{Start: tt.start, End: tt.end}
+			if got := inBusinessHours(bh, tt.hour); got != tt.want {
+				t.Errorf("inBusinessHours(%d-%d, %d) = %t, want %t", tt.start, tt.end, tt.hour, got, tt.want)
+			}
+		})
+	}
+}
+
+// signalPoints returns the points the named signal contributed to the score
+func signalPoints(t *testing.T, score trustScore, name string) int {
+	t.Helper()
+	for _, signal := range score.signals {
+		if signal.name == name {
+			return signal.points
+		}
+	}
+	t.Fatalf("score %s has no signal '%s'", score, name)
+	return 0
+}
+
+func mustTrustEvaluator(t *testing.T, trustConfig configs.TrustConfig) *trustEvaluator {
+	t.Helper()
+	te, err := newTrustEvaluator(trustConfig)
+	if err != nil {
+		t.Fatalf("newTrustEvaluator(): %v", err)
+	}
+	return te
+}
+
+func TestTrustSignals(t *testing.T) {
+	te := mustTrustEvaluator(t, configs.TrustConfig{
+		Issuers:      map[string]int{"Corporate CA": 30},
+		Networks:     map[string]int{"10.0.0.0/8": 10, "10.1.0.0/16": 20},
+		AuthFailures: configs.AuthFailuresConfig{Window: time.Minute, Penalty: 15},
+	})
+	now := time.Now()
+
+	t.Run("certificate", func(t *testing.T) {
+		tests := []struct {
+			name string
+			cert *x509.Certificate
+			want int
+		}{
+			{"known issuer", &x509.Certificate{Issuer: pkix.Name{CommonName: "Corporate CA"}}, 30},
+			{"unknown issuer", &x509.Certificate{Issuer: pkix.Name{CommonName: "Other CA"}}, 0},
+			{"no certificate", nil, 0},
+		}
+		for _, tt := range tests {
+			ar := &AccessRequest{SourceIP: net.ParseIP("192.0.2.1"), ClientCert: tt.cert}
+			if got := signalPoints(t, te.evaluate(ar, now), "issuer"); got != tt.want {
+				t.Errorf("%s: issuer = %d, want %d", tt.name, got, tt.want)
+			}
+		}
+	})
+
+	t.Run("network", func(t *testing.T) {
+		tests := []struct {
+			ip   string
+			want int
+		}{
+			{"10.2.0.1", 10},
+			{"10.1.0.1", 20}, // the most specific network counts
+			{"192.0.2.1", 0},
+		}
+		for _, tt := range tests {
+			ar := &AccessRequest{SourceIP: net.ParseIP(tt.ip)}
+			if got := signalPoints(t, te.evaluate(ar, now), "network"); got != tt.want {
+				t.Errorf("%s: network = %d, want %d", tt.ip, got, tt.want)
+			}
+		}
+	})
+
+	t.Run("failure rate", func(t *testing.T) {
+		ar := &AccessRequest{SourceIP: net.ParseIP("198.51.100.1")}
+		te.recordFailure(ar, now.Add(-2*time.Minute)) // outside the window
+		te.recordFailure(ar, now.Add(-30*time.Second))
+		te.recordFailure(ar, now)
+		if got := signalPoints(t, te.evaluate(ar, now), "auth_failures"); got != -30 {
+			t.Errorf("auth_failures = %d, want -30", got)
+		}
+
+		other := &AccessRequest{SourceIP: net.ParseIP("198.51.100.2")}
+		if got := signalPoints(t, te.evaluate(other, now), "auth_failures"); got != 0 {
+			t.Errorf("auth_failures of another source = %d, want 0", got)
+		}
+	})
+}
+
+func TestTrustThreshold(t *testing.T) {
+	te := mustTrustEvaluator(t, configs.TrustConfig{
+		Networks:     map[string]int{"10.0.0.0/8": 50},
+		AuthFailures: configs.AuthFailuresConfig{Window: time.Minute, Penalty: 30},
+	})
+	permit := mustPolicy(t, &configs.PolicyConfig{Rules: []configs.RuleConfig{{ID: "permit-internal", Effect: effectPermit, PathPrefixes: []string{"/internal"}}}})
+	pdp := &PDP{
+		cpLogger:        log.New(io.Discard, "", 0),
+		engine:          permit,
+		services:        &service.Services{ServicePool: map[string]*service.Service{"service.example.de": {}}},
+		trust:           te,
+		trustThresholds: map[string]int{"service.example.de": 40},
+	}
+	ctx := context.Background()
+	request := func(ip, path string) AccessRequest {
+		return AccessRequest{Method: "GET", SNI: "service.example.de", Path: path, SourceIP: net.ParseIP(ip)}
+	}
+
+	if decision := pdp.Decide(ctx, request("10.0.0.1", "/internal")); !decision.Allow || decision.TrustScore != 50 {
+		t.Errorf("Decide() from trusted network = %s with score %d, want permit with score 50", decision, decision.TrustScore)
+	}
+	if decision := pdp.Decide(ctx, request("192.0.2.1", "/internal")); decision.Allow || decision.TrustScore != 0 {
+		t.Errorf("Decide() from unknown network = %s with score %d, want deny with score 0", decision, decision.TrustScore)
+	}
+
+	// Trust denies must not count as failures, or the score of a source would drop with every attempt
+	if n := te.failures.count("192.0.2.1", time.Now()); n != 0 {
+		t.Errorf("%d failures counted after a trust deny, want 0", n)
+	}
+
+	// A policy deny counts as failure and lowers the score of the source below the threshold
+	if decision := pdp.Decide(ctx, request("10.0.0.1", "/admin")); decision.Allow {
+		t.Fatalf("Decide() for path without permit = %s, want deny", decision)
+	}
+	if decision := pdp.Decide(ctx, request("10.0.0.1", "/internal")); decision.Allow || decision.TrustScore != 20 {
+		t.Errorf("Decide() after a failure = %s with score %d, want deny with score 20", decision, decision.TrustScore)
+	}
+}
+
+// Sources must not grow their event lists without bound, no matter how many events they cause within the window
+func TestSlidingWindowKeepsMostRecentEvents(t *testing.T) {
+	sw := newSlidingWindow(time.Minute, 3)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		sw.add("192.0.2.1", now.Add(time.Duration(i)*time.Millisecond))
+	}
+
+	last := now.Add(9 * time.Millisecond)
+	if n := sw.count("192.0.2.1", last); n != 3 {
+		t.Errorf("count() = %d, want 3", n)
+	}
+	if events := sw.events["192.0.2.1"]; cap(events) > 3 || !events[2].Equal(last) {
+		t.Errorf("events = %v with capacity %d, want the 3 most recent", events, cap(events))
+	}
+}
+
+func TestTrustEventCaps(t *testing.T) {
+	te := mustTrustEvaluator(t, configs.TrustConfig{
+		Issuers:      map[string]int{"Corporate CA": 30},
+		Networks:     map[string]int{"10.0.0.0/8": 20},
+		AuthFailures: configs.AuthFailuresConfig{Window: time.Minute, Penalty: 20},
+		RequestRate:  configs.RequestRateConfig{Window: time.Minute, Limit: 5, Penalty: 10},
+	})
+
+	// 3 failures already push the maximum of 50 points below 0
+	if te.failures.maxEvents != 3 {
+		t.Errorf("failures keep %d events, want 3", te.failures.maxEvents)
+	}
+	if te.requests.maxEvents != 6 {
+		t.Errorf("requests keep %d events, want 6", te.requests.maxEvents)
+	}
+}
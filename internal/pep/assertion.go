@@ -0,0 +1,42 @@
+package pep
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/leobrada/ztsfc_proxy/internal/assertion"
+	"github.com/leobrada/ztsfc_proxy/internal/pdp"
+)
+
+// Header stripped from client requests if no assertion signer is configured
+const defaultAssertionHeader = "X-Ztsfc-Assertion"
+
+// stripAssertion removes assertions sent by the client, so services only ever see assertions minted by the PEP
+func (pep *PEP) stripAssertion(r *http.Request) {
+	r.Header.Del(defaultAssertionHeader)
+	if pep.signer != nil {
+		r.Header.Del(pep.signer.Header())
+	}
+}
+
+// setAssertion adds a signed identity assertion for the verified client certificate of a permitted request.
+// The subject is the certificate's CN and the groups are its OUs. Requests without verified certificate get no assertion.
+func (pep *PEP) setAssertion(r *http.Request, decision pdp.Decision) error {
+	if pep.signer == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	token, err := pep.signer.Sign(assertion.Claims{
+		Subject:    cert.Subject.CommonName,
+		Audience:   r.TLS.ServerName,
+		Groups:     cert.Subject.OrganizationalUnit,
+		DecisionID: decision.ID,
+		TrustScore: decision.TrustScore,
+	})
+	if err != nil {
+		return fmt.Errorf("pep.setAssertion(): %v", err)
+	}
+	r.Header.Set(pep.signer.Header(), token)
+	return nil
+}
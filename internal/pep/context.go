@@ -0,0 +1,49 @@
+package pep
+
+import (
+	"context"
+
+	"github.com/leobrada/ztsfc_proxy/internal/pdp"
+	"github.com/leobrada/ztsfc_proxy/internal/service"
+	"github.com/leobrada/ztsfc_proxy/internal/sfc"
+)
+
+// requestState is the per-request state the long-lived reverse proxies of the services hand back to the PEP's hooks
+type requestState struct {
+	// Hash of the request to match requests, decisions and responses in log files
+	hash string
+	// Decision of the PDP the request was permitted with
+	decision pdp.Decision
+	// In-process service functions of the requested service
+	functions []*sfc.Function
+	// Security headers of the service
+	securityHeaders *service.SecurityHeaders
+	// CORS policy the request was checked against. The CORS headers of the service's responses are replaced by it
+	cors *service.CORS
+	// Header rules of the service and the route, applied in this order
+	headerRules []*service.HeaderRules
+	// Values of the template variables in header rules
+	vars service.TemplateVars
+	// Access request the request was permitted with. Tunnels are re-authorized with it
+	ar pdp.AccessRequest
+	// Limits of the tunnel the request may open (nil if the service does not allow upgrades)
+	upgrade *service.Upgrade
+	// Body of the request if a max_body_size obligation limits it. The transport may wrap the body, e.g., to replay
+	// it on retries, so the PEP keeps its own reference to learn whether the limit was hit.
+	limitedBody *limitedBody
+}
+
+// stateContextKey is the context key of a request's requestState
+type stateContextKey struct{}
+
+func withRequestState(ctx context.Context, state *requestState) context.Context {
+	return context.WithValue(ctx, stateContextKey{}, state)
+}
+
+// requestStateFromContext returns the requestState stored in ctx, or an empty state if there is none
+func requestStateFromContext(ctx context.Context) *requestState {
+	if state, ok := ctx.Value(stateContextKey{}).(*requestState); ok {
+		return state
+	}
+	return new(requestState)
+}
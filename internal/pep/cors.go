@@ -0,0 +1,37 @@
+package pep
+
+import (
+	"net/http"
+
+	"github.com/leobrada/ztsfc_proxy/internal/service"
+)
+
+// enforceCORS applies the CORS policy of the route, or of the service if the route has none, to cross-origin requests.
+// Requests from disallowed origins are rejected, preflights are answered by the PEP itself and allowed requests
+// get the CORS response headers, so browsers can also read the error pages of the PEP.
+// It returns whether the request has been answered.
+func (pep *PEP) enforceCORS(w http.ResponseWriter, r *http.Request, cors *service.CORS, rHash string) bool {
+	if cors == nil || !cors.CrossOrigin(r) {
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	if !cors.AllowOrigin(origin) {
+		pep.dpLogger.Printf("cors: %s request from %s to %s rejected: origin '%s' is not allowed - [Hash:'%s']", r.Method, r.RemoteAddr, r.TLS.ServerName, origin, rHash)
+		handleError(w, r, http.StatusForbidden, 0)
+		return true
+	}
+
+	if service.IsPreflight(r) {
+		if err := cors.Preflight(w, r); err != nil {
+			pep.dpLogger.Printf("cors: preflight from %s to %s for origin '%s' rejected: %v - [Hash:'%s']", r.RemoteAddr, r.TLS.ServerName, origin, err, rHash)
+			handleError(w, r, http.StatusForbidden, 0)
+			return true
+		}
+		pep.dpLogger.Printf("cors: answered preflight from %s to %s for origin '%s' - [Hash:'%s']", r.RemoteAddr, r.TLS.ServerName, origin, rHash)
+		return true
+	}
+
+	cors.SetHeaders(w.Header(), origin)
+	return false
+}
@@ -0,0 +1,37 @@
+package pep
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/grpcutil"
+	"github.com/leobrada/ztsfc_proxy/internal/web"
+)
+
+// handleError answers a request the PEP does not forward with the error page of the status. gRPC calls get the
+// matching gRPC status instead, e.g., PERMISSION_DENIED for a 403. A positive retryAfter is sent with 429 and 503.
+func handleError(w http.ResponseWriter, r *http.Request, status int, retryAfter time.Duration) {
+	if grpcutil.IsRequest(r) {
+		web.HandleGRPCError(w, grpcutil.CodeFromHTTPStatus(status), http.StatusText(status))
+		return
+	}
+
+	switch status {
+	case http.StatusForbidden:
+		web.Handle403(w)
+	case http.StatusNotFound:
+		web.Handle404(w)
+	case http.StatusRequestEntityTooLarge:
+		web.Handle413(w)
+	case http.StatusTooManyRequests:
+		web.Handle429(w, retryAfter)
+	case http.StatusNotImplemented:
+		web.Handle501(w)
+	case http.StatusBadGateway:
+		web.Handle502(w)
+	case http.StatusServiceUnavailable:
+		web.Handle503(w, retryAfter)
+	default:
+		web.Handle500(w)
+	}
+}
@@ -0,0 +1,72 @@
+package pep
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/grpcutil"
+)
+
+// gRPC calls the PEP rejects are answered with a trailers-only response: HTTP 200 without body, carrying the
+// gRPC status in the headers
+func TestHandleErrorAnswersGRPCCallsTrailersOnly(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		want   grpcutil.Code
+	}{
+		{"deny", http.StatusForbidden, grpcutil.PermissionDenied},
+		{"body too large", http.StatusRequestEntityTooLarge, grpcutil.ResourceExhausted},
+		{"rate limited", http.StatusTooManyRequests, grpcutil.ResourceExhausted},
+		{"bad gateway", http.StatusBadGateway, grpcutil.Unavailable},
+		{"gateway timeout", http.StatusGatewayTimeout, grpcutil.Unavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/helloworld.Greeter/SayHello", nil)
+			r.Header.Set("Content-Type", "application/grpc")
+			w := httptest.NewRecorder()
+
+			handleError(w, r, tt.status, time.Second)
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("HTTP status = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			if got := resp.Header.Get("Content-Type"); got != "application/grpc" {
+				t.Errorf("Content-Type = '%s', want 'application/grpc'", got)
+			}
+			if got := resp.Header.Get("Grpc-Status"); got != strconv.Itoa(int(tt.want)) {
+				t.Errorf("Grpc-Status = '%s', want '%d'", got, tt.want)
+			}
+			if got, _ := url.PathUnescape(resp.Header.Get("Grpc-Message")); got != http.StatusText(tt.status) {
+				t.Errorf("Grpc-Message = '%s', want '%s'", got, http.StatusText(tt.status))
+			}
+			if got := resp.Header.Get("Retry-After"); got != "" {
+				t.Errorf("Retry-After = '%s', want none", got)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("body = %q, want none", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleErrorAnswersHTTPRequestsWithStatus(t *testing.T) {
+	for _, status := range []int{http.StatusForbidden, http.StatusRequestEntityTooLarge, http.StatusTooManyRequests, http.StatusBadGateway} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		w := httptest.NewRecorder()
+		handleError(w, r, status, time.Second)
+		if w.Code != status {
+			t.Errorf("handleError(%d) answered with %d", status, w.Code)
+		}
+		if got := w.Header().Get("Grpc-Status"); got != "" {
+			t.Errorf("handleError(%d) set Grpc-Status '%s' on an HTTP request", status, got)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package pep
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/leobrada/ztsfc_proxy/internal/pdp"
+)
+
+// ObligationContext is passed to an ObligationHandler for every obligation it carries out
+type ObligationContext struct {
+	// Obligation to carry out including its parameters
+	Obligation pdp.Obligation
+	// Hash of the request the obligation belongs to
+	RequestHash string
+	// DataPlane logger of the PEP
+	Logger *log.Logger
+}
+
+// ObligationHandler carries out a single type of obligation attached to a PDP decision.
+// If a handler returns an error, the PEP fails the request.
+type ObligationHandler interface {
+	// ApplyRequest is called before the request is forwarded to the service
+	ApplyRequest(oc *ObligationContext, r *http.Request) error
+	// ApplyResponse is called before the response of the service is returned to the client
+	ApplyResponse(oc *ObligationContext, resp *http.Response) error
+}
+
+var (
+	obligationHandlersMu sync.RWMutex
+	// Registered obligation handlers, indexed by the obligation type they carry out
+	obligationHandlers = map[string]ObligationHandler{
+		"inject_header":   injectHeaderHandler{},
+		"strip_header":    stripHeaderHandler{},
+		"response_header": responseHeaderHandler{},
+		"audit_body":      auditBodyHandler{},
+		"max_body_size":   maxBodySizeHandler{},
+	}
+)
+
+// RegisterObligationHandler registers the handler for the given obligation type. It is meant to be called from an
+// init() function and panics if the type is already taken, so built-in handlers can never be silently replaced.
+func RegisterObligationHandler(obligationType string, handler ObligationHandler) {
+	obligationHandlersMu.Lock()
+	defer obligationHandlersMu.Unlock()
+
+	if _, ok := obligationHandlers[obligationType]; ok {
+		panic(fmt.Sprintf("pep.RegisterObligationHandler(): obligation '%s' already has a handler", obligationType))
+	}
+	obligationHandlers[obligationType] = handler
+}
+
+func getObligationHandler(obligationType string) (ObligationHandler, bool) {
+	obligationHandlersMu.RLock()
+	defer obligationHandlersMu.RUnlock()
+
+	handler, ok := obligationHandlers[obligationType]
+	return handler, ok
+}
+
+// applyRequestObligations carries out all obligations of the decision on the request. Body limits are carried out first,
+// so that no other handler, e.g., audit_body, reads more of the body than permitted.
+// An error is returned if an obligation type is unknown or a handler fails.
+func (pep *PEP) applyRequestObligations(r *http.Request, decision pdp.Decision, rHash string) error {
+	for _, obligation := range limitsFirst(decision.Obligations) {
+		handler, ok := getObligationHandler(obligation.Type)
+		if !ok {
+			return fmt.Errorf("pep.applyRequestObligations(): no handler for obligation '%s'", obligation.Type)
+		}
+		oc := &ObligationContext{Obligation: obligation, RequestHash: rHash, Logger: pep.dpLogger}
+		if err := handler.ApplyRequest(oc, r); err != nil {
+			return fmt.Errorf("pep.applyRequestObligations(): obligation '%s' failed: %w", obligation.Type, err)
+		}
+	}
+	return nil
+}
+
+// limitsFirst returns the obligations with all max_body_size obligations first, keeping the order of the others
+func limitsFirst(obligations []pdp.Obligation) []pdp.Obligation {
+	ordered := make([]pdp.Obligation, 0, len(obligations))
+	for _, obligation := range obligations {
+		if obligation.Type == "max_body_size" {
+			ordered = append(ordered, obligation)
+		}
+	}
+	for _, obligation := range obligations {
+		if obligation.Type != "max_body_size" {
+			ordered = append(ordered, obligation)
+		}
+	}
+	return ordered
+}
+
+// applyResponseObligations carries out all obligations of the decision on the response
+func (pep *PEP) applyResponseObligations(resp *http.Response, decision pdp.Decision, rHash string) error {
+	for _, obligation := range decision.Obligations {
+		handler, ok := getObligationHandler(obligation.Type)
+		if !ok {
+			return fmt.Errorf("pep.applyResponseObligations(): no handler for obligation '%s'", obligation.Type)
+		}
+		oc := &ObligationContext{Obligation: obligation, RequestHash: rHash, Logger: pep.dpLogger}
+		if err := handler.ApplyResponse(oc, resp); err != nil {
+			return fmt.Errorf("pep.applyResponseObligations(): obligation '%s' failed: %v", obligation.Type, err)
+		}
+	}
+	return nil
+}
+
+// requireParam returns the value of the named obligation parameter or an error if it is missing
+func requireParam(oc *ObligationContext, name string) (string, error) {
+	value, ok := oc.Obligation.Params[name]
+	if !ok || value == "" {
+		return "", fmt.Errorf("missing parameter '%s'", name)
+	}
+	return value, nil
+}
+
+// injectHeaderHandler sets the request header "name" to "value" before the request is forwarded
+type injectHeaderHandler struct{}
+
+func (injectHeaderHandler) ApplyRequest(oc *ObligationContext, r *http.Request) error {
+	name, err := requireParam(oc, "name")
+	if err != nil {
+		return err
+	}
+	r.Header.Set(name, oc.Obligation.Params["value"])
+	return nil
+}
+
+func (injectHeaderHandler) ApplyResponse(oc *ObligationContext, resp *http.Response) error {
+	return nil
+}
+
+// stripHeaderHandler removes the comma separated request headers listed in "names" before the request is forwarded
+type stripHeaderHandler struct{}
+
+func (stripHeaderHandler) ApplyRequest(oc *ObligationContext, r *http.Request) error {
+	names, err := requireParam(oc, "names")
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(names, ",") {
+		r.Header.Del(strings.TrimSpace(name))
+	}
+	return nil
+}
+
+func (stripHeaderHandler) ApplyResponse(oc *ObligationContext, resp *http.Response) error {
+	return nil
+}
+
+// responseHeaderHandler sets the response header "name" to "value" before the response is returned
+type responseHeaderHandler struct{}
+
+func (responseHeaderHandler) ApplyRequest(oc *ObligationContext, r *http.Request) error {
+	_, err := requireParam(oc, "name")
+	return err
+}
+
+func (responseHeaderHandler) ApplyResponse(oc *ObligationContext, resp *http.Response) error {
+	name, err := requireParam(oc, "name")
+	if err != nil {
+		return err
+	}
+	resp.Header.Set(name, oc.Obligation.Params["value"])
+	return nil
+}
+
+// auditBodyHandler writes the full request and response body to the data plane log
+type auditBodyHandler struct{}
+
+func (auditBodyHandler) ApplyRequest(oc *ObligationContext, r *http.Request) error {
+	body, err := readAndRestoreBody(&r.Body)
+	if err != nil {
+		return err
+	}
+	oc.Logger.Printf("audit: request body of %s %s (%d bytes): %q - [Hash:'%s']", r.Method, r.URL.Path, len(body), body, oc.RequestHash)
+	return nil
+}
+
+func (auditBodyHandler) ApplyResponse(oc *ObligationContext, resp *http.Response) error {
+	// The body of a protocol switch is the tunnel itself, which cannot be audited
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return fmt.Errorf("cannot audit the traffic of an upgraded connection")
+	}
+	body, err := readAndRestoreBody(&resp.Body)
+	if err != nil {
+		return err
+	}
+	oc.Logger.Printf("audit: response body with status %d (%d bytes): %q - [Hash:'%s']", resp.StatusCode, len(body), body, oc.RequestHash)
+	return nil
+}
+
+// readAndRestoreBody reads the whole body and replaces it by a reader over the read bytes
+func readAndRestoreBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+	content, err := io.ReadAll(*body)
+	(*body).Close()
+	if err != nil {
+		// A body cut off by a max_body_size obligation must be answered with 413
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, fmt.Errorf("could not read body: %w", errBodyTooLarge)
+		}
+		return nil, fmt.Errorf("could not read body: %v", err)
+	}
+	*body = io.NopCloser(bytes.NewReader(content))
+	return content, nil
+}
+
+// errBodyTooLarge is returned if a request body exceeds the limit of a max_body_size obligation. The PEP answers with 413.
+var errBodyTooLarge = errors.New("request body too large")
+
+// maxBodySizeHandler fails requests whose body exceeds "bytes" bytes
+type maxBodySizeHandler struct{}
+
+func (maxBodySizeHandler) ApplyRequest(oc *ObligationContext, r *http.Request) error {
+	value, err := requireParam(oc, "bytes")
+	if err != nil {
+		return err
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit < 0 {
+		return fmt.Errorf("invalid parameter 'bytes': '%s'", value)
+	}
+
+	if r.ContentLength > limit {
+		return fmt.Errorf("body of %d bytes exceeds limit of %d bytes: %w", r.ContentLength, limit, errBodyTooLarge)
+	}
+	// Bodies of unknown length are cut off while they are forwarded
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &limitedBody{ReadCloser: http.MaxBytesReader(nil, r.Body, limit)}
+	}
+	return nil
+}
+
+func (maxBodySizeHandler) ApplyResponse(oc *ObligationContext, resp *http.Response) error {
+	return nil
+}
+
+// limitedBody is a request body cut off by a max_body_size obligation. It remembers whether the limit was hit,
+// since the error reaches the PEP only as a failure of the reverse proxy.
+type limitedBody struct {
+	io.ReadCloser
+	exceeded atomic.Bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		b.exceeded.Store(true)
+	}
+	return n, err
+}
+
+// bodyLimitExceeded reports whether the request failed since its body exceeded the limit of a max_body_size obligation
+func (state *requestState) bodyLimitExceeded() bool {
+	return state.limitedBody != nil && state.limitedBody.exceeded.Load()
+}
@@ -0,0 +1,280 @@
+package pep
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/logger"
+	"github.com/leobrada/ztsfc_proxy/internal/pdp"
+	"github.com/leobrada/ztsfc_proxy/internal/service"
+	"github.com/sirupsen/logrus"
+)
+
+func maxBodySizeContext(limit string) *ObligationContext {
+	return &ObligationContext{
+		Obligation: pdp.Obligation{Type: "max_body_size", Params: map[string]string{"bytes": limit}},
+		Logger:     log.New(io.Discard, "", 0),
+	}
+}
+
+func TestMaxBodySizeRejectsDeclaredLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   string
+		body    string
+		wantErr error
+	}{
+		{"below limit", "10", "hello", nil},
+		{"at limit", "5", "hello", nil},
+		{"above limit", "4", "hello", errBodyTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			err := maxBodySizeHandler{}.ApplyRequest(maxBodySizeContext(tt.limit), r)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("ApplyRequest() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaxBodySizeInvalidParameter(t *testing.T) {
+	for _, limit := range []string{"", "-1", "1MB"} {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+		if err := (maxBodySizeHandler{}).ApplyRequest(maxBodySizeContext(limit), r); err == nil {
+			t.Errorf("ApplyRequest() with bytes '%s' succeeded, want error", limit)
+		}
+	}
+}
+
+// A body of unknown length exceeding the limit fails while it is forwarded and must be answered with 413, not 502
+func TestMaxBodySizeCutsOffStreamedBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	pep := &PEP{dpLogger: log.New(io.Discard, "", 0)}
+	proxy := &httputil.ReverseProxy{
+		Rewrite:      func(pr *httputil.ProxyRequest) { pr.SetURL(backendURL) },
+		ErrorHandler: pep.proxyErrorHandler,
+	}
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := (maxBodySizeHandler{}).ApplyRequest(maxBodySizeContext("1024"), r); err != nil {
+			t.Errorf("ApplyRequest(): %v", err)
+		}
+		state := &requestState{}
+		state.limitedBody, _ = r.Body.(*limitedBody)
+		proxy.ServeHTTP(w, r.WithContext(withRequestState(r.Context(), state)))
+	}))
+	defer frontend.Close()
+
+	tests := []struct {
+		size int
+		want int
+	}{
+		{512, http.StatusOK},
+		{64 << 10, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		// Hiding the length makes the client send the body chunked
+		body := io.MultiReader(strings.NewReader(strings.Repeat("a", tt.size)))
+		resp, err := http.Post(frontend.URL, "text/plain", body)
+		if err != nil {
+			t.Fatalf("POST of %d bytes: %v", tt.size, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("POST of %d bytes answered with %d, want %d", tt.size, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestRegisterObligationHandlerPanicsOnDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("RegisterObligationHandler() replaced the built-in inject_header handler, want panic")
+		}
+	}()
+	RegisterObligationHandler("inject_header", injectHeaderHandler{})
+}
+
+// A body limit must apply before audit_body reads the body, no matter in which order the policy lists the obligations
+func TestMaxBodySizeAppliesBeforeAuditBody(t *testing.T) {
+	decision := pdp.Decision{Obligations: []pdp.Obligation{
+		{Type: "audit_body"},
+		{Type: "max_body_size", Params: map[string]string{"bytes": "8"}},
+	}}
+
+	tests := []struct {
+		name    string
+		body    string
+		wantErr error
+	}{
+		{"below limit", "hello", nil},
+		{"above limit", "hello world", errBodyTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dpLog strings.Builder
+			pep := &PEP{dpLogger: log.New(&dpLog, "", 0)}
+			// Hiding the length leaves the limit to the reader
+			r := httptest.NewRequest(http.MethodPost, "/", io.MultiReader(strings.NewReader(tt.body)))
+			r.ContentLength = -1
+
+			err := pep.applyRequestObligations(r, decision, "hash")
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("applyRequestObligations() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if strings.Contains(dpLog.String(), "audit:") {
+					t.Errorf("body over the limit was audited: %s", dpLog.String())
+				}
+				return
+			}
+
+			if !strings.Contains(dpLog.String(), `"hello"`) {
+				t.Errorf("data plane log = %q, want the audited body", dpLog.String())
+			}
+			if body, _ := io.ReadAll(r.Body); string(body) != tt.body {
+				t.Errorf("body after audit = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+// Retries buffer the request body for replay, which must not hide that the body exceeded the limit of a max_body_size obligation
+func TestMaxBodySizeOnRetriedRoute(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+
+	discard := log.New(io.Discard, "", 0)
+	services, err := service.NewServices(&configs.ServicesConfig{
+		TLS: testServicesTLS(t),
+		ServicePool: map[string]configs.ServiceConfig{
+			"service.example.de": {
+				ServiceURL: backend.URL,
+				Retry:      configs.RetryConfig{MaxRetries: 2, RetryOn: []int{503}, BodyLimit: 1024},
+			},
+		},
+	}, discard, discard)
+	if err != nil {
+		t.Fatalf("service.NewServices(): %v", err)
+	}
+	targetService := services.ServicePool["service.example.de"]
+	route := targetService.Routes[0]
+	upstream := route.Upstreams.Upstreams[0]
+
+	pep := &PEP{dpLogger: discard}
+	targetService.Proxy.ErrorHandler = pep.proxyErrorHandler
+	decision := pdp.Decision{Allow: true, Obligations: []pdp.Obligation{{Type: "max_body_size", Params: map[string]string{"bytes": "16384"}}}}
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := &requestState{hash: "hash", decision: decision}
+		if err := pep.requestDirector(w, r, upstream.URL, route, upstream, state); err != nil {
+			t.Errorf("requestDirector(): %v", err)
+		}
+		ctx := withRequestState(r.Context(), state)
+		ctx = service.WithTarget(ctx, upstream.URL)
+		ctx = service.WithUpstream(ctx, upstream)
+		targetService.Proxy.ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer frontend.Close()
+
+	tests := []struct {
+		name string
+		size int
+		want int
+	}{
+		{"buffered for retries", 512, http.StatusOK},
+		{"too large for retries", 8 << 10, http.StatusOK},
+		{"above the limit", 64 << 10, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		// Hiding the length makes the client send the body chunked, so only reading it reveals the size
+		body := io.MultiReader(strings.NewReader(strings.Repeat("a", tt.size)))
+		req, _ := http.NewRequest(http.MethodPut, frontend.URL, body)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: PUT of %d bytes: %v", tt.name, tt.size, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: PUT of %d bytes answered with %d, want %d", tt.name, tt.size, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+// testServicesTLS returns the TLS configuration of the services with a CA and its empty CRL written to a temporary directory
+func testServicesTLS(t *testing.T) configs.TLSConfig {
+	t.Helper()
+	// Loading the CRL writes to the system logger
+	if logger.SystemLogger == nil {
+		logger.SystemLogger = logrus.New()
+		logger.SystemLogger.SetOutput(io.Discard)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(): %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate(): %v", err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate(): %v", err)
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}, ca, key)
+	if err != nil {
+		t.Fatalf("x509.CreateRevocationList(): %v", err)
+	}
+
+	dir := t.TempDir()
+	caFile, crlFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.crl")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("os.WriteFile(): %v", err)
+	}
+	if err := os.WriteFile(crlFile, crl, 0o600); err != nil {
+		t.Fatalf("os.WriteFile(): %v", err)
+	}
+	return configs.TLSConfig{CAs: []string{caFile}, CRL: crlFile}
+}
@@ -1,19 +1,18 @@
 package pep
 
 import (
-	"crypto/tls"
 	"errors"
-	"fmt"
 	"log"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
-	"time"
 
+	"github.com/leobrada/ztsfc_proxy/internal/assertion"
 	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/pdp"
 	"github.com/leobrada/ztsfc_proxy/internal/security/hashutil"
+	"github.com/leobrada/ztsfc_proxy/internal/security/tlsutil"
 	"github.com/leobrada/ztsfc_proxy/internal/service"
-	"github.com/leobrada/ztsfc_proxy/internal/web"
+	"github.com/leobrada/ztsfc_proxy/internal/sfc"
 )
 
 // Policy Enforcement Point (PEP) struct defining the main HTTP handler for the frontend HTTP server
@@ -22,29 +21,45 @@ type PEP struct {
 	dpLogger *log.Logger
 	// Pointer to all services served by the PEP
 	services *service.Services
+	// Policy Decision Point (PDP) the PEP asks for a decision on every request
+	pdp *pdp.PDP
+	// Signer of the identity assertions passed to services (nil if assertions are disabled)
+	signer *assertion.Signer
+	// CRL client certificates are checked against. Open tunnels of revoked clients are closed
+	crl *tlsutil.RevocationList
 }
 
 // NewPEP creates a new Policy Enforcement Point (PEP) instance using the provided configuration and logger.
-// It initializes services based on the configuration and returns the PEP instance.
+// It returns the PEP instance serving the given services.
 // Parameters:
 //   - config: A pointer to the configuration struct holding PEP settings and service configurations.
 //   - dataPlaneLogger: A pointer to the logger instance for data plane logging.
+//   - policyDecisionPoint: A pointer to the PDP that authorizes every request before it is forwarded.
+//   - services: A pointer to the initialized services served by the PEP.
+//   - signer: A pointer to the signer of identity assertions, or nil if assertions are disabled.
+//   - clientCRL: A pointer to the CRL the frontend checks client certificates against.
 //
 // Returns:
 //   - *PEP: A pointer to the created PEP instance.
 //   - error: An error if any occurred during initialization.
-func NewPEP(config *configs.Config, dataPlaneLogger *log.Logger) (*PEP, error) {
-	// Initialize services based on the configuration.
-	services, err := service.NewServices(&config.Services)
-	if err != nil {
-		return nil, fmt.Errorf("pep.NewPEP(): %v", err)
-	}
-
-	// Create a new PEP instance with the provided logger and initialized services.
-	return &PEP{
+func NewPEP(config *configs.Config, dataPlaneLogger *log.Logger, policyDecisionPoint *pdp.PDP, services *service.Services, signer *assertion.Signer, clientCRL *tlsutil.RevocationList) (*PEP, error) {
+	// Create a new PEP instance with the provided logger, initialized services and PDP.
+	pep := &PEP{
 		dpLogger: dataPlaneLogger,
 		services: services,
-	}, nil
+		pdp:      policyDecisionPoint,
+		signer:   signer,
+		crl:      clientCRL,
+	}
+
+	// Hook the PEP into the long-lived reverse proxy of every service
+	for _, s := range services.ServicePool {
+		s.Proxy.ErrorLog = dataPlaneLogger
+		s.Proxy.ModifyResponse = pep.responseDirector
+		s.Proxy.ErrorHandler = pep.proxyErrorHandler
+	}
+
+	return pep, nil
 }
 
 func (pep *PEP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -52,85 +67,233 @@ func (pep *PEP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	targetService, ok := pep.services.ServicePool[targetSNI]
 	if !ok {
 		pep.dpLogger.Printf("pep.ServeHTTP(): requested service %s could not be served", targetSNI)
-		web.Handle404(w)
+		handleError(w, r, http.StatusNotFound, 0)
 		return
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(targetService.ServiceUrl)
-	if proxy == nil {
-		pep.dpLogger.Printf("pep.ServeHTTP(): while serving requested service %s an internal error occured", targetSNI)
-		web.Handle500(w)
-		return
+	// X-Ztsfc-* headers, the client certificate header and assertions are only set by the PEP itself and must never be accepted from clients
+	sfc.StripHeaders(r)
+	targetService.ClientCertHeader.Strip(r)
+	pep.stripAssertion(r)
+
+	// Protocol upgrades open long-lived tunnels and must be allowed by the service
+	if isUpgrade(r) || isExtendedConnect(r) {
+		if w, ok = pep.prepareUpgrade(w, r, targetService); !ok {
+			return
+		}
 	}
-	if pep != nil && pep.dpLogger != nil {
-		proxy.ErrorLog = pep.dpLogger
+
+	// Select the route of the service, which determines the upstream the request is forwarded to
+	route := targetService.Route(r)
+	if route == nil {
+		pep.dpLogger.Printf("pep.ServeHTTP(): no route of service %s matches %s request to %s", targetSNI, r.Method, r.URL.Path)
+		handleError(w, r, http.StatusNotFound, 0)
+		return
 	}
-	// Calculate the request hash to match requests and responses in log files
+
+	// Calculate the request hash to match requests, decisions and responses in log files
 	rHash := hashutil.CalcRequestHash(r)
-	proxy.ModifyResponse = pep.responseDirector(rHash)
 
-	proxyTransport, err := GetHTTPTransportForSchemeAndTLS(targetService.ServiceUrl.Scheme, pep.services.ServicesTLS)
+	// Cross-origin requests are checked before they cost a rate limit token or a PDP decision
+	cors := route.CORS
+	if cors == nil {
+		cors = targetService.CORS
+	}
+	if pep.enforceCORS(w, r, cors, rHash) {
+		return
+	}
+
+	// Reject clients exceeding a rate limit before they cost a PDP decision
+	if allowed, retryAfter := pep.checkRateLimits(r, targetService, route, rHash); !allowed {
+		handleError(w, r, http.StatusTooManyRequests, retryAfter)
+		return
+	}
+
+	// Ask the PDP for a decision and block denied requests before anything is forwarded
+	ar := pdp.NewAccessRequest(r, rHash)
+	decision := pep.pdp.Decide(r.Context(), ar)
+	if !decision.Allow {
+		pep.dpLogger.Printf("pep.ServeHTTP(): %s request from %s to %s denied by PDP - [Hash:'%s']", r.Method, r.RemoteAddr, targetSNI, rHash)
+		handleError(w, r, http.StatusForbidden, 0)
+		return
+	}
+
+	// Tell the service who the verified client is
+	targetService.ClientCertHeader.Set(r)
+	if err := pep.setAssertion(r, decision); err != nil {
+		pep.dpLogger.Printf("pep.ServeHTTP(): %s request from %s to %s failed: %v - [Hash:'%s']", r.Method, r.RemoteAddr, targetSNI, err, rHash)
+		handleError(w, r, http.StatusInternalServerError, 0)
+		return
+	}
+
+	// Select the instance of the backend and resolve the service function chain the request must pass before it reaches it
+	upstream := route.Upstreams.Select(r)
+	if upstream == nil {
+		pep.dpLogger.Printf("pep.ServeHTTP(): no healthy upstream of route '%s' of service %s available - [Hash:'%s']", route.Name, targetSNI, rHash)
+		handleError(w, r, http.StatusServiceUnavailable, 0)
+		return
+	}
+	chain, err := sfc.NewChain(decision.Chain, pep.services.ServiceFunctions, upstream.URL)
 	if err != nil {
-		pep.dpLogger.Printf("pep.ServeHTTP(): requested service %s does not implement requested scheme", targetSNI)
-		web.Handle501(w)
+		pep.dpLogger.Printf("pep.ServeHTTP(): while chaining %s request to %s an error occured: %v - [Hash:'%s']", r.Method, targetSNI, err, rHash)
+		handleError(w, r, http.StatusInternalServerError, 0)
+		return
+	}
+	if err = chain.Apply(r, newChainMetadata(&ar, decision)); err != nil {
+		pep.dpLogger.Printf("pep.ServeHTTP(): while chaining %s request to %s an error occured: %v - [Hash:'%s']", r.Method, targetSNI, err, rHash)
+		handleError(w, r, http.StatusInternalServerError, 0)
 		return
 	}
-	proxy.Transport = proxyTransport
+	nextHop := chain.FirstHop()
 
-	pep.requestDirector(w, r, targetService.ServiceUrl, rHash)
+	// Run the in-process service functions of the service before anything is forwarded
+	verdict, err := pep.runServiceFunctions(targetService.Functions, r, rHash)
+	if err != nil {
+		pep.dpLogger.Printf("pep.ServeHTTP(): %s request from %s to %s failed: %v - [Hash:'%s']", r.Method, r.RemoteAddr, targetSNI, err, rHash)
+		handleError(w, r, http.StatusInternalServerError, 0)
+		return
+	}
+	if verdict.Action == sfc.Block {
+		pep.dpLogger.Printf("pep.ServeHTTP(): %s request from %s to %s blocked by service function: %s - [Hash:'%s']", r.Method, r.RemoteAddr, targetSNI, verdict.Reason, rHash)
+		handleError(w, r, http.StatusForbidden, 0)
+		return
+	}
+
+	state := &requestState{
+		hash:            rHash,
+		decision:        decision,
+		functions:       targetService.Functions,
+		securityHeaders: targetService.SecurityHeaders,
+		cors:            cors,
+		headerRules:     []*service.HeaderRules{targetService.HeaderRules, route.HeaderRules},
+		vars:            newTemplateVars(&ar),
+		ar:              ar,
+		upgrade:         targetService.Upgrade,
+	}
 
-	proxy.ServeHTTP(w, r)
+	// A permit with obligations the PEP cannot carry out must be treated as deny
+	if err = pep.requestDirector(w, r, nextHop, route, upstream, state); err != nil {
+		pep.dpLogger.Printf("pep.ServeHTTP(): %s request from %s to %s failed: %v - [Hash:'%s']", r.Method, r.RemoteAddr, targetSNI, err, rHash)
+		if errors.Is(err, errBodyTooLarge) {
+			handleError(w, r, http.StatusRequestEntityTooLarge, 0)
+			return
+		}
+		handleError(w, r, http.StatusForbidden, 0)
+		return
+	}
+
+	// The service's proxy is shared by all requests, so everything request specific travels in the context
+	ctx := withRequestState(r.Context(), state)
+	ctx = service.WithTarget(ctx, nextHop)
+	ctx = service.WithUpstream(ctx, upstream)
+	ctx = service.WithRequestHash(ctx, rHash)
+	targetService.Proxy.ServeHTTP(w, r.WithContext(ctx))
 }
 
 // Request director is used to modify and log the request if needed
+// It carries out the request obligations of the PDP decision and returns an error if any of them fails
 // The log includes a hash of the whole request (rHash) including timestamp to match requests and responses in log files
-func (pep *PEP) requestDirector(w http.ResponseWriter, r *http.Request, resource *url.URL, rHash string) {
-	pep.dpLogger.Printf("http: forwarding %s request from %s to %s - [Hash:'%s']", r.Method, r.RemoteAddr, resource.String()+r.URL.String(), rHash)
+// The header rules of the service and the route are applied before the obligations, so obligations take precedence
+// The path prefix of the request is stripped or rewritten as configured for its route
+func (pep *PEP) requestDirector(w http.ResponseWriter, r *http.Request, resource *url.URL, route *service.Route, upstream *service.Upstream, state *requestState) error {
+	for _, rules := range state.headerRules {
+		rules.ApplyRequest(r, &state.vars)
+	}
+	if err := pep.applyRequestObligations(r, state.decision, state.hash); err != nil {
+		return err
+	}
+	state.limitedBody, _ = r.Body.(*limitedBody)
+	route.RewritePath(r)
+	pep.dpLogger.Printf("http: forwarding %s request from %s to %s (protocol: %s, route: %s, upstream: %s, chain: %v) - [Hash:'%s']", r.Method, r.RemoteAddr, resource.String()+r.URL.String(), state.ar.Protocol, route.Name, upstream.URL.String(), state.decision.Chain, state.hash)
+	return nil
+}
+
+// newTemplateVars collects the values of the template variables usable in header rules
+func newTemplateVars(ar *pdp.AccessRequest) service.TemplateVars {
+	vars := service.TemplateVars{
+		ClientFingerprint: ar.ClientFingerprint(),
+		RequestHash:       ar.RequestHash,
+		SNI:               ar.SNI,
+		Method:            ar.Method,
+		Path:              ar.Path,
+	}
+	if ar.ClientCert != nil {
+		vars.ClientCN = ar.ClientCert.Subject.CommonName
+	}
+	if ar.SourceIP != nil {
+		vars.SourceIP = ar.SourceIP.String()
+	}
+	return vars
+}
+
+// newChainMetadata builds the decision context passed along the service function chain
+func newChainMetadata(ar *pdp.AccessRequest, decision pdp.Decision) sfc.Metadata {
+	md := sfc.Metadata{
+		RequestHash:       ar.RequestHash,
+		SNI:               ar.SNI,
+		RuleID:            decision.RuleID,
+		TrustScore:        decision.TrustScore,
+		ClientFingerprint: ar.ClientFingerprint(),
+	}
+	if ar.ClientCert != nil {
+		md.ClientCN = ar.ClientCert.Subject.CommonName
+	}
+	return md
 }
 
 // Request director is used to modify and log the response if needed
+// It adds the security headers of the service, applies the header rules, runs the in-process service functions
+// and carries out the response obligations of the PDP decision. Upgraded connections are supervised as tunnels.
+// If any of them fails, the client receives an error instead
 // The log includes a hash of the whole request (rHash) including timestamp to match requests and responses in log files
-func (pep *PEP) responseDirector(rHash string) func(*http.Response) error {
-	return func(resp *http.Response) error {
-		setHSTSHeader(resp)
-		pep.dpLogger.Printf("http: serving %s to %s - [Hash:'%s']", resp.Request.URL.String(), resp.Request.RemoteAddr, rHash)
+func (pep *PEP) responseDirector(resp *http.Response) error {
+	state := requestStateFromContext(resp.Request.Context())
+
+	// Header rules apply after the security headers, so they can still remove or replace them
+	state.securityHeaders.Apply(resp)
+	state.cors.RemoveUpstreamHeaders(resp)
+	for _, rules := range state.headerRules {
+		rules.ApplyResponse(resp, &state.vars)
+	}
+	if err := pep.runResponseServiceFunctions(state.functions, resp, state.hash); err != nil {
+		pep.dpLogger.Printf("http: response to %s failed: %v - [Hash:'%s']", resp.Request.RemoteAddr, err, state.hash)
+		return err
+	}
+	if err := pep.applyResponseObligations(resp, state.decision, state.hash); err != nil {
+		pep.dpLogger.Printf("http: response to %s failed: %v - [Hash:'%s']", resp.Request.RemoteAddr, err, state.hash)
+		return err
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols && state.upgrade != nil {
+		if err := pep.openTunnel(resp, state); err != nil {
+			pep.dpLogger.Printf("http: response to %s failed: %v - [Hash:'%s']", resp.Request.RemoteAddr, err, state.hash)
+			return err
+		}
+		pep.dpLogger.Printf("tunnel: opened %s tunnel from %s to %s - [Hash:'%s']", resp.Header.Get("Upgrade"), resp.Request.RemoteAddr, resp.Request.URL.String(), state.hash)
 		return nil
 	}
+	pep.dpLogger.Printf("http: serving %s to %s - [Hash:'%s']", resp.Request.URL.String(), resp.Request.RemoteAddr, state.hash)
+	return nil
 }
 
-func setHSTSHeader(response *http.Response) {
-	response.Header.Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
-}
+// proxyErrorHandler answers requests the reverse proxy could not forward or whose response failed in the responseDirector.
+// Requests rejected by an open circuit breaker fail fast with a 503 telling the client when to retry.
+// Requests whose body exceeded the limit of a max_body_size obligation while it was forwarded are answered with 413.
+func (pep *PEP) proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	state := requestStateFromContext(r.Context())
 
-// GetHTTPTransportForSchemeAndTLS returns an HTTP transport based on the provided scheme and TLS configuration.
-// Parameters:
-//   - scheme: The URI scheme ("http" or "https").
-//   - servicesTLS: A pointer to the TLS configuration for services.
-//
-// Returns:
-//   - *http.Transport: An HTTP transport configured based on the scheme and TLS settings.
-//   - error: An error if the scheme is unsupported.
-func GetHTTPTransportForSchemeAndTLS(scheme string, servicesTLS *tls.Config) (*http.Transport, error) {
-	var transport *http.Transport
-
-	switch scheme {
-	case "https":
-		// Create an HTTP transport with TLS configuration for HTTPS scheme.
-		transport = &http.Transport{
-			IdleConnTimeout:     10 * time.Second,
-			MaxIdleConnsPerHost: 10000,
-			TLSClientConfig:     servicesTLS,
-		}
-	case "http":
-		// Create an HTTP transport without TLS for HTTP scheme.
-		transport = &http.Transport{
-			IdleConnTimeout:     10 * time.Second,
-			MaxIdleConnsPerHost: 10000,
-		}
-	default:
-		// Return an error for unsupported scheme.
-		return nil, errors.New("unsupported scheme")
+	var circuitOpen *service.CircuitOpenError
+	if errors.As(err, &circuitOpen) {
+		pep.dpLogger.Printf("http: %s request from %s rejected: %v - [Hash:'%s']", r.Method, r.RemoteAddr, err, state.hash)
+		handleError(w, r, http.StatusServiceUnavailable, circuitOpen.RetryAfter)
+		return
+	}
+
+	if state.bodyLimitExceeded() {
+		pep.dpLogger.Printf("http: %s request from %s rejected: body exceeds the limit of a max_body_size obligation - [Hash:'%s']", r.Method, r.RemoteAddr, state.hash)
+		handleError(w, r, http.StatusRequestEntityTooLarge, 0)
+		return
 	}
 
-	return transport, nil
+	pep.dpLogger.Printf("http: proxy error for %s request from %s: %v - [Hash:'%s']", r.Method, r.RemoteAddr, err, state.hash)
+	handleError(w, r, http.StatusBadGateway, 0)
 }
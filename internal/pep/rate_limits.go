@@ -0,0 +1,37 @@
+package pep
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/ratelimit"
+	"github.com/leobrada/ztsfc_proxy/internal/service"
+)
+
+// checkRateLimits takes a token from every rate limit applying to the request: the global ones, those of the service and
+// those of the route, in this order. The first exhausted limit rejects the request and is written to the data plane log.
+// It returns whether the request may continue and, if not, when the client should retry.
+func (pep *PEP) checkRateLimits(r *http.Request, targetService *service.Service, route *service.Route, rHash string) (bool, time.Duration) {
+	scopes := []struct {
+		name     string
+		limiters []*ratelimit.Limiter
+	}{
+		{"global", pep.services.RateLimits},
+		{"service", targetService.RateLimits},
+		{fmt.Sprintf("route '%s'", route.Name), route.RateLimits},
+	}
+
+	for _, scope := range scopes {
+		for _, limiter := range scope.limiters {
+			allowed, retryAfter, key := limiter.Allow(r)
+			if allowed {
+				continue
+			}
+			pep.dpLogger.Printf("ratelimit: %s request from %s to %s rejected by %s limit of %s for key '%s', retry after %s - [Hash:'%s']",
+				r.Method, r.RemoteAddr, r.TLS.ServerName, scope.name, limiter, key, retryAfter.Round(time.Millisecond), rHash)
+			return false, retryAfter
+		}
+	}
+	return true, 0
+}
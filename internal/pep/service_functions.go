@@ -0,0 +1,48 @@
+package pep
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/sfc"
+)
+
+// runServiceFunctions runs the in-process service functions of a service in order on the request.
+// It returns the verdict of the first function that blocks the request, or a passing verdict if all functions pass.
+// The verdict and latency of every function are written to the data plane log.
+func (pep *PEP) runServiceFunctions(functions []*sfc.Function, r *http.Request, rHash string) (sfc.Verdict, error) {
+	for _, function := range functions {
+		start := time.Now()
+		verdict, err := function.Inspect(r)
+		latency := time.Since(start)
+
+		if err != nil {
+			pep.dpLogger.Printf("sfc: function '%s' failed after %s: %v - [Hash:'%s']", function.Name, latency, err, rHash)
+			return sfc.Verdict{}, fmt.Errorf("pep.runServiceFunctions(): function '%s' failed: %v", function.Name, err)
+		}
+		pep.dpLogger.Printf("sfc: function '%s' verdict: %s (%s) in %s - [Hash:'%s']", function.Name, verdict.Action, verdict.Reason, latency, rHash)
+
+		if verdict.Action == sfc.Block {
+			return verdict, nil
+		}
+	}
+	return sfc.Verdict{Action: sfc.Pass}, nil
+}
+
+// runResponseServiceFunctions runs the in-process service functions of a service in order on the response.
+// The latency of every function is written to the data plane log.
+func (pep *PEP) runResponseServiceFunctions(functions []*sfc.Function, resp *http.Response, rHash string) error {
+	for _, function := range functions {
+		start := time.Now()
+		err := function.InspectResponse(resp)
+		latency := time.Since(start)
+
+		if err != nil {
+			pep.dpLogger.Printf("sfc: function '%s' failed on response after %s: %v - [Hash:'%s']", function.Name, latency, err, rHash)
+			return fmt.Errorf("pep.runResponseServiceFunctions(): function '%s' failed: %v", function.Name, err)
+		}
+		pep.dpLogger.Printf("sfc: function '%s' inspected response in %s - [Hash:'%s']", function.Name, latency, rHash)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package pep
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/pdp"
+	"github.com/leobrada/ztsfc_proxy/internal/service"
+)
+
+const (
+	// Period the limits of open tunnels are checked in
+	tunnelCheckInterval = time.Second
+	// Time the PDP may take to re-authorize an open tunnel before the check is abandoned
+	tunnelReauthorizeTimeout = 5 * time.Second
+)
+
+// Only WebSocket tunnels are supported
+const upgradeProtocolWebSocket = "websocket"
+
+// isUpgrade reports whether the request asks to switch protocols via the HTTP/1.1 Upgrade handshake
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isExtendedConnect reports whether the request opens a tunnel via extended CONNECT over HTTP/2 (RFC 8441)
+func isExtendedConnect(r *http.Request) bool {
+	return r.Method == http.MethodConnect && r.Header.Get(":protocol") != ""
+}
+
+// prepareUpgrade checks whether the service allows the tunnel the request asks for. Protocols other than WebSocket are
+// answered with 501. Extended CONNECT requests are turned into an HTTP/1.1 WebSocket handshake, since services are
+// reached with HTTP/1.1 only. Their response is written via the returned writer, which turns the handshake's response
+// back into one for extended CONNECT.
+// It returns false if the request has been answered.
+func (pep *PEP) prepareUpgrade(w http.ResponseWriter, r *http.Request, targetService *service.Service) (http.ResponseWriter, bool) {
+	protocol := r.Header.Get("Upgrade")
+	if isExtendedConnect(r) {
+		protocol = r.Header.Get(":protocol")
+	}
+	if !strings.EqualFold(strings.TrimSpace(protocol), upgradeProtocolWebSocket) {
+		pep.dpLogger.Printf("tunnel: %s request from %s to %s rejected: protocol '%s' is not supported", r.Method, r.RemoteAddr, r.TLS.ServerName, protocol)
+		handleError(w, r, http.StatusNotImplemented, 0)
+		return w, false
+	}
+	if targetService.Upgrade == nil {
+		pep.dpLogger.Printf("tunnel: %s request from %s to %s rejected: service does not allow protocol upgrades", r.Method, r.RemoteAddr, r.TLS.ServerName)
+		handleError(w, r, http.StatusForbidden, 0)
+		return w, false
+	}
+	if !isExtendedConnect(r) {
+		return w, true
+	}
+
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		pep.dpLogger.Printf("tunnel: extended CONNECT request from %s to %s failed: %v", r.RemoteAddr, r.TLS.ServerName, err)
+		handleError(w, r, http.StatusInternalServerError, 0)
+		return w, false
+	}
+	r.Method = http.MethodGet
+	r.Header.Del(":protocol")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", upgradeProtocolWebSocket)
+	r.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	if r.Header.Get("Sec-WebSocket-Version") == "" {
+		r.Header.Set("Sec-WebSocket-Version", "13")
+	}
+
+	// The body of the stream carries the client's side of the tunnel, so it must not be read before the tunnel is open
+	stream := r.Body
+	r.Body = http.NoBody
+	r.ContentLength = 0
+
+	return &extendedConnectWriter{ResponseWriter: w, stream: stream, remoteAddr: r.RemoteAddr}, true
+}
+
+// extendedConnectWriter answers an extended CONNECT request. The reverse proxy hijacks it to relay the tunnel.
+type extendedConnectWriter struct {
+	http.ResponseWriter
+	stream     io.ReadCloser
+	remoteAddr string
+}
+
+func (w *extendedConnectWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack hands out the stream of the extended CONNECT request as connection to the client
+func (w *extendedConnectWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn := &extendedConnectConn{
+		w:          w.ResponseWriter,
+		rc:         http.NewResponseController(w.ResponseWriter),
+		stream:     w.stream,
+		remoteAddr: w.remoteAddr,
+	}
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+// extendedConnectConn is the client's side of a tunnel opened via extended CONNECT. The HTTP/1.1 response head
+// the reverse proxy writes first is replaced by a 200 response, everything after it is the tunnel's traffic.
+type extendedConnectConn struct {
+	w          http.ResponseWriter
+	rc         *http.ResponseController
+	stream     io.ReadCloser
+	remoteAddr string
+
+	mu sync.Mutex
+	// Response head written so far, until it is complete
+	head       []byte
+	headerSent bool
+}
+
+func (c *extendedConnectConn) Read(p []byte) (int, error) {
+	return c.stream.Read(p)
+}
+
+func (c *extendedConnectConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data := p
+	if !c.headerSent {
+		c.head = append(c.head, p...)
+		end := bytes.Index(c.head, []byte("\r\n\r\n"))
+		if end < 0 {
+			return len(p), nil
+		}
+		data = c.head[end+4:]
+		c.head = nil
+		c.headerSent = true
+
+		h := c.w.Header()
+		h.Del("Connection")
+		h.Del("Upgrade")
+		h.Del("Sec-Websocket-Accept")
+		c.w.WriteHeader(http.StatusOK)
+	}
+
+	if len(data) > 0 {
+		if _, err := c.w.Write(data); err != nil {
+			return 0, err
+		}
+	}
+	if err := c.rc.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *extendedConnectConn) Close() error {
+	return c.stream.Close()
+}
+
+func (c *extendedConnectConn) LocalAddr() net.Addr {
+	return tunnelAddr("")
+}
+
+func (c *extendedConnectConn) RemoteAddr() net.Addr {
+	return tunnelAddr(c.remoteAddr)
+}
+
+func (c *extendedConnectConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.rc.SetReadDeadline(t), c.rc.SetWriteDeadline(t))
+}
+
+func (c *extendedConnectConn) SetReadDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *extendedConnectConn) SetWriteDeadline(t time.Time) error {
+	return c.rc.SetWriteDeadline(t)
+}
+
+// tunnelAddr is the address of a stream carrying a tunnel
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "h2" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// tunnel is the service's side of an open tunnel. It remembers when traffic last passed in either direction.
+type tunnel struct {
+	io.ReadWriteCloser
+	// Unix time in nanoseconds of the last traffic
+	lastActive atomic.Int64
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+func newTunnel(conn io.ReadWriteCloser) *tunnel {
+	t := &tunnel{ReadWriteCloser: conn, closed: make(chan struct{})}
+	t.lastActive.Store(time.Now().UnixNano())
+	return t
+}
+
+func (t *tunnel) Read(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Read(p)
+	if n > 0 {
+		t.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (t *tunnel) Write(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Write(p)
+	if n > 0 {
+		t.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// Close closes the connection to the service, which makes the reverse proxy close the connection to the client as well
+func (t *tunnel) Close() error {
+	err := t.ReadWriteCloser.Close()
+	t.closeOnce.Do(func() { close(t.closed) })
+	return err
+}
+
+func (t *tunnel) idle() time.Duration {
+	return time.Since(time.Unix(0, t.lastActive.Load()))
+}
+
+// openTunnel hands the upgraded connection of a protocol switch to the reverse proxy and supervises it until it is closed
+func (pep *PEP) openTunnel(resp *http.Response, state *requestState) error {
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return errors.New("upgraded connection to the service is not writable")
+	}
+	t := newTunnel(conn)
+	resp.Body = t
+	go pep.watchTunnel(t, state)
+	return nil
+}
+
+// watchTunnel closes the tunnel as soon as it exceeds the limits of its service, the client certificate is revoked
+// or the PDP no longer permits the request that opened it
+func (pep *PEP) watchTunnel(t *tunnel, state *requestState) {
+	opened := time.Now()
+	lastAuthorized := opened
+	limits := state.upgrade
+	ar := state.ar
+
+	ticker := time.NewTicker(tunnelCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.closed:
+			pep.dpLogger.Printf("tunnel: tunnel of %s to %s closed after %s - [Hash:'%s']", ar.SourceIP, ar.SNI, time.Since(opened).Round(time.Second), state.hash)
+			return
+		case now := <-ticker.C:
+			reason := ""
+			switch {
+			case limits.MaxLifetime > 0 && now.Sub(opened) >= limits.MaxLifetime:
+				reason = "maximum lifetime of " + limits.MaxLifetime.String() + " exceeded"
+			case limits.IdleTimeout > 0 && t.idle() >= limits.IdleTimeout:
+				reason = "idle for " + limits.IdleTimeout.String()
+			case pep.crl != nil && ar.ClientCert != nil && pep.crl.IsRevoked(ar.ClientCert):
+				reason = "client certificate '" + ar.ClientCert.Subject.CommonName + "' has been revoked"
+			case limits.ReauthorizeInterval > 0 && now.Sub(lastAuthorized) >= limits.ReauthorizeInterval:
+				lastAuthorized = now
+				if decision := pep.reauthorize(ar); !decision.Allow {
+					reason = "access denied by PDP on re-authorization: " + decision.Reason
+				}
+			}
+			if reason != "" {
+				pep.dpLogger.Printf("tunnel: closing tunnel of %s to %s: %s - [Hash:'%s']", ar.SourceIP, ar.SNI, reason, state.hash)
+				t.Close()
+			}
+		}
+	}
+}
+
+// reauthorize asks the PDP again whether the request that opened a tunnel is permitted. A PDP that does not answer in
+// time fails the check according to the fail mode of the service.
+func (pep *PEP) reauthorize(ar pdp.AccessRequest) pdp.Decision {
+	ctx, cancel := context.WithTimeout(context.Background(), tunnelReauthorizeTimeout)
+	defer cancel()
+	return pep.pdp.Reevaluate(ctx, ar)
+}
@@ -0,0 +1,104 @@
+package pep
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/leobrada/ztsfc_proxy/internal/service"
+)
+
+// newUpgradeRequest returns an HTTP/1.1 request asking to switch to the protocol, or an extended CONNECT request for it
+func newUpgradeRequest(protocol string, extendedConnect bool) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "https://service.example.de/ws", nil)
+	r.TLS = &tls.ConnectionState{ServerName: "service.example.de"}
+	if extendedConnect {
+		r.Method = http.MethodConnect
+		r.Header.Set(":protocol", protocol)
+		return r
+	}
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	r.Header.Set("Upgrade", protocol)
+	return r
+}
+
+func TestPrepareUpgrade(t *testing.T) {
+	pep := &PEP{dpLogger: log.New(io.Discard, "", 0)}
+	tunnels := &service.Service{Upgrade: &service.Upgrade{}}
+	noTunnels := &service.Service{}
+
+	tests := []struct {
+		name            string
+		r               *http.Request
+		service         *service.Service
+		wantOK          bool
+		wantStatus      int
+		wantTranslation bool
+	}{
+		{"websocket", newUpgradeRequest("websocket", false), tunnels, true, 0, false},
+		{"websocket in other case", newUpgradeRequest("WebSocket", false), tunnels, true, 0, false},
+		{"h2c", newUpgradeRequest("h2c", false), tunnels, false, http.StatusNotImplemented, false},
+		{"other protocol", newUpgradeRequest("irc/6.9", false), tunnels, false, http.StatusNotImplemented, false},
+		{"other protocol to service without tunnels", newUpgradeRequest("h2c", false), noTunnels, false, http.StatusNotImplemented, false},
+		{"websocket to service without tunnels", newUpgradeRequest("websocket", false), noTunnels, false, http.StatusForbidden, false},
+		{"extended CONNECT websocket", newUpgradeRequest("websocket", true), tunnels, true, 0, true},
+		{"extended CONNECT other protocol", newUpgradeRequest("connect-udp", true), tunnels, false, http.StatusNotImplemented, false},
+		{"extended CONNECT to service without tunnels", newUpgradeRequest("websocket", true), noTunnels, false, http.StatusForbidden, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !isUpgrade(tt.r) && !isExtendedConnect(tt.r) {
+				t.Fatal("request is not recognized as upgrade")
+			}
+
+			recorder := httptest.NewRecorder()
+			w, ok := pep.prepareUpgrade(recorder, tt.r, tt.service)
+			if ok != tt.wantOK {
+				t.Fatalf("prepareUpgrade() ok = %t, want %t", ok, tt.wantOK)
+			}
+			if !ok {
+				if recorder.Code != tt.wantStatus {
+					t.Errorf("status = %d, want %d", recorder.Code, tt.wantStatus)
+				}
+				return
+			}
+
+			_, translated := w.(*extendedConnectWriter)
+			if translated != tt.wantTranslation {
+				t.Fatalf("writer translates extended CONNECT = %t, want %t", translated, tt.wantTranslation)
+			}
+			if translated && (tt.r.Method != http.MethodGet || tt.r.Header.Get("Upgrade") != "websocket" || tt.r.Header.Get("Sec-WebSocket-Key") == "") {
+				t.Errorf("extended CONNECT request not turned into a WebSocket handshake: %s %v", tt.r.Method, tt.r.Header)
+			}
+		})
+	}
+}
+
+func TestIsUpgrade(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection string
+		upgrade    string
+		want       bool
+	}{
+		{"upgrade", "Upgrade", "websocket", true},
+		{"token list", "keep-alive, upgrade", "websocket", true},
+		{"no upgrade token", "keep-alive", "websocket", false},
+		{"no protocol", "Upgrade", "", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Connection", tt.connection)
+		if tt.upgrade != "" {
+			r.Header.Set("Upgrade", tt.upgrade)
+		}
+		if got := isUpgrade(r); got != tt.want {
+			t.Errorf("%s: isUpgrade() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Package ratelimit implements the token bucket rate limits of the ZTSFC proxy. Buckets are kept per client identity,
+// so a single compromised client certificate cannot exhaust a service for everybody else.
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/security/tlsutil"
+)
+
+// Keys requests can be counted by
+const (
+	KeyFingerprint = "fingerprint"
+	KeyCN          = "cn"
+	KeySourceIP    = "source_ip"
+	KeySNI         = "sni"
+)
+
+// Period after which buckets that are full again are dropped
+const sweepInterval = time.Minute
+
+// Limiter is a set of token buckets, one per distinct key of the requests it limits
+type Limiter struct {
+	key      string
+	requests int
+	period   time.Duration
+	burst    float64
+	// Tokens added per nanosecond
+	rate float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New creates a limiter from its configuration.
+// Parameters:
+//   - rateLimitConf: A pointer to the rate limit configuration.
+//
+// Returns:
+//   - *Limiter: A pointer to the created limiter.
+//   - error: An error if the key is unknown or the limit is not positive.
+func New(rateLimitConf *configs.RateLimitConfig) (*Limiter, error) {
+	switch rateLimitConf.Key {
+	case KeyFingerprint, KeyCN, KeySourceIP, KeySNI:
+	default:
+		return nil, fmt.Errorf("ratelimit.New(): unsupported key '%s'", rateLimitConf.Key)
+	}
+	if rateLimitConf.Requests <= 0 {
+		return nil, fmt.Errorf("ratelimit.New(): requests must be positive")
+	}
+
+	l := &Limiter{
+		key:       rateLimitConf.Key,
+		requests:  rateLimitConf.Requests,
+		period:    rateLimitConf.Period,
+		burst:     float64(rateLimitConf.Burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+	if l.period <= 0 {
+		l.period = time.Second
+	}
+	if l.burst <= 0 {
+		l.burst = float64(l.requests)
+	}
+	l.rate = float64(l.requests) / float64(l.period)
+	return l, nil
+}
+
+// NewLimiters creates a limiter for every configuration
+func NewLimiters(rateLimitConfs []configs.RateLimitConfig) ([]*Limiter, error) {
+	limiters := make([]*Limiter, 0, len(rateLimitConfs))
+	for i := range rateLimitConfs {
+		limiter, err := New(&rateLimitConfs[i])
+		if err != nil {
+			return nil, err
+		}
+		limiters = append(limiters, limiter)
+	}
+	return limiters, nil
+}
+
+// String describes the limit, e.g., "100 requests per 1m0s by fingerprint"
+func (l *Limiter) String() string {
+	return fmt.Sprintf("%d requests per %s by %s", l.requests, l.period, l.key)
+}
+
+// Allow takes a token from the bucket of the request's key. If the bucket is empty, the request is rejected
+// and the returned duration says when the next token is available.
+// The key is returned as well for log messages.
+func (l *Limiter) Allow(r *http.Request) (allowed bool, retryAfter time.Duration, key string) {
+	key = l.keyOf(r)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += float64(now.Sub(b.last)) * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate), key
+	}
+	b.tokens--
+	return true, 0, key
+}
+
+// sweep drops all buckets that are full again, since they behave like new ones. The caller must hold l.mu.
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+float64(now.Sub(b.last))*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// keyOf returns the key the request is counted by. Requests without verified client certificate are counted by their source IP
+// if the limiter is keyed by certificate.
+func (l *Limiter) keyOf(r *http.Request) string {
+	switch l.key {
+	case KeySNI:
+		if r.TLS != nil {
+			return r.TLS.ServerName
+		}
+		return r.Host
+	case KeyFingerprint, KeyCN:
+		if cert := tlsutil.VerifiedClientCert(r.TLS); cert != nil {
+			if l.key == KeyCN {
+				return cert.Subject.CommonName
+			}
+			fingerprint := sha256.Sum256(cert.Raw)
+			return hex.EncodeToString(fingerprint[:])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,228 @@
+package ratelimit
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+func mustLimiter(t *testing.T, rateLimitConf configs.RateLimitConfig) *Limiter {
+	t.Helper()
+	l, err := New(&rateLimitConf)
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	return l
+}
+
+// newRequest returns a request to the SNI from the source IP. A non-empty cn adds a verified client certificate with raw bytes raw.
+func newRequest(sni, ip, cn, raw string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = ip + ":40000"
+	r.TLS = &tls.ConnectionState{ServerName: sni}
+	if cn != "" {
+		cert := &x509.Certificate{Raw: []byte(raw), Subject: pkix.Name{CommonName: cn}}
+		r.TLS.PeerCertificates = []*x509.Certificate{cert}
+		r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	}
+	return r
+}
+
+// unverified removes the verified chains of the request, so its client certificate is only presented
+func unverified(r *http.Request) *http.Request {
+	r.TLS.VerifiedChains = nil
+	return r
+}
+
+// elapse moves the last refill of all buckets of the limiter back by d, as if d had passed
+func elapse(l *Limiter, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, b := range l.buckets {
+		b.last = b.last.Add(-d)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    configs.RateLimitConfig
+		wantErr bool
+	}{
+		{"fingerprint", configs.RateLimitConfig{Key: KeyFingerprint, Requests: 1}, false},
+		{"cn", configs.RateLimitConfig{Key: KeyCN, Requests: 1}, false},
+		{"source ip", configs.RateLimitConfig{Key: KeySourceIP, Requests: 1}, false},
+		{"sni", configs.RateLimitConfig{Key: KeySNI, Requests: 1}, false},
+		{"unknown key", configs.RateLimitConfig{Key: "user", Requests: 1}, true},
+		{"no requests", configs.RateLimitConfig{Key: KeySNI}, true},
+		{"negative requests", configs.RateLimitConfig{Key: KeySNI, Requests: -1}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(&tt.conf); (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBurst(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  configs.RateLimitConfig
+		allow int
+	}{
+		{"burst defaults to requests", configs.RateLimitConfig{Key: KeySourceIP, Requests: 3, Period: time.Minute}, 3},
+		{"configured burst", configs.RateLimitConfig{Key: KeySourceIP, Requests: 3, Period: time.Minute, Burst: 5}, 5},
+		{"period defaults to a second", configs.RateLimitConfig{Key: KeySourceIP, Requests: 2}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := mustLimiter(t, tt.conf)
+			r := newRequest("service.example.de", "192.0.2.1", "", "")
+			for i := 0; i < tt.allow; i++ {
+				if allowed, _, _ := l.Allow(r); !allowed {
+					t.Fatalf("request %d rejected, want %d allowed", i+1, tt.allow)
+				}
+			}
+			allowed, retryAfter, _ := l.Allow(r)
+			if allowed {
+				t.Fatalf("request %d allowed, want rejected", tt.allow+1)
+			}
+			period := tt.conf.Period
+			if period == 0 {
+				period = time.Second
+			}
+			if want := period / time.Duration(tt.conf.Requests); retryAfter <= 0 || retryAfter > want {
+				t.Errorf("retryAfter = %s, want within (0, %s]", retryAfter, want)
+			}
+		})
+	}
+}
+
+func TestRefill(t *testing.T) {
+	l := mustLimiter(t, configs.RateLimitConfig{Key: KeySourceIP, Requests: 10, Period: 10 * time.Second})
+	r := newRequest("service.example.de", "192.0.2.1", "", "")
+	for j := 0; j < 10; j++ {
+		l.Allow(r)
+	}
+	if allowed, _, _ := l.Allow(r); allowed {
+		t.Fatal("request allowed with empty bucket")
+	}
+
+	// One token per second is added
+	elapse(l, 1500*time.Millisecond)
+	if allowed, _, _ := l.Allow(r); !allowed {
+		t.Fatal("request rejected after one token was added")
+	}
+	allowed, retryAfter, _ := l.Allow(r)
+	if allowed {
+		t.Fatal("second request allowed after only one token was added")
+	}
+	// Half a token is left, so the next one is due in about half a second
+	if retryAfter < 400*time.Millisecond || retryAfter > 500*time.Millisecond {
+		t.Errorf("retryAfter = %s, want about 500ms", retryAfter)
+	}
+
+	// The bucket never holds more than the burst
+	elapse(l, time.Hour)
+	for i := 0; i < 10; i++ {
+		if allowed, _, _ := l.Allow(r); !allowed {
+			t.Fatalf("request %d rejected after the bucket refilled", i+1)
+		}
+	}
+	if allowed, _, _ := l.Allow(r); allowed {
+		t.Error("bucket held more tokens than the burst")
+	}
+}
+
+func TestKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		r       *http.Request
+		wantKey string
+	}{
+		{"sni", KeySNI, newRequest("service.example.de", "192.0.2.1", "alice", "a"), "service.example.de"},
+		{"source ip", KeySourceIP, newRequest("service.example.de", "192.0.2.1", "alice", "a"), "192.0.2.1"},
+		{"cn", KeyCN, newRequest("service.example.de", "192.0.2.1", "alice", "a"), "alice"},
+		// sha256("a")
+		{"fingerprint", KeyFingerprint, newRequest("service.example.de", "192.0.2.1", "alice", "a"), "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb"},
+		{"cn without certificate", KeyCN, newRequest("service.example.de", "192.0.2.1", "", ""), "192.0.2.1"},
+		{"fingerprint without certificate", KeyFingerprint, newRequest("service.example.de", "192.0.2.1", "", ""), "192.0.2.1"},
+		{"cn of unverified certificate", KeyCN, unverified(newRequest("service.example.de", "192.0.2.1", "alice", "a")), "192.0.2.1"},
+		{"fingerprint of unverified certificate", KeyFingerprint, unverified(newRequest("service.example.de", "192.0.2.1", "alice", "a")), "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := mustLimiter(t, configs.RateLimitConfig{Key: tt.key, Requests: 1})
+			if _, _, key := l.Allow(tt.r); key != tt.wantKey {
+				t.Errorf("key = %s, want %s", key, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestBucketsPerKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		first     *http.Request
+		other     *http.Request
+		sameLimit bool
+	}{
+		{"fingerprint separates certificates with the same CN", KeyFingerprint,
+			newRequest("service.example.de", "192.0.2.1", "alice", "a"), newRequest("service.example.de", "192.0.2.1", "alice", "b"), false},
+		{"fingerprint follows the certificate across IPs", KeyFingerprint,
+			newRequest("service.example.de", "192.0.2.1", "alice", "a"), newRequest("service.example.de", "198.51.100.7", "alice", "a"), true},
+		{"cn joins certificates with the same CN", KeyCN,
+			newRequest("service.example.de", "192.0.2.1", "alice", "a"), newRequest("service.example.de", "192.0.2.1", "alice", "b"), true},
+		{"source ip separates IPs", KeySourceIP,
+			newRequest("service.example.de", "192.0.2.1", "alice", "a"), newRequest("service.example.de", "198.51.100.7", "alice", "a"), false},
+		{"sni joins all clients of a service", KeySNI,
+			newRequest("service.example.de", "192.0.2.1", "alice", "a"), newRequest("service.example.de", "198.51.100.7", "bob", "b"), true},
+		{"sni separates services", KeySNI,
+			newRequest("service.example.de", "192.0.2.1", "alice", "a"), newRequest("other.example.de", "192.0.2.1", "alice", "a"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := mustLimiter(t, configs.RateLimitConfig{Key: tt.key, Requests: 1, Period: time.Minute})
+			if allowed, _, _ := l.Allow(tt.first); !allowed {
+				t.Fatal("first request rejected")
+			}
+			allowed, _, _ := l.Allow(tt.other)
+			if allowed == tt.sameLimit {
+				t.Errorf("other request allowed = %t, want %t", allowed, !tt.sameLimit)
+			}
+		})
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l := mustLimiter(t, configs.RateLimitConfig{Key: KeySourceIP, Requests: 2, Period: time.Second})
+	l.Allow(newRequest("service.example.de", "192.0.2.1", "", ""))
+	l.Allow(newRequest("service.example.de", "198.51.100.7", "", ""))
+	l.Allow(newRequest("service.example.de", "198.51.100.7", "", ""))
+
+	// Only the first bucket is full again when the sweep runs
+	elapse(l, 600*time.Millisecond)
+	l.lastSweep = time.Now().Add(-2 * sweepInterval)
+	l.Allow(newRequest("service.example.de", "203.0.113.5", "", ""))
+
+	if _, ok := l.buckets["192.0.2.1"]; ok {
+		t.Error("full bucket of 192.0.2.1 was not dropped")
+	}
+	if _, ok := l.buckets["198.51.100.7"]; !ok {
+		t.Error("bucket of 198.51.100.7 was dropped before it was full again")
+	}
+}
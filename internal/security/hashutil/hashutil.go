@@ -3,7 +3,6 @@ package hashutil
 import (
 	"crypto/sha256"
 	"encoding/hex"
-	"io"
 	"net/http"
 	"strings"
 	"time"
@@ -23,16 +22,14 @@ func CalcRequestHash(r *http.Request) string {
 		headers += name + ": " + strings.Join(values, ",") + "\n"
 	}
 
-	// Get the body of the request
-	body, _ := io.ReadAll(r.Body)
-	// Reset the body so it can be read again
-	r.Body = io.NopCloser(strings.NewReader(string(body)))
+	// The body is left out, since it must not be buffered before the PDP decided on the request and its body size limit.
+	// The timestamp keeps the hashes of otherwise identical requests apart.
 
 	// Get the current time
 	currentTime := time.Now().String()
 
 	// Concatenate all parts to a single string
-	toHash := method + r.Host + r.RemoteAddr + url + headers + string(body) + currentTime
+	toHash := method + r.Host + r.RemoteAddr + url + headers + currentTime
 
 	// Calculate the SHA256 hash
 	hash := sha256.Sum256([]byte(toHash))
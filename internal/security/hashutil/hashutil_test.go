@@ -0,0 +1,28 @@
+package hashutil
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCalcRequestHashLeavesBodyUnread(t *testing.T) {
+	r := httptest.NewRequest("POST", "/upload", strings.NewReader("payload"))
+
+	if hash := CalcRequestHash(r); len(hash) != 14 {
+		t.Errorf("CalcRequestHash() = %q, want 14 hex digits", hash)
+	}
+	body, _ := io.ReadAll(r.Body)
+	if string(body) != "payload" {
+		t.Errorf("body after hashing = %q, want %q", body, "payload")
+	}
+}
+
+func TestCalcRequestHashDiffersForIdenticalRequests(t *testing.T) {
+	a := CalcRequestHash(httptest.NewRequest("GET", "/", nil))
+	b := CalcRequestHash(httptest.NewRequest("GET", "/", nil))
+	if a == b {
+		t.Errorf("CalcRequestHash() = %q for two requests, want distinct hashes", a)
+	}
+}
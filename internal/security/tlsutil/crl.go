@@ -0,0 +1,70 @@
+package tlsutil
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/logger"
+)
+
+// RevocationList is a certificate revocation list (CRL) that is reloaded from its file periodically if configured,
+// so certificates revoked after startup are rejected as well.
+type RevocationList struct {
+	// Serial numbers of the revoked certificates
+	revoked atomic.Pointer[map[string]bool]
+}
+
+// NewRevocationList loads the CRL of the given TLS configuration and starts reloading it every crl_refresh_interval.
+// A CRL that fails to reload is logged and the previously loaded one is kept.
+// Parameters:
+//   - tlsConfig: A pointer to the configuration struct holding the CRL settings.
+//   - cAsListForCRLChecking: A list of CA certificates used for CRL signature verification.
+//
+// Returns:
+//   - *RevocationList: A pointer to the loaded CRL.
+//   - error: An error if the CRL could not be loaded initially.
+func NewRevocationList(tlsConfig *configs.TLSConfig, cAsListForCRLChecking []*x509.Certificate) (*RevocationList, error) {
+	crl, err := NewCRL(tlsConfig, cAsListForCRLChecking)
+	if err != nil {
+		return nil, fmt.Errorf("tlsutil.NewRevocationList(): %v", err)
+	}
+
+	rl := new(RevocationList)
+	rl.store(crl)
+
+	if tlsConfig.CRLRefreshInterval > 0 {
+		go rl.refresh(tlsConfig, cAsListForCRLChecking)
+	}
+	return rl, nil
+}
+
+func (rl *RevocationList) store(crl *x509.RevocationList) {
+	revoked := make(map[string]bool, len(crl.RevokedCertificateEntries))
+	for _, entry := range crl.RevokedCertificateEntries {
+		revoked[entry.SerialNumber.String()] = true
+	}
+	rl.revoked.Store(&revoked)
+}
+
+func (rl *RevocationList) refresh(tlsConfig *configs.TLSConfig, cAsListForCRLChecking []*x509.Certificate) {
+	ticker := time.NewTicker(tlsConfig.CRLRefreshInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		crl, err := NewCRL(tlsConfig, cAsListForCRLChecking)
+		if err != nil {
+			logger.SystemLogger.Errorf("tlsutil.RevocationList.refresh(): keeping previously loaded CRL: %v", err)
+			continue
+		}
+		rl.store(crl)
+		logger.SystemLogger.Debugf("tlsutil.RevocationList.refresh(): CRL '%s' %s reloaded with %d revoked certificate(s)", tlsConfig.CRL, logger.Success, len(crl.RevokedCertificateEntries))
+	}
+}
+
+// IsRevoked reports whether the certificate is listed in the currently loaded CRL
+func (rl *RevocationList) IsRevoked(cert *x509.Certificate) bool {
+	return (*rl.revoked.Load())[cert.SerialNumber.String()]
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/x509"
 	"fmt"
 	"os"
+	"slices"
 	"time"
 
 	gct "github.com/leobrada/golang_convenience_tools"
@@ -36,7 +37,7 @@ func NewClientTLS(tlsConfig *configs.TLSConfig) (*tls.Config, error) {
 	}
 
 	// Initialize certificate revocation list (CRL) for server certificate verification.
-	serverCRL, err := NewCRL(tlsConfig, serverCAsListForCRLChecking)
+	serverCRL, err := NewRevocationList(tlsConfig, serverCAsListForCRLChecking)
 	if err != nil {
 		return nil, fmt.Errorf("tlsutil.NewTLS(): could not load internal CRL: %v", err)
 	}
@@ -63,31 +64,39 @@ func NewClientTLS(tlsConfig *configs.TLSConfig) (*tls.Config, error) {
 // And certificate maps storing certificates for showing to clients, and client authentication settings.
 // Parameters:
 //   - tlsConfig: A pointer to the configuration struct holding TLS settings.
+//   - alpn: The application protocols offered to clients in order of preference, e.g., []string{"h2", "http/1.1"}.
 //
 // Returns:
 //   - *tls.Config: A pointer to the created TLS configuration.
+//   - *RevocationList: A pointer to the CRL client certificates are checked against, e.g., to close long-lived connections of revoked clients.
 //   - error: An error if any occurred during initialization.
-func NewServerTLS(tlsConfig *configs.TLSConfig) (*tls.Config, error) {
+func NewServerTLS(tlsConfig *configs.TLSConfig, alpn []string) (*tls.Config, *RevocationList, error) {
+	// Validate the application protocols offered to clients
+	nextProtos, err := newNextProtos(alpn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tlsutil.NewServerTLS(): %v", err)
+	}
+
 	// Initialize certificate authorities (CAs) for client verification.
 	// Holding the CAs that are accepted to sign client certififactes and client CRLs
 	clientCAs, clientCAsListForCRLChecking, err := NewCAs(tlsConfig)
 	if err != nil {
-		return nil, fmt.Errorf("tlsutil.NewServerTLS(): could not load client CA list: %v", err)
+		return nil, nil, fmt.Errorf("tlsutil.NewServerTLS(): could not load client CA list: %v", err)
 	}
 	// Log the number of loaded client CAs.
 	logger.SystemLogger.Debugf("tlsutil.NewServerTLS(): %d client CA(s) %s loaded", len(clientCAsListForCRLChecking), logger.Success)
 
 	// Initialize certificate revocation list (CRL) for client certificate verification.
-	clientCRL, err := NewCRL(tlsConfig, clientCAsListForCRLChecking)
+	clientCRL, err := NewRevocationList(tlsConfig, clientCAsListForCRLChecking)
 	if err != nil {
-		return nil, fmt.Errorf("tlsutil.NewServerTLS(): could not load external CRL: %v", err)
+		return nil, nil, fmt.Errorf("tlsutil.NewServerTLS(): could not load external CRL: %v", err)
 	}
 
 	// Initialize certificate map storing all server certificates shown to clients for server authentication
 	// Certificates are indexed by the requested service's SNI
 	cm, err := NewCertificateMap(tlsConfig)
 	if err != nil {
-		return nil, fmt.Errorf("tlsutil.NewServerTLS(): could not load CL: %v", err)
+		return nil, nil, fmt.Errorf("tlsutil.NewServerTLS(): could not load CL: %v", err)
 	}
 
 	// Retrieve client authentication method
@@ -98,7 +107,7 @@ func NewServerTLS(tlsConfig *configs.TLSConfig) (*tls.Config, error) {
 		Rand:                   nil,
 		Time:                   nil,
 		InsecureSkipVerify:     false,
-		NextProtos:             []string{"h2"}, // enforces HTTP/2
+		NextProtos:             nextProtos,
 		MinVersion:             tls.VersionTLS13,
 		MaxVersion:             tls.VersionTLS13,
 		SessionTicketsDisabled: true,
@@ -108,7 +117,7 @@ func NewServerTLS(tlsConfig *configs.TLSConfig) (*tls.Config, error) {
 		GetCertificate:         makeGetCertificateFunction(cm),
 		VerifyConnection:       makeVerifyConnection(clientAuthType, clientCRL),
 	}
-	return serverTLS, nil
+	return serverTLS, clientCRL, nil
 }
 
 func setMTLS(tlsConfig *configs.TLSConfig) tls.ClientAuthType {
@@ -262,13 +271,22 @@ func compareDNs(dn1, dn2 []byte) bool {
 	return bytes.Equal(dn1, dn2)
 }
 
+// VerifiedClientCert returns the client certificate of a connection if it was verified against the client CAs, or nil otherwise.
+// Certificates a client merely presented must never identify it, since anybody can present any certificate.
+func VerifiedClientCert(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
 // makeVerifyConnection creates a function for verifying TLS connections against a certificate revocation list (CRL).
 // Parameters:
-//   - crl: A pointer to the parsed and verified certificate revocation list.
+//   - crl: A pointer to the certificate revocation list. Connections are always checked against its currently loaded version.
 //
 // Returns:
 //   - func(tls.ConnectionState) error: A function that verifies TLS connections against the provided CRL.
-func makeVerifyConnection(clientAuthType tls.ClientAuthType, crl *x509.RevocationList) func(tls.ConnectionState) error {
+func makeVerifyConnection(clientAuthType tls.ClientAuthType, crl *RevocationList) func(tls.ConnectionState) error {
 	// Define a function for verifying TLS connections.
 	return func(con tls.ConnectionState) error {
 		if clientAuthType != tls.NoClientCert {
@@ -277,15 +295,37 @@ func makeVerifyConnection(clientAuthType tls.ClientAuthType, crl *x509.Revocatio
 				return fmt.Errorf("tlsutil.VerifyConnection(): error: verified chains does not hold a valid client certificate")
 			}
 
-			// Iterate through revoked certificate entries in the CRL.
-			for _, revokedCertificateEntry := range crl.RevokedCertificateEntries {
-				// Check if the client certificate serial number matches any revoked certificate entry.
-				if con.VerifiedChains[0][0].SerialNumber.Cmp(revokedCertificateEntry.SerialNumber) == 0 {
-					return fmt.Errorf("tlsutil.VerifyConnection(): client '%s' certificate is revoked", con.VerifiedChains[0][0].Subject.CommonName)
-				}
+			// Check if the client certificate serial number matches any revoked certificate entry.
+			if crl.IsRevoked(con.VerifiedChains[0][0]) {
+				return fmt.Errorf("tlsutil.VerifyConnection(): client '%s' certificate is revoked", con.VerifiedChains[0][0].Subject.CommonName)
 			}
 		}
 		// Return nil if the connection is verified successfully.
 		return nil
 	}
 }
+
+// newNextProtos validates the application protocols offered to clients via ALPN. Without any, h2 and http/1.1 are offered.
+// Parameters:
+//   - alpn: The application protocols in order of preference.
+//
+// Returns:
+//   - []string: The application protocols to offer.
+//   - error: An error if a protocol is not supported by the frontend or listed twice.
+func newNextProtos(alpn []string) ([]string, error) {
+	if len(alpn) == 0 {
+		return []string{"h2", "http/1.1"}, nil
+	}
+
+	nextProtos := make([]string, 0, len(alpn))
+	for _, proto := range alpn {
+		if proto != "h2" && proto != "http/1.1" {
+			return nil, fmt.Errorf("unsupported ALPN protocol '%s', expected h2 or http/1.1", proto)
+		}
+		if slices.Contains(nextProtos, proto) {
+			return nil, fmt.Errorf("ALPN protocol '%s' is listed twice", proto)
+		}
+		nextProtos = append(nextProtos, proto)
+	}
+	return nextProtos, nil
+}
@@ -0,0 +1,61 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"slices"
+	"testing"
+)
+
+func TestVerifiedClientCert(t *testing.T) {
+	leaf := &x509.Certificate{Raw: []byte("leaf")}
+	ca := &x509.Certificate{Raw: []byte("ca")}
+
+	tests := []struct {
+		name  string
+		state *tls.ConnectionState
+		want  *x509.Certificate
+	}{
+		{"no connection state", nil, nil},
+		{"no certificate", &tls.ConnectionState{}, nil},
+		{"presented but not verified", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}, nil},
+		{"empty verified chain", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}, VerifiedChains: [][]*x509.Certificate{{}}}, nil},
+		{"verified", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}, VerifiedChains: [][]*x509.Certificate{{leaf, ca}}}, leaf},
+	}
+
+	for _, tt := range tests {
+		if got := VerifiedClientCert(tt.state); got != tt.want {
+			t.Errorf("%s: VerifiedClientCert() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewNextProtos(t *testing.T) {
+	tests := []struct {
+		name    string
+		alpn    []string
+		want    []string
+		wantErr bool
+	}{
+		{"default", nil, []string{"h2", "http/1.1"}, false},
+		{"empty list", []string{}, []string{"h2", "http/1.1"}, false},
+		{"HTTP/1.1 preferred", []string{"http/1.1", "h2"}, []string{"http/1.1", "h2"}, false},
+		{"h2 disabled", []string{"http/1.1"}, []string{"http/1.1"}, false},
+		{"h2 only", []string{"h2"}, []string{"h2"}, false},
+		{"unknown protocol", []string{"h2", "h3"}, nil, true},
+		{"h2c", []string{"h2c"}, nil, true},
+		{"wrong case", []string{"HTTP/1.1"}, nil, true},
+		{"listed twice", []string{"h2", "h2"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := newNextProtos(tt.alpn)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: newNextProtos(%q) error = %v, want error %t", tt.name, tt.alpn, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: newNextProtos(%q) = %q, want %q", tt.name, tt.alpn, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/leobrada/ztsfc_proxy/internal/security/tlsutil"
+)
+
+// Load balancing policies
+const (
+	lbRoundRobin       = "round_robin"
+	lbLeastOutstanding = "least_outstanding"
+	lbRandomTwoChoices = "random_two_choices"
+	lbConsistentHash   = "consistent_hash"
+)
+
+// Number of points every unit of weight places an upstream on the hash ring
+const hashRingPointsPerWeight = 100
+
+// balancer picks one of the given upstreams for a request. Implementations must be safe for concurrent use.
+type balancer interface {
+	pick(r *http.Request, upstreams []*Upstream) *Upstream
+}
+
+// newBalancer creates the balancer of a load balancing policy for the given upstreams
+func newBalancer(policy string, upstreams []*Upstream) (balancer, error) {
+	switch policy {
+	case "", lbRoundRobin:
+		return &roundRobin{current: make(map[*Upstream]int, len(upstreams))}, nil
+	case lbLeastOutstanding:
+		return leastOutstanding{}, nil
+	case lbRandomTwoChoices:
+		return randomTwoChoices{}, nil
+	case lbConsistentHash:
+		return newConsistentHash(upstreams), nil
+	default:
+		return nil, fmt.Errorf("unsupported load_balancing '%s'", policy)
+	}
+}
+
+// roundRobin implements smooth weighted round robin: upstreams are picked in proportion to their weight,
+// but interleaved instead of in bursts
+type roundRobin struct {
+	mu      sync.Mutex
+	current map[*Upstream]int
+}
+
+func (rr *roundRobin) pick(r *http.Request, upstreams []*Upstream) *Upstream {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	var best *Upstream
+	total := 0
+	for _, upstream := range upstreams {
+		rr.current[upstream] += upstream.Weight
+		total += upstream.Weight
+		if best == nil || rr.current[upstream] > rr.current[best] {
+			best = upstream
+		}
+	}
+	rr.current[best] -= total
+	return best
+}
+
+// leastOutstanding picks the upstream with the fewest outstanding requests relative to its weight
+type leastOutstanding struct{}
+
+func (leastOutstanding) pick(r *http.Request, upstreams []*Upstream) *Upstream {
+	best := upstreams[0]
+	for _, upstream := range upstreams[1:] {
+		if lessLoaded(upstream, best) {
+			best = upstream
+		}
+	}
+	return best
+}
+
+// lessLoaded reports whether a has fewer outstanding requests relative to its weight than b
+func lessLoaded(a, b *Upstream) bool {
+	return a.Outstanding()*int64(b.Weight) < b.Outstanding()*int64(a.Weight)
+}
+
+// randomTwoChoices picks two upstreams at random in proportion to their weight and takes the less loaded one.
+// It avoids the herd behaviour of leastOutstanding when many requests arrive at once.
+type randomTwoChoices struct{}
+
+func (randomTwoChoices) pick(r *http.Request, upstreams []*Upstream) *Upstream {
+	first, second := weightedRandom(upstreams), weightedRandom(upstreams)
+	if lessLoaded(second, first) {
+		return second
+	}
+	return first
+}
+
+func weightedRandom(upstreams []*Upstream) *Upstream {
+	total := 0
+	for _, upstream := range upstreams {
+		total += upstream.Weight
+	}
+	n := rand.Intn(total)
+	for _, upstream := range upstreams {
+		if n < upstream.Weight {
+			return upstream
+		}
+		n -= upstream.Weight
+	}
+	return upstreams[len(upstreams)-1]
+}
+
+// consistentHash maps the client certificate fingerprint onto a hash ring, so a client keeps reaching the same upstream
+// as long as it is available. Clients without certificate are hashed by their source IP.
+type consistentHash struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash     uint64
+	upstream *Upstream
+}
+
+func newConsistentHash(upstreams []*Upstream) *consistentHash {
+	ch := new(consistentHash)
+	for _, upstream := range upstreams {
+		for i := 0; i < upstream.Weight*hashRingPointsPerWeight; i++ {
+			ch.points = append(ch.points, ringPoint{hash: hashKey([]byte(upstream.URL.String() + "#" + strconv.Itoa(i))), upstream: upstream})
+		}
+	}
+	sort.Slice(ch.points, func(i, j int) bool { return ch.points[i].hash < ch.points[j].hash })
+	return ch
+}
+
+// pick walks the ring clockwise from the hash of the client and returns the first upstream that is a candidate
+func (ch *consistentHash) pick(r *http.Request, upstreams []*Upstream) *Upstream {
+	candidates := make(map[*Upstream]bool, len(upstreams))
+	for _, upstream := range upstreams {
+		candidates[upstream] = true
+	}
+
+	h := hashKey(clientKey(r))
+	start := sort.Search(len(ch.points), func(i int) bool { return ch.points[i].hash >= h })
+	for i := 0; i < len(ch.points); i++ {
+		point := ch.points[(start+i)%len(ch.points)]
+		if candidates[point.upstream] {
+			return point.upstream
+		}
+	}
+	return upstreams[0]
+}
+
+// clientKey returns the verified client certificate of the request or, if there is none, the source IP
+func clientKey(r *http.Request) []byte {
+	if cert := tlsutil.VerifiedClientCert(r.TLS); cert != nil {
+		return cert.Raw
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return []byte(r.RemoteAddr)
+	}
+	return []byte(host)
+}
+
+func hashKey(key []byte) uint64 {
+	sum := sha256.Sum256(key)
+	return binary.BigEndian.Uint64(sum[:8])
+}
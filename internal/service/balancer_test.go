@@ -0,0 +1,225 @@
+package service
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newTestUpstreams creates upstreams with the given weights
+func newTestUpstreams(weights ...int) []*Upstream {
+	upstreams := make([]*Upstream, 0, len(weights))
+	for i, weight := range weights {
+		upstreams = append(upstreams, &Upstream{
+			URL:    &url.URL{Scheme: "http", Host: fmt.Sprintf("upstream%d.example.de", i)},
+			Weight: weight,
+		})
+	}
+	return upstreams
+}
+
+// sequence returns the indexes of the upstreams picked for n requests
+func sequence(b balancer, upstreams []*Upstream, n int) string {
+	index := make(map[*Upstream]int, len(upstreams))
+	for i, upstream := range upstreams {
+		index[upstream] = i
+	}
+
+	var picked strings.Builder
+	r := httptest.NewRequest("GET", "/", nil)
+	for j := 0; j < n; j++ {
+		fmt.Fprint(&picked, index[b.pick(r, upstreams)])
+	}
+	return picked.String()
+}
+
+func TestNewBalancer(t *testing.T) {
+	for _, policy := range []string{"", lbRoundRobin, lbLeastOutstanding, lbRandomTwoChoices, lbConsistentHash} {
+		if _, err := newBalancer(policy, newTestUpstreams(1)); err != nil {
+			t.Errorf("newBalancer(%q): %v", policy, err)
+		}
+	}
+	if _, err := newBalancer("fastest", newTestUpstreams(1)); err == nil {
+		t.Error("newBalancer(\"fastest\") succeeded, want error")
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		want    string
+	}{
+		{"equal weights", []int{1, 1, 1}, "012012"},
+		// Smooth weighted round robin interleaves the upstreams instead of picking 0 five times in a row
+		{"smooth weights", []int{5, 1, 1}, "0010200"},
+		{"two to one", []int{2, 1}, "010010"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreams := newTestUpstreams(tt.weights...)
+			rr, _ := newBalancer(lbRoundRobin, upstreams)
+			if got := sequence(rr, upstreams, len(tt.want)); got != tt.want {
+				t.Errorf("picked %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundRobinSkipsCandidates(t *testing.T) {
+	upstreams := newTestUpstreams(1, 1, 1)
+	rr, _ := newBalancer(lbRoundRobin, upstreams)
+	r := httptest.NewRequest("GET", "/", nil)
+
+	// Upstream 1 is not a candidate, e.g., because it is unhealthy
+	candidates := []*Upstream{upstreams[0], upstreams[2]}
+	for j := 0; j < 10; j++ {
+		if rr.pick(r, candidates) == upstreams[1] {
+			t.Fatal("pick() returned an upstream that is no candidate")
+		}
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	tests := []struct {
+		name        string
+		weights     []int
+		outstanding []int64
+		want        int
+	}{
+		{"fewest outstanding", []int{1, 1, 1}, []int64{3, 1, 2}, 1},
+		{"relative to weight", []int{4, 1}, []int64{6, 2}, 0},
+		{"tie picks first", []int{1, 1}, []int64{0, 0}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreams := newTestUpstreams(tt.weights...)
+			for i, n := range tt.outstanding {
+				upstreams[i].outstanding.Store(n)
+			}
+			if got := (leastOutstanding{}).pick(nil, upstreams); got != upstreams[tt.want] {
+				t.Errorf("pick() = %s, want %s", got.URL, upstreams[tt.want].URL)
+			}
+		})
+	}
+}
+
+func TestRandomTwoChoices(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+
+	t.Run("never picks the most loaded of two", func(t *testing.T) {
+		upstreams := newTestUpstreams(1, 1)
+		upstreams[1].outstanding.Store(10)
+		counts := make(map[*Upstream]int)
+		for j := 0; j < 1000; j++ {
+			counts[(randomTwoChoices{}).pick(r, upstreams)]++
+		}
+		// The loaded upstream only wins if both choices hit it, i.e., in about a quarter of the picks
+		if loaded := counts[upstreams[1]]; loaded < 150 || loaded > 350 {
+			t.Errorf("loaded upstream picked %d of 1000 times, want about 250", loaded)
+		}
+	})
+
+	t.Run("follows the weights without load", func(t *testing.T) {
+		upstreams := newTestUpstreams(3, 1)
+		counts := make(map[*Upstream]int)
+		for j := 0; j < 4000; j++ {
+			counts[(randomTwoChoices{}).pick(r, upstreams)]++
+		}
+		// Without load the first choice wins, which is weighted 3:1
+		if heavy := counts[upstreams[0]]; heavy < 2700 || heavy > 3300 {
+			t.Errorf("upstream with weight 3 picked %d of 4000 times, want about 3000", heavy)
+		}
+	})
+}
+
+// requestWithClient returns a request from the source IP with a verified client certificate with the given raw bytes if not empty
+func requestWithClient(ip, rawCert string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = ip + ":40000"
+	if rawCert != "" {
+		cert := &x509.Certificate{Raw: []byte(rawCert)}
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	return r
+}
+
+func TestConsistentHash(t *testing.T) {
+	upstreams := newTestUpstreams(1, 1, 1)
+	ch := newConsistentHash(upstreams)
+
+	t.Run("same client same upstream", func(t *testing.T) {
+		for i := 0; i < 50; i++ {
+			cert := fmt.Sprintf("client-%d", i)
+			first := ch.pick(requestWithClient("192.0.2.1", cert), upstreams)
+			// The certificate decides, not the source IP
+			if again := ch.pick(requestWithClient("198.51.100.7", cert), upstreams); again != first {
+				t.Fatalf("client %s moved from %s to %s", cert, first.URL, again.URL)
+			}
+		}
+	})
+
+	t.Run("unverified certificate is ignored", func(t *testing.T) {
+		r := requestWithClient("192.0.2.1", "client-0")
+		r.TLS.VerifiedChains = nil
+		if !bytes.Equal(clientKey(r), []byte("192.0.2.1")) {
+			t.Errorf("clientKey() = %q, want the source IP", clientKey(r))
+		}
+	})
+
+	t.Run("source IP without certificate", func(t *testing.T) {
+		first := ch.pick(requestWithClient("192.0.2.1", ""), upstreams)
+		if again := ch.pick(requestWithClient("192.0.2.1", ""), upstreams); again != first {
+			t.Errorf("client 192.0.2.1 moved from %s to %s", first.URL, again.URL)
+		}
+	})
+
+	t.Run("spreads clients", func(t *testing.T) {
+		counts := make(map[*Upstream]int)
+		for i := 0; i < 3000; i++ {
+			counts[ch.pick(requestWithClient("192.0.2.1", fmt.Sprintf("client-%d", i)), upstreams)]++
+		}
+		for _, upstream := range upstreams {
+			if n := counts[upstream]; n < 700 || n > 1300 {
+				t.Errorf("upstream %s received %d of 3000 clients, want about 1000", upstream.URL, n)
+			}
+		}
+	})
+
+	t.Run("only clients of a removed upstream move", func(t *testing.T) {
+		removed := upstreams[1]
+		remaining := []*Upstream{upstreams[0], upstreams[2]}
+		for i := 0; i < 300; i++ {
+			r := requestWithClient("192.0.2.1", fmt.Sprintf("client-%d", i))
+			before, after := ch.pick(r, upstreams), ch.pick(r, remaining)
+			if after == removed {
+				t.Fatalf("pick() returned %s, which is no candidate", removed.URL)
+			}
+			if before != removed && after != before {
+				t.Fatalf("client-%d moved from %s to %s although its upstream is still a candidate", i, before.URL, after.URL)
+			}
+		}
+	})
+
+	t.Run("weights", func(t *testing.T) {
+		weighted := newTestUpstreams(3, 1)
+		ch := newConsistentHash(weighted)
+		heavy := 0
+		for i := 0; i < 4000; i++ {
+			if ch.pick(requestWithClient("192.0.2.1", fmt.Sprintf("client-%d", i)), weighted) == weighted[0] {
+				heavy++
+			}
+		}
+		if heavy < 2700 || heavy > 3300 {
+			t.Errorf("upstream with weight 3 received %d of 4000 clients, want about 3000", heavy)
+		}
+	})
+}
@@ -0,0 +1,218 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+// Defaults of the circuit breaker if the configuration leaves them unset
+const (
+	defaultBreakerWindow           = 10 * time.Second
+	defaultBreakerMinRequests      = 20
+	defaultBreakerOpenDuration     = 30 * time.Second
+	defaultBreakerHalfOpenRequests = 3
+)
+
+// States of a circuit breaker
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type breakerState int
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitOpenError is returned by the transport of a service for requests to an upstream whose circuit breaker is open
+type CircuitOpenError struct {
+	Upstream *url.URL
+	// RetryAfter is the time until the breaker lets trial requests through again
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker of upstream %s is open", e.Upstream)
+}
+
+// circuitBreaker protects an upstream from requests while it fails or is slow
+type circuitBreaker struct {
+	// Upstream and SNI of its service, used in log messages
+	upstream *url.URL
+	sni      string
+	config   configs.CircuitBreakerConfig
+	cpLogger *log.Logger
+
+	mu    sync.Mutex
+	state breakerState
+	// Start of the current window and the requests counted in it
+	windowStart time.Time
+	requests    int
+	failures    int
+	slow        int
+	// Time the breaker opened
+	openedAt time.Time
+	// Trial requests let through and succeeded while half-open
+	trials         int
+	trialSuccesses int
+}
+
+// newCircuitBreaker returns the circuit breaker of an upstream or nil if no threshold is configured
+func newCircuitBreaker(sni string, upstream *url.URL, breakerConf *configs.CircuitBreakerConfig, controlPlaneLogger *log.Logger) *circuitBreaker {
+	config := *breakerConf
+	if config.ErrorRateThreshold <= 0 && (config.SlowRateThreshold <= 0 || config.SlowRequestThreshold <= 0) {
+		return nil
+	}
+
+	if config.Window <= 0 {
+		config.Window = defaultBreakerWindow
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = defaultBreakerMinRequests
+	}
+	if config.OpenDuration <= 0 {
+		config.OpenDuration = defaultBreakerOpenDuration
+	}
+	if config.HalfOpenRequests <= 0 {
+		config.HalfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+
+	return &circuitBreaker{
+		upstream:    upstream,
+		sni:         sni,
+		config:      config,
+		cpLogger:    controlPlaneLogger,
+		windowStart: time.Now(),
+	}
+}
+
+// allow reports whether a request may be sent to the upstream. If not, the returned error says when to try again.
+func (cb *circuitBreaker) allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		remaining := cb.config.OpenDuration - time.Since(cb.openedAt)
+		if remaining > 0 {
+			return &CircuitOpenError{Upstream: cb.upstream, RetryAfter: remaining}
+		}
+		cb.setState(breakerHalfOpen, "open duration elapsed")
+		cb.trials, cb.trialSuccesses = 0, 0
+		fallthrough
+	case breakerHalfOpen:
+		if cb.trials >= cb.config.HalfOpenRequests {
+			// The trial requests are still in flight
+			return &CircuitOpenError{Upstream: cb.upstream, RetryAfter: time.Second}
+		}
+		cb.trials++
+	}
+	return nil
+}
+
+// admits reports whether allow would currently let a request through without counting it. A half-open breaker admits
+// requests as long as trial slots are free.
+func (cb *circuitBreaker) admits() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		return time.Since(cb.openedAt) >= cb.config.OpenDuration
+	case breakerHalfOpen:
+		return cb.trials < cb.config.HalfOpenRequests
+	}
+	return true
+}
+
+// record counts the outcome of a request let through by allow
+func (cb *circuitBreaker) record(failed bool, latency time.Duration) {
+	slow := cb.config.SlowRequestThreshold > 0 && latency > cb.config.SlowRequestThreshold
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerHalfOpen:
+		if failed || slow {
+			cb.open(fmt.Sprintf("trial request failed (latency %s)", latency))
+			return
+		}
+		cb.trialSuccesses++
+		if cb.trialSuccesses >= cb.config.HalfOpenRequests {
+			cb.setState(breakerClosed, fmt.Sprintf("%d trial requests succeeded", cb.trialSuccesses))
+			cb.resetWindow(time.Now())
+		}
+		return
+	case breakerOpen:
+		// Outcome of a request let through before the breaker opened
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(cb.windowStart) > cb.config.Window {
+		cb.resetWindow(now)
+	}
+	cb.requests++
+	if failed {
+		cb.failures++
+	}
+	if slow {
+		cb.slow++
+	}
+	if cb.requests < cb.config.MinRequests {
+		return
+	}
+
+	errorRate := 100 * float64(cb.failures) / float64(cb.requests)
+	slowRate := 100 * float64(cb.slow) / float64(cb.requests)
+	switch {
+	case cb.config.ErrorRateThreshold > 0 && errorRate >= cb.config.ErrorRateThreshold:
+		cb.open(fmt.Sprintf("error rate %.1f%% of %d requests", errorRate, cb.requests))
+	case cb.config.SlowRateThreshold > 0 && cb.config.SlowRequestThreshold > 0 && slowRate >= cb.config.SlowRateThreshold:
+		cb.open(fmt.Sprintf("%.1f%% of %d requests slower than %s", slowRate, cb.requests, cb.config.SlowRequestThreshold))
+	}
+}
+
+// release gives back the trial slot of a request let through by allow whose outcome is not counted
+func (cb *circuitBreaker) release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == breakerHalfOpen && cb.trials > 0 {
+		cb.trials--
+	}
+}
+
+// open opens the breaker. The caller must hold cb.mu.
+func (cb *circuitBreaker) open(reason string) {
+	cb.openedAt = time.Now()
+	cb.setState(breakerOpen, reason)
+	cb.resetWindow(cb.openedAt)
+}
+
+// setState switches the state of the breaker and logs the change. The caller must hold cb.mu.
+func (cb *circuitBreaker) setState(state breakerState, reason string) {
+	cb.cpLogger.Printf("breaker: circuit breaker of upstream %s of service %s changed from %s to %s: %s", cb.upstream, cb.sni, cb.state, state, reason)
+	cb.state = state
+}
+
+// resetWindow starts a new window. The caller must hold cb.mu.
+func (cb *circuitBreaker) resetWindow(now time.Time) {
+	cb.windowStart = now
+	cb.requests, cb.failures, cb.slow = 0, 0, 0
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/security/tlsutil"
+)
+
+// Name of the client certificate header if none is configured
+const defaultClientCertHeaderName = "X-Forwarded-Client-Cert"
+
+// ClientCertHeader passes the verified client certificate on to a service
+type ClientCertHeader struct {
+	name       string
+	enabled    bool
+	includePEM bool
+}
+
+func newClientCertHeader(headerConf *configs.ClientCertHeaderConfig) *ClientCertHeader {
+	h := &ClientCertHeader{
+		name:       http.CanonicalHeaderKey(headerConf.Name),
+		enabled:    headerConf.Enabled,
+		includePEM: headerConf.IncludePEM,
+	}
+	if h.name == "" {
+		h.name = defaultClientCertHeaderName
+	}
+	return h
+}
+
+// Strip removes the header from a request received from a client, so it cannot be spoofed.
+// It is called for every request, even if the header is disabled. A copy under the default name is removed as well.
+func (h *ClientCertHeader) Strip(r *http.Request) {
+	r.Header.Del(h.name)
+	r.Header.Del(defaultClientCertHeaderName)
+}
+
+// Set adds the header describing the client certificate, if enabled and the client presented a verified certificate
+func (h *ClientCertHeader) Set(r *http.Request) {
+	if !h.enabled {
+		return
+	}
+	cert := tlsutil.VerifiedClientCert(r.TLS)
+	if cert == nil {
+		return
+	}
+
+	hash := sha256.Sum256(cert.Raw)
+	elements := []string{
+		"Hash=" + hex.EncodeToString(hash[:]),
+		"Subject=" + strconv.Quote(cert.Subject.String()),
+	}
+	for _, uri := range cert.URIs {
+		elements = append(elements, "URI="+uri.String())
+	}
+	for _, dnsName := range cert.DNSNames {
+		elements = append(elements, "DNS="+dnsName)
+	}
+	if h.includePEM {
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		elements = append(elements, "Cert="+strconv.Quote(url.QueryEscape(string(certPEM))))
+	}
+
+	r.Header.Set(h.name, strings.Join(elements, ";"))
+}
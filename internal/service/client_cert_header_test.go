@@ -0,0 +1,116 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+func TestClientCertHeaderStrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		headerConf configs.ClientCertHeaderConfig
+		stripped   []string
+	}{
+		{"disabled with default name", configs.ClientCertHeaderConfig{}, []string{defaultClientCertHeaderName}},
+		{"enabled with default name", configs.ClientCertHeaderConfig{Enabled: true}, []string{defaultClientCertHeaderName}},
+		{"disabled with custom name", configs.ClientCertHeaderConfig{Name: "x-client-cert"}, []string{defaultClientCertHeaderName, "X-Client-Cert"}},
+		{"enabled with custom name", configs.ClientCertHeaderConfig{Enabled: true, Name: "x-client-cert"}, []string{defaultClientCertHeaderName, "X-Client-Cert"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set(defaultClientCertHeaderName, "Hash=forged")
+			r.Header.Set("X-Client-Cert", "Hash=forged")
+
+			newClientCertHeader(&tt.headerConf).Strip(r)
+
+			for _, name := range tt.stripped {
+				if value := r.Header.Get(name); value != "" {
+					t.Errorf("%s = %q after Strip(), want it removed", name, value)
+				}
+			}
+		})
+	}
+}
+
+func TestClientCertHeaderSet(t *testing.T) {
+	spiffeID, _ := url.Parse("spiffe://example.de/alice")
+	cert := &x509.Certificate{
+		Raw:      []byte("certificate"),
+		Subject:  pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"Security"}},
+		URIs:     []*url.URL{spiffeID},
+		DNSNames: []string{"alice.example.de", "alice.internal"},
+	}
+	hash := sha256.Sum256(cert.Raw)
+	want := "Hash=" + hex.EncodeToString(hash[:]) + `;Subject="CN=alice,OU=Security";URI=spiffe://example.de/alice;DNS=alice.example.de;DNS=alice.internal`
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	wantPEM := want + ";Cert=" + strconv.Quote(url.QueryEscape(string(certPEM)))
+
+	tests := []struct {
+		name       string
+		headerConf configs.ClientCertHeaderConfig
+		verified   bool
+		header     string
+		want       string
+	}{
+		{"fields", configs.ClientCertHeaderConfig{Enabled: true}, true, defaultClientCertHeaderName, want},
+		{"custom name", configs.ClientCertHeaderConfig{Enabled: true, Name: "x-client-cert"}, true, "X-Client-Cert", want},
+		{"pem", configs.ClientCertHeaderConfig{Enabled: true, IncludePEM: true}, true, defaultClientCertHeaderName, wantPEM},
+		{"disabled", configs.ClientCertHeaderConfig{}, true, defaultClientCertHeaderName, ""},
+		{"unverified certificate", configs.ClientCertHeaderConfig{Enabled: true}, false, defaultClientCertHeaderName, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+			if tt.verified {
+				r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+			}
+
+			newClientCertHeader(&tt.headerConf).Set(r)
+
+			if got := r.Header.Get(tt.header); got != tt.want {
+				t.Errorf("%s = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+// The PEM must survive the URL encoding unchanged, so services can parse the certificate again
+func TestClientCertHeaderPEMRoundTrip(t *testing.T) {
+	cert := &x509.Certificate{Raw: []byte("certificate"), Subject: pkix.Name{CommonName: "alice"}}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	newClientCertHeader(&configs.ClientCertHeaderConfig{Enabled: true, IncludePEM: true}).Set(r)
+
+	_, quoted, ok := strings.Cut(r.Header.Get(defaultClientCertHeaderName), ";Cert=")
+	if !ok {
+		t.Fatalf("header %q has no Cert element", r.Header.Get(defaultClientCertHeaderName))
+	}
+	unquoted, err := strconv.Unquote(quoted)
+	if err != nil {
+		t.Fatalf("Cert element is not quoted: %v", err)
+	}
+	decoded, err := url.QueryUnescape(unquoted)
+	if err != nil {
+		t.Fatalf("Cert element is not URL encoded: %v", err)
+	}
+	block, _ := pem.Decode([]byte(decoded))
+	if block == nil || string(block.Bytes) != "certificate" {
+		t.Errorf("Cert element decodes to %q, want the PEM of the certificate", decoded)
+	}
+}
@@ -0,0 +1,242 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+// Methods allowed in cross-origin requests if none are configured
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// Request headers browsers send without asking in a preflight
+var corsSafelistedHeaders = map[string]bool{
+	"Accept":           true,
+	"Accept-Language":  true,
+	"Content-Language": true,
+	"Content-Type":     true,
+}
+
+// originWildcard matches the origins of all subdomains, e.g., "https://*.example.de"
+type originWildcard struct {
+	// Scheme including "://"
+	prefix string
+	// Domain starting with '.', optionally followed by a port
+	suffix string
+}
+
+func (w originWildcard) matches(origin string) bool {
+	if len(origin) <= len(w.prefix)+len(w.suffix) || !strings.HasPrefix(origin, w.prefix) || !strings.HasSuffix(origin, w.suffix) {
+		return false
+	}
+	subdomain := origin[len(w.prefix) : len(origin)-len(w.suffix)]
+	return !strings.ContainsAny(subdomain, "/:@")
+}
+
+// CORS enforces the Cross-Origin Resource Sharing policy of a service or route
+type CORS struct {
+	anyOrigin bool
+	origins   map[string]bool
+	wildcards []originWildcard
+
+	methods     map[string]bool
+	anyHeader   bool
+	headers     map[string]bool
+	credentials bool
+
+	// Values of the response headers, prepared once
+	allowMethods  string
+	allowHeaders  string
+	exposeHeaders string
+	maxAge        string
+}
+
+// newCORS creates the CORS policy of a service or route. It returns nil if no origin is allowed.
+func newCORS(corsConf *configs.CORSConfig) (*CORS, error) {
+	if len(corsConf.AllowedOrigins) == 0 {
+		return nil, nil
+	}
+
+	c := &CORS{
+		origins:     make(map[string]bool),
+		methods:     make(map[string]bool),
+		headers:     make(map[string]bool),
+		credentials: corsConf.AllowCredentials,
+	}
+
+	for _, origin := range corsConf.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+		switch {
+		case origin == "*":
+			c.anyOrigin = true
+		case strings.Contains(origin, "*"):
+			wildcard, err := parseOriginWildcard(origin)
+			if err != nil {
+				return nil, fmt.Errorf("cors: %v", err)
+			}
+			c.wildcards = append(c.wildcards, wildcard)
+		default:
+			if !strings.Contains(origin, "://") {
+				return nil, fmt.Errorf("cors: origin '%s' has no scheme", origin)
+			}
+			c.origins[origin] = true
+		}
+	}
+	if c.anyOrigin && c.credentials {
+		return nil, fmt.Errorf("cors: allow_credentials cannot be combined with origin '*'")
+	}
+
+	configured := corsConf.AllowedMethods
+	if len(configured) == 0 {
+		configured = defaultCORSMethods
+	}
+	methods := make([]string, 0, len(configured))
+	for _, method := range configured {
+		method = strings.ToUpper(method)
+		c.methods[method] = true
+		methods = append(methods, method)
+	}
+	c.allowMethods = strings.Join(methods, ", ")
+
+	headers := make([]string, 0, len(corsConf.AllowedHeaders))
+	for _, header := range corsConf.AllowedHeaders {
+		if header == "*" {
+			c.anyHeader = true
+			continue
+		}
+		header = http.CanonicalHeaderKey(header)
+		c.headers[header] = true
+		headers = append(headers, header)
+	}
+	c.allowHeaders = strings.Join(headers, ", ")
+
+	exposed := make([]string, 0, len(corsConf.ExposedHeaders))
+	for _, header := range corsConf.ExposedHeaders {
+		exposed = append(exposed, http.CanonicalHeaderKey(header))
+	}
+	c.exposeHeaders = strings.Join(exposed, ", ")
+
+	if corsConf.MaxAge < 0 {
+		return nil, fmt.Errorf("cors: max_age must not be negative")
+	}
+	if corsConf.MaxAge > 0 {
+		c.maxAge = strconv.FormatInt(int64(corsConf.MaxAge/time.Second), 10)
+	}
+
+	return c, nil
+}
+
+// parseOriginWildcard parses an origin of the form "<scheme>://*.<domain>[:<port>]"
+func parseOriginWildcard(origin string) (originWildcard, error) {
+	prefix, suffix, _ := strings.Cut(origin, "*")
+	if !strings.HasSuffix(prefix, "://") || !strings.HasPrefix(suffix, ".") || strings.Contains(suffix, "*") {
+		return originWildcard{}, fmt.Errorf("invalid wildcard origin '%s', expected e.g. 'https://*.example.de'", origin)
+	}
+	return originWildcard{prefix: prefix, suffix: suffix}, nil
+}
+
+// IsPreflight reports whether the request is a CORS preflight request
+func IsPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// CrossOrigin reports whether the request was sent by a script of another origin than the requested service
+func (c *CORS) CrossOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	host := strings.ToLower(strings.TrimSuffix(r.Host, ":443"))
+	return strings.ToLower(origin) != "https://"+host
+}
+
+// AllowOrigin reports whether the policy allows requests from the origin
+func (c *CORS) AllowOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	if c.anyOrigin || c.origins[origin] {
+		return true
+	}
+	for _, wildcard := range c.wildcards {
+		if wildcard.matches(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Preflight answers a preflight request of an allowed origin. It returns an error without writing a response
+// if the requested method or headers are not allowed.
+func (c *CORS) Preflight(w http.ResponseWriter, r *http.Request) error {
+	method := r.Header.Get("Access-Control-Request-Method")
+	if !c.methods[method] {
+		return fmt.Errorf("method %s is not allowed", method)
+	}
+
+	var requested []string
+	for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		header = http.CanonicalHeaderKey(strings.TrimSpace(header))
+		if header == "" {
+			continue
+		}
+		if !c.anyHeader && !c.headers[header] && !corsSafelistedHeaders[header] {
+			return fmt.Errorf("header %s is not allowed", header)
+		}
+		requested = append(requested, header)
+	}
+
+	h := w.Header()
+	c.setOrigin(h, r.Header.Get("Origin"))
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	h.Set("Access-Control-Allow-Methods", c.allowMethods)
+	// "*" is not understood by browsers in credentialed requests, so allowed headers are echoed instead
+	if c.anyHeader {
+		if len(requested) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+		}
+	} else if c.allowHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", c.allowHeaders)
+	}
+	if c.maxAge != "" {
+		h.Set("Access-Control-Max-Age", c.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// SetHeaders adds the CORS headers for an allowed cross-origin request to the response headers h
+func (c *CORS) SetHeaders(h http.Header, origin string) {
+	c.setOrigin(h, origin)
+	if c.exposeHeaders != "" {
+		h.Set("Access-Control-Expose-Headers", c.exposeHeaders)
+	}
+}
+
+// setOrigin allows the origin to read the response. Without credentials, a policy allowing every origin answers all of them alike.
+func (c *CORS) setOrigin(h http.Header, origin string) {
+	if c.anyOrigin {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Add("Vary", "Origin")
+	if c.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// RemoveUpstreamHeaders removes the CORS headers set by the service, since the policy of the PEP replaces them
+func (c *CORS) RemoveUpstreamHeaders(resp *http.Response) {
+	if c == nil {
+		return
+	}
+	for name := range resp.Header {
+		if strings.HasPrefix(name, "Access-Control-") {
+			resp.Header.Del(name)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+func mustCORS(t *testing.T, corsConf configs.CORSConfig) *CORS {
+	t.Helper()
+	c, err := newCORS(&corsConf)
+	if err != nil {
+		t.Fatalf("newCORS(): %v", err)
+	}
+	return c
+}
+
+func TestNewCORS(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    configs.CORSConfig
+		wantErr bool
+	}{
+		{"exact origin", configs.CORSConfig{AllowedOrigins: []string{"https://app.example.de"}}, false},
+		{"wildcard origin", configs.CORSConfig{AllowedOrigins: []string{"https://*.example.de:8443"}}, false},
+		{"any origin", configs.CORSConfig{AllowedOrigins: []string{"*"}}, false},
+		{"origin without scheme", configs.CORSConfig{AllowedOrigins: []string{"app.example.de"}}, true},
+		{"wildcard inside a label", configs.CORSConfig{AllowedOrigins: []string{"https://app*.example.de"}}, true},
+		{"wildcard without scheme", configs.CORSConfig{AllowedOrigins: []string{"*.example.de"}}, true},
+		{"two wildcards", configs.CORSConfig{AllowedOrigins: []string{"https://*.*.example.de"}}, true},
+		{"credentials with any origin", configs.CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}, true},
+		{"negative max age", configs.CORSConfig{AllowedOrigins: []string{"https://app.example.de"}, MaxAge: -time.Second}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newCORS(&tt.conf); (err != nil) != tt.wantErr {
+				t.Errorf("newCORS() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+
+	if c, err := newCORS(&configs.CORSConfig{}); c != nil || err != nil {
+		t.Errorf("newCORS() without origins = %v, %v, want nil, nil", c, err)
+	}
+}
+
+func TestAllowOrigin(t *testing.T) {
+	c := mustCORS(t, configs.CORSConfig{AllowedOrigins: []string{"https://app.example.de/", "https://*.example.com", "http://*.dev.example.de:8080"}})
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.de", true},
+		{"HTTPS://APP.EXAMPLE.DE", true},
+		{"http://app.example.de", false},
+		{"https://app.example.de:8443", false},
+		{"https://evil.example.de", false},
+		{"https://api.example.com", true},
+		{"https://a.b.example.com", true},
+		// The wildcard needs a subdomain
+		{"https://example.com", false},
+		{"https://.example.com", false},
+		{"https://evilexample.com", false},
+		{"https://example.com.evil.de", false},
+		{"https://user@api.example.com", false},
+		{"https://api.example.com:8443", false},
+		{"http://api.dev.example.de:8080", true},
+		{"http://api.dev.example.de", false},
+		{"null", false},
+	}
+
+	for _, tt := range tests {
+		if got := c.AllowOrigin(tt.origin); got != tt.want {
+			t.Errorf("AllowOrigin(%q) = %t, want %t", tt.origin, got, tt.want)
+		}
+	}
+
+	if anyOrigin := mustCORS(t, configs.CORSConfig{AllowedOrigins: []string{"*"}}); !anyOrigin.AllowOrigin("https://whatever.example.org") {
+		t.Error("policy with origin '*' rejected an origin")
+	}
+}
+
+// newPreflight returns a preflight request from the origin asking for the method and headers
+func newPreflight(origin, method, headers string) *http.Request {
+	r := httptest.NewRequest(http.MethodOptions, "https://api.example.de/users", nil)
+	r.Header.Set("Origin", origin)
+	r.Header.Set("Access-Control-Request-Method", method)
+	if headers != "" {
+		r.Header.Set("Access-Control-Request-Headers", headers)
+	}
+	return r
+}
+
+func TestPreflight(t *testing.T) {
+	tests := []struct {
+		name        string
+		conf        configs.CORSConfig
+		method      string
+		headers     string
+		wantErr     bool
+		wantHeaders map[string]string
+	}{
+		{
+			name:   "default methods",
+			conf:   configs.CORSConfig{AllowedOrigins: []string{"https://app.example.de"}},
+			method: "POST",
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.de",
+				"Access-Control-Allow-Methods":     "GET, HEAD, POST",
+				"Access-Control-Allow-Credentials": "",
+				"Access-Control-Max-Age":           "",
+			},
+		},
+		{
+			name:    "method not allowed",
+			conf:    configs.CORSConfig{AllowedOrigins: []string{"https://app.example.de"}},
+			method:  "DELETE",
+			wantErr: true,
+		},
+		{
+			name:    "configured methods, headers, credentials and max age",
+			conf:    configs.CORSConfig{AllowedOrigins: []string{"https://app.example.de"}, AllowedMethods: []string{"get", "delete"}, AllowedHeaders: []string{"authorization", "x-request-id"}, AllowCredentials: true, MaxAge: 10 * time.Minute},
+			method:  "DELETE",
+			headers: "Authorization, content-type",
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.de",
+				"Access-Control-Allow-Methods":     "GET, DELETE",
+				"Access-Control-Allow-Headers":     "Authorization, X-Request-Id",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Max-Age":           "600",
+			},
+		},
+		{
+			name:    "header not allowed",
+			conf:    configs.CORSConfig{AllowedOrigins: []string{"https://app.example.de"}, AllowedHeaders: []string{"Authorization"}},
+			method:  "GET",
+			headers: "Authorization, X-Debug",
+			wantErr: true,
+		},
+		{
+			name:    "any header is echoed",
+			conf:    configs.CORSConfig{AllowedOrigins: []string{"https://app.example.de"}, AllowedHeaders: []string{"*"}},
+			method:  "GET",
+			headers: "x-debug,x-trace",
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Headers": "X-Debug, X-Trace",
+			},
+		},
+		{
+			name:   "any origin",
+			conf:   configs.CORSConfig{AllowedOrigins: []string{"*"}},
+			method: "GET",
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "*",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := mustCORS(t, tt.conf)
+			w := httptest.NewRecorder()
+			err := c.Preflight(w, newPreflight("https://app.example.de", tt.method, tt.headers))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Preflight() error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if len(w.Header()) != 0 {
+					t.Errorf("rejected preflight wrote headers %v", w.Header())
+				}
+				return
+			}
+			if w.Code != http.StatusNoContent {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusNoContent)
+			}
+			for name, want := range tt.wantHeaders {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIsPreflight(t *testing.T) {
+	tests := []struct {
+		name string
+		r    *http.Request
+		want bool
+	}{
+		{"preflight", newPreflight("https://app.example.de", "PUT", ""), true},
+		{"OPTIONS without request method", httptest.NewRequest(http.MethodOptions, "/", nil), false},
+		{"GET with request method", func() *http.Request {
+			r := newPreflight("https://app.example.de", "PUT", "")
+			r.Method = http.MethodGet
+			return r
+		}(), false},
+	}
+
+	for _, tt := range tests {
+		if got := IsPreflight(tt.r); got != tt.want {
+			t.Errorf("%s: IsPreflight() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCrossOrigin(t *testing.T) {
+	c := mustCORS(t, configs.CORSConfig{AllowedOrigins: []string{"*"}})
+
+	tests := []struct {
+		host   string
+		origin string
+		want   bool
+	}{
+		{"api.example.de", "", false},
+		{"api.example.de", "https://api.example.de", false},
+		{"api.example.de:443", "https://API.example.de", false},
+		{"api.example.de", "https://app.example.de", true},
+		{"api.example.de", "http://api.example.de", true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = tt.host
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := c.CrossOrigin(r); got != tt.want {
+			t.Errorf("CrossOrigin() of origin %q to host %s = %t, want %t", tt.origin, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	c := mustCORS(t, configs.CORSConfig{AllowedOrigins: []string{"https://*.example.de"}, ExposedHeaders: []string{"x-request-id"}, AllowCredentials: true})
+	h := make(http.Header)
+	c.SetHeaders(h, "https://app.example.de")
+
+	want := map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.de",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Expose-Headers":    "X-Request-Id",
+		"Vary":                             "Origin",
+	}
+	for name, value := range want {
+		if got := h.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+
+	resp := &http.Response{Header: http.Header{"Access-Control-Allow-Origin": {"*"}, "Content-Type": {"text/plain"}}}
+	c.RemoveUpstreamHeaders(resp)
+	if resp.Header.Get("Access-Control-Allow-Origin") != "" || resp.Header.Get("Content-Type") == "" {
+		t.Errorf("RemoveUpstreamHeaders() left %v, want only non-CORS headers", resp.Header)
+	}
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+// TemplateVars are the values template variables in header rules are replaced with
+type TemplateVars struct {
+	ClientCN          string
+	ClientFingerprint string
+	RequestHash       string
+	SNI               string
+	SourceIP          string
+	Method            string
+	Path              string
+}
+
+// templateVarNames maps the names usable in header values to their value
+var templateVarNames = map[string]func(*TemplateVars) string{
+	"client_cn":          func(v *TemplateVars) string { return v.ClientCN },
+	"client_fingerprint": func(v *TemplateVars) string { return v.ClientFingerprint },
+	"request_hash":       func(v *TemplateVars) string { return v.RequestHash },
+	"sni":                func(v *TemplateVars) string { return v.SNI },
+	"source_ip":          func(v *TemplateVars) string { return v.SourceIP },
+	"method":             func(v *TemplateVars) string { return v.Method },
+	"path":               func(v *TemplateVars) string { return v.Path },
+}
+
+var templateVarPattern = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// headerTemplate is a header value with template variables, split into literal text and variables
+type headerTemplate struct {
+	// Literal parts; literals[i] precedes vars[i]. There is one more literal than variables.
+	literals []string
+	vars     []func(*TemplateVars) string
+}
+
+func newHeaderTemplate(value string) (*headerTemplate, error) {
+	if i := strings.IndexFunc(value, isControl); i >= 0 {
+		return nil, fmt.Errorf("invalid control character %q", value[i])
+	}
+
+	t := new(headerTemplate)
+	last := 0
+	for _, match := range templateVarPattern.FindAllStringSubmatchIndex(value, -1) {
+		name := value[match[2]:match[3]]
+		lookup, ok := templateVarNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown template variable '${%s}'", name)
+		}
+		t.literals = append(t.literals, value[last:match[0]])
+		t.vars = append(t.vars, lookup)
+		last = match[1]
+	}
+	t.literals = append(t.literals, value[last:])
+	return t, nil
+}
+
+// render replaces the template variables with their values. Control characters in the values, e.g., a CR LF decoded
+// from the path, are percent-encoded, since they are invalid in header values and would fail the request.
+func (t *headerTemplate) render(vars *TemplateVars) string {
+	if len(t.vars) == 0 {
+		return t.literals[0]
+	}
+	var b strings.Builder
+	for i, lookup := range t.vars {
+		b.WriteString(t.literals[i])
+		writeSanitized(&b, lookup(vars))
+	}
+	b.WriteString(t.literals[len(t.literals)-1])
+	return b.String()
+}
+
+// isControl reports whether r is a control character other than horizontal tab, which header values must not contain
+func isControl(r rune) bool {
+	return (r < 0x20 && r != '\t') || r == 0x7f
+}
+
+// writeSanitized writes value to b with all control characters percent-encoded
+func writeSanitized(b *strings.Builder, value string) {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; isControl(rune(c)) {
+			fmt.Fprintf(b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+}
+
+type headerValue struct {
+	name  string
+	value *headerTemplate
+}
+
+// headerOperations are the compiled modifications of one header set
+type headerOperations struct {
+	remove []string
+	set    []headerValue
+	add    []headerValue
+}
+
+func newHeaderOperations(operationsConf *configs.HeaderOperationsConfig) (*headerOperations, error) {
+	ops := new(headerOperations)
+	for _, name := range operationsConf.Remove {
+		ops.remove = append(ops.remove, http.CanonicalHeaderKey(name))
+	}
+
+	var err error
+	if ops.set, err = newHeaderValues(operationsConf.Set); err != nil {
+		return nil, err
+	}
+	if ops.add, err = newHeaderValues(operationsConf.Add); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+func newHeaderValues(values map[string]string) ([]headerValue, error) {
+	headerValues := make([]headerValue, 0, len(values))
+	for name, value := range values {
+		t, err := newHeaderTemplate(value)
+		if err != nil {
+			return nil, fmt.Errorf("header '%s': %v", name, err)
+		}
+		headerValues = append(headerValues, headerValue{name: http.CanonicalHeaderKey(name), value: t})
+	}
+	return headerValues, nil
+}
+
+func (ops *headerOperations) apply(header http.Header, vars *TemplateVars) {
+	for _, name := range ops.remove {
+		header.Del(name)
+	}
+	for _, hv := range ops.set {
+		header.Set(hv.name, hv.value.render(vars))
+	}
+	for _, hv := range ops.add {
+		header.Add(hv.name, hv.value.render(vars))
+	}
+}
+
+// HeaderRules modify the headers of requests to a service and of its responses
+type HeaderRules struct {
+	request  *headerOperations
+	response *headerOperations
+}
+
+// newHeaderRules compiles the header rules of a service or route. Unknown template variables are reported as error.
+func newHeaderRules(rulesConf *configs.HeaderRulesConfig) (*HeaderRules, error) {
+	request, err := newHeaderOperations(&rulesConf.Request)
+	if err != nil {
+		return nil, fmt.Errorf("request header rules: %v", err)
+	}
+	response, err := newHeaderOperations(&rulesConf.Response)
+	if err != nil {
+		return nil, fmt.Errorf("response header rules: %v", err)
+	}
+	return &HeaderRules{request: request, response: response}, nil
+}
+
+// ApplyRequest modifies the headers of a request before it is forwarded
+func (hr *HeaderRules) ApplyRequest(r *http.Request, vars *TemplateVars) {
+	if hr == nil {
+		return
+	}
+	hr.request.apply(r.Header, vars)
+}
+
+// ApplyResponse modifies the headers of a response before it is returned to the client
+func (hr *HeaderRules) ApplyResponse(resp *http.Response, vars *TemplateVars) {
+	if hr == nil {
+		return
+	}
+	hr.response.apply(resp.Header, vars)
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+func mustHeaderRules(t *testing.T, rulesConf *configs.HeaderRulesConfig) *HeaderRules {
+	t.Helper()
+	hr, err := newHeaderRules(rulesConf)
+	if err != nil {
+		t.Fatalf("newHeaderRules(): %v", err)
+	}
+	return hr
+}
+
+// Headers are removed first, then set, then added, whatever the client sent
+func TestHeaderRulesOrder(t *testing.T) {
+	hr := mustHeaderRules(t, &configs.HeaderRulesConfig{Request: configs.HeaderOperationsConfig{
+		Remove: []string{"x-internal", "x-env"},
+		Set:    map[string]string{"x-env": "prod", "x-user": "fixed"},
+		Add:    map[string]string{"x-env": "eu", "x-tag": "proxy"},
+	}})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Internal", "forged")
+	r.Header.Set("X-Env", "dev")
+	r.Header.Add("X-User", "alice")
+	r.Header.Add("X-User", "bob")
+	r.Header.Set("X-Tag", "client")
+	hr.ApplyRequest(r, &TemplateVars{})
+
+	want := http.Header{
+		"X-Env":  {"prod", "eu"},
+		"X-User": {"fixed"},
+		"X-Tag":  {"client", "proxy"},
+	}
+	if !reflect.DeepEqual(r.Header, want) {
+		t.Errorf("headers = %v, want %v", r.Header, want)
+	}
+}
+
+func TestHeaderRulesTemplates(t *testing.T) {
+	vars := &TemplateVars{
+		ClientCN:          "alice",
+		ClientFingerprint: "ab12",
+		RequestHash:       "hash",
+		SNI:               "service.example.de",
+		SourceIP:          "192.0.2.1",
+		Method:            "POST",
+		Path:              "/api/users",
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		vars  *TemplateVars
+		want  string
+	}{
+		{"literal", "static", vars, "static"},
+		{"path", "${path}", vars, "/api/users"},
+		{"client cn", "CN=${client_cn}", vars, "CN=alice"},
+		{"several variables", "${method} ${sni}${path} from ${source_ip} (${client_fingerprint}, ${request_hash})", vars,
+			"POST service.example.de/api/users from 192.0.2.1 (ab12, hash)"},
+		{"empty value", "cn=${client_cn}", &TemplateVars{}, "cn="},
+		{"CR LF in the path", "${path}", &TemplateVars{Path: "/a\r\nX-Injected: 1"}, "/a%0D%0AX-Injected: 1"},
+		{"other control characters", "${client_cn}", &TemplateVars{ClientCN: "al\x00ice\x7f\tx"}, "al%00ice%7F\tx"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hr := mustHeaderRules(t, &configs.HeaderRulesConfig{Request: configs.HeaderOperationsConfig{Set: map[string]string{"X-Value": tt.value}}})
+			r := httptest.NewRequest("GET", "/", nil)
+			hr.ApplyRequest(r, tt.vars)
+			if got := r.Header.Get("X-Value"); got != tt.want {
+				t.Errorf("X-Value = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Expanded values must always be valid header values, or the transport fails the request with a 502
+func TestHeaderRulesControlCharactersReachUpstream(t *testing.T) {
+	var got string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-Path")
+	}))
+	defer backend.Close()
+
+	hr := mustHeaderRules(t, &configs.HeaderRulesConfig{Request: configs.HeaderOperationsConfig{Set: map[string]string{"X-Path": "${path}"}}})
+	r, _ := http.NewRequest("GET", backend.URL, nil)
+	hr.ApplyRequest(r, &TemplateVars{Path: "/a\r\nb"})
+
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		t.Fatalf("RoundTrip(): %v", err)
+	}
+	resp.Body.Close()
+	if got != "/a%0D%0Ab" {
+		t.Errorf("upstream received X-Path %q, want %q", got, "/a%0D%0Ab")
+	}
+}
+
+func TestHeaderRulesRequestAndResponse(t *testing.T) {
+	hr := mustHeaderRules(t, &configs.HeaderRulesConfig{
+		Request:  configs.HeaderOperationsConfig{Set: map[string]string{"X-Request-Rule": "1"}, Remove: []string{"Cookie"}},
+		Response: configs.HeaderOperationsConfig{Set: map[string]string{"X-Response-Rule": "1"}, Remove: []string{"Server"}},
+	})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Cookie", "a=b")
+	r.Header.Set("Server", "kept")
+	hr.ApplyRequest(r, &TemplateVars{})
+	if r.Header.Get("X-Request-Rule") != "1" || r.Header.Get("Cookie") != "" || r.Header.Get("X-Response-Rule") != "" || r.Header.Get("Server") != "kept" {
+		t.Errorf("request headers = %v, want only the request rules applied", r.Header)
+	}
+
+	resp := &http.Response{Header: http.Header{"Server": {"nginx"}, "Cookie": {"kept"}}}
+	hr.ApplyResponse(resp, &TemplateVars{})
+	if resp.Header.Get("X-Response-Rule") != "1" || resp.Header.Get("Server") != "" || resp.Header.Get("X-Request-Rule") != "" || resp.Header.Get("Cookie") != "kept" {
+		t.Errorf("response headers = %v, want only the response rules applied", resp.Header)
+	}
+
+	// Routes without header rules have none
+	var none *HeaderRules
+	none.ApplyRequest(r, &TemplateVars{})
+	none.ApplyResponse(resp, &TemplateVars{})
+}
+
+func TestNewHeaderRulesErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		rulesConf configs.HeaderRulesConfig
+		wantErr   string
+	}{
+		{"unknown request variable", configs.HeaderRulesConfig{Request: configs.HeaderOperationsConfig{Set: map[string]string{"X-A": "${user}"}}}, "request header rules: header 'X-A': unknown template variable '${user}'"},
+		{"unknown response variable", configs.HeaderRulesConfig{Response: configs.HeaderOperationsConfig{Add: map[string]string{"X-A": "${}"}}}, "response header rules: header 'X-A': unknown template variable '${}'"},
+		{"control character", configs.HeaderRulesConfig{Request: configs.HeaderOperationsConfig{Set: map[string]string{"X-A": "a\nb"}}}, "invalid control character"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newHeaderRules(&tt.rulesConf)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("newHeaderRules() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
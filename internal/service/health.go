@@ -0,0 +1,188 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+// Defaults of the health checks if the configuration leaves them unset
+const (
+	defaultProbeInterval      = 10 * time.Second
+	defaultProbeTimeout       = 2 * time.Second
+	defaultHealthyThreshold   = 2
+	defaultUnhealthyThreshold = 3
+	defaultEjectionTime       = 30 * time.Second
+)
+
+// healthChecker keeps track of the health of the upstreams of a service. Upstreams start healthy.
+type healthChecker struct {
+	// SNI of the service the checker belongs to, used in log messages
+	sni    string
+	active configs.ActiveHealthCheckConfig
+	// Consecutive5xx, ConsecutiveConnectErrors and EjectionTime of the passive health check
+	passive configs.PassiveHealthCheckConfig
+	// Client sending the probes with the transport of the service
+	client *http.Client
+	// ControlPlane logger all state changes are written to
+	cpLogger *log.Logger
+}
+
+// newHealthChecker returns the health checker of a service or nil if no health check is configured
+func newHealthChecker(sni string, healthCheckConf *configs.HealthCheckConfig, transport http.RoundTripper, controlPlaneLogger *log.Logger) *healthChecker {
+	active, passive := healthCheckConf.Active, healthCheckConf.Passive
+	if active.Path == "" && passive.Consecutive5xx <= 0 && passive.ConsecutiveConnectErrors <= 0 {
+		return nil
+	}
+
+	if active.Interval <= 0 {
+		active.Interval = defaultProbeInterval
+	}
+	if active.Timeout <= 0 {
+		active.Timeout = defaultProbeTimeout
+	}
+	if active.HealthyThreshold <= 0 {
+		active.HealthyThreshold = defaultHealthyThreshold
+	}
+	if active.UnhealthyThreshold <= 0 {
+		active.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+	if passive.EjectionTime <= 0 {
+		passive.EjectionTime = defaultEjectionTime
+	}
+
+	return &healthChecker{
+		sni:     sni,
+		active:  active,
+		passive: passive,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   active.Timeout,
+			// A redirect is an answer, so it counts as success instead of being followed
+			CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		cpLogger: controlPlaneLogger,
+	}
+}
+
+// start begins probing the upstreams if active health checks are configured. Every upstream is probed by its own goroutine.
+func (hc *healthChecker) start(upstreams []*Upstream) {
+	if hc.active.Path == "" {
+		return
+	}
+	for _, upstream := range upstreams {
+		go hc.probeLoop(upstream)
+	}
+}
+
+func (hc *healthChecker) probeLoop(upstream *Upstream) {
+	ticker := time.NewTicker(hc.active.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := hc.probe(upstream)
+		upstream.recordProbe(err)
+	}
+}
+
+// probe sends a GET request to the health check path of the upstream. Status codes below 400 count as success.
+func (hc *healthChecker) probe(upstream *Upstream) error {
+	probeURL := *upstream.URL
+	probeURL.Path, probeURL.RawPath, probeURL.RawQuery = hc.active.Path, "", ""
+
+	resp, err := hc.client.Get(probeURL.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// recordProbe updates the active health state of the upstream with the result of a probe
+func (u *Upstream) recordProbe(probeErr error) {
+	hc := u.health
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if probeErr == nil {
+		u.probeFailures = 0
+		u.probeSuccesses++
+		if u.probeDown.Load() && u.probeSuccesses >= hc.active.HealthyThreshold {
+			u.probeDown.Store(false)
+			hc.cpLogger.Printf("health: upstream %s of service %s is healthy after %d successful probes", u.URL, hc.sni, u.probeSuccesses)
+		}
+		return
+	}
+
+	u.probeSuccesses = 0
+	u.probeFailures++
+	if !u.probeDown.Load() && u.probeFailures >= hc.active.UnhealthyThreshold {
+		u.probeDown.Store(true)
+		hc.cpLogger.Printf("health: upstream %s of service %s is unhealthy after %d failed probes: %v", u.URL, hc.sni, u.probeFailures, probeErr)
+	}
+}
+
+// observeResponse feeds the status code of a response received from the upstream into the passive health check
+func (u *Upstream) observeResponse(statusCode int) {
+	hc := u.health
+	if hc == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.consecutiveConnectErrors = 0
+	if statusCode < http.StatusInternalServerError {
+		u.consecutive5xx = 0
+		return
+	}
+	u.consecutive5xx++
+	if hc.passive.Consecutive5xx > 0 && u.consecutive5xx >= hc.passive.Consecutive5xx {
+		u.eject(fmt.Sprintf("%d consecutive 5xx responses", u.consecutive5xx))
+	}
+}
+
+// observeError feeds an error of the transport into the passive health check. Only connect errors, e.g., a refused
+// connection or a failed TLS handshake, count towards ejecting the upstream.
+func (u *Upstream) observeError(err error) {
+	hc := u.health
+	if hc == nil || !isConnectError(err) {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.consecutiveConnectErrors++
+	if hc.passive.ConsecutiveConnectErrors > 0 && u.consecutiveConnectErrors >= hc.passive.ConsecutiveConnectErrors {
+		u.eject(fmt.Sprintf("%d consecutive connect errors, last: %v", u.consecutiveConnectErrors, err))
+	}
+}
+
+// eject removes the upstream from selection for the ejection time. The caller must hold u.mu.
+func (u *Upstream) eject(reason string) {
+	u.consecutive5xx, u.consecutiveConnectErrors = 0, 0
+	if u.ejected.Load() {
+		return
+	}
+
+	hc := u.health
+	u.ejected.Store(true)
+	hc.cpLogger.Printf("health: upstream %s of service %s ejected for %s: %s", u.URL, hc.sni, hc.passive.EjectionTime, reason)
+
+	time.AfterFunc(hc.passive.EjectionTime, func() {
+		u.ejected.Store(false)
+		hc.cpLogger.Printf("health: upstream %s of service %s returned after ejection", u.URL, hc.sni)
+	})
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+// roundTripError sends a GET request to the URL with a fresh transport and returns the error of the transport
+func roundTripError(t *testing.T, transport *http.Transport, url string) error {
+	t.Helper()
+	defer transport.CloseIdleConnections()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): %v", err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestIsConnectError(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+	untrusted := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	untrusted.Config.ErrorLog = log.New(io.Discard, "", 0)
+	untrusted.StartTLS()
+	defer untrusted.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	reset := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := http.NewResponseController(w).Hijack()
+		conn.Close()
+	}))
+	defer reset.Close()
+
+	// Address nothing listens on, taken after the servers above so none of them reuses its port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): %v", err)
+	}
+	closedAddr := listener.Addr().String()
+	listener.Close()
+
+	tests := []struct {
+		name      string
+		transport *http.Transport
+		url       string
+		want      bool
+	}{
+		{"connection refused", &http.Transport{}, "http://" + closedAddr, true},
+		{"TLS to a cleartext server", &http.Transport{}, "https://" + plain.Listener.Addr().String(), true},
+		{"untrusted certificate", &http.Transport{}, untrusted.URL, true},
+		{"response header timeout", &http.Transport{ResponseHeaderTimeout: 20 * time.Millisecond}, slow.URL, false},
+		{"connection closed after the request was sent", &http.Transport{}, reset.URL, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := roundTripError(t, tt.transport, tt.url)
+			if err == nil {
+				t.Fatal("RoundTrip() succeeded, want error")
+			}
+			if got := isConnectError(err); got != tt.want {
+				t.Errorf("isConnectError(%v) = %t, want %t", err, got, tt.want)
+			}
+		})
+	}
+
+	if isConnectError(nil) {
+		t.Error("isConnectError(nil) = true, want false")
+	}
+}
+
+func TestObserveErrorCountsConnectErrorsOnly(t *testing.T) {
+	hc := newHealthChecker("service.example.de", &configs.HealthCheckConfig{
+		Passive: configs.PassiveHealthCheckConfig{ConsecutiveConnectErrors: 2, EjectionTime: time.Minute},
+	}, http.DefaultTransport, log.New(io.Discard, "", 0))
+	upstream := &Upstream{health: hc}
+
+	connectErr := &net.OpError{Op: "dial", Net: "tcp", Err: io.ErrUnexpectedEOF}
+	otherErr := &net.OpError{Op: "read", Net: "tcp", Err: io.ErrUnexpectedEOF}
+
+	upstream.observeError(connectErr)
+	upstream.observeError(otherErr)
+	upstream.observeError(tls.AlertError(0))
+	if upstream.Available() {
+		t.Fatal("upstream available after 2 connect errors, want ejected")
+	}
+
+	upstream = &Upstream{health: hc}
+	for range 5 {
+		upstream.observeError(otherErr)
+	}
+	if !upstream.Available() {
+		t.Error("upstream ejected after errors that are no connect errors")
+	}
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+const (
+	// HTTP/2 if the upstream offers it via ALPN, HTTP/1.1 otherwise. Cleartext upstreams use HTTP/1.1
+	upstreamProtocolAuto = "auto"
+	// HTTP/1.1 only
+	upstreamProtocolH1 = "h1"
+	// HTTP/2 over TLS only
+	upstreamProtocolH2 = "h2"
+	// HTTP/2 over cleartext TCP with prior knowledge. TLS upstreams are spoken to with HTTP/2 as well
+	upstreamProtocolH2C = "h2c"
+)
+
+// targetContextKey is the context key of the URL a request is forwarded to
+type targetContextKey struct{}
+
+// upstreamContextKey is the context key of the upstream selected for a request
+type upstreamContextKey struct{}
+
+// WithUpstream returns a copy of ctx carrying the upstream selected for the request.
+// The transport of the service needs it to pass the request through the upstream's circuit breaker.
+func WithUpstream(ctx context.Context, upstream *Upstream) context.Context {
+	return context.WithValue(ctx, upstreamContextKey{}, upstream)
+}
+
+// UpstreamFromContext returns the upstream stored in ctx by WithUpstream, or nil if there is none
+func UpstreamFromContext(ctx context.Context) *Upstream {
+	upstream, _ := ctx.Value(upstreamContextKey{}).(*Upstream)
+	return upstream
+}
+
+// WithTarget returns a copy of ctx that makes the service's proxy forward the request to target.
+// It is used to send requests to the upstream of their route or the first hop of a service function chain.
+func WithTarget(ctx context.Context, target *url.URL) context.Context {
+	return context.WithValue(ctx, targetContextKey{}, target)
+}
+
+// TargetFromContext returns the target stored in ctx by WithTarget, or nil if there is none
+func TargetFromContext(ctx context.Context) *url.URL {
+	target, _ := ctx.Value(targetContextKey{}).(*url.URL)
+	return target
+}
+
+// NewTransport returns the long-lived HTTP transport a service uses for all its requests.
+// Connections to the service are reused across requests. TLS is only used for "https" targets.
+// Parameters:
+//   - servicesTLS: A pointer to the client TLS configuration for services.
+//   - protocol: The protocol spoken to the upstreams: "auto" (default), "h1", "h2" or "h2c".
+//
+// Returns:
+//   - *http.Transport: The created HTTP transport.
+//   - error: An error if the protocol is unknown.
+func NewTransport(servicesTLS *tls.Config, protocol string) (*http.Transport, error) {
+	var protocols http.Protocols
+	switch protocol {
+	case "", upstreamProtocolAuto:
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	case upstreamProtocolH1:
+		protocols.SetHTTP1(true)
+	case upstreamProtocolH2:
+		protocols.SetHTTP2(true)
+	case upstreamProtocolH2C:
+		protocols.SetUnencryptedHTTP2(true)
+		protocols.SetHTTP2(true)
+	default:
+		return nil, fmt.Errorf("service.NewTransport(): unsupported upstream protocol '%s'", protocol)
+	}
+
+	// The transport sets the ALPN protocols it offers according to its protocols, so the shared client TLS
+	// configuration must not be modified
+	clientTLS := servicesTLS.Clone()
+	clientTLS.NextProtos = nil
+	if !protocols.HTTP2() {
+		clientTLS.NextProtos = []string{"http/1.1"}
+	}
+
+	return &http.Transport{
+		Proxy:               nil,
+		IdleConnTimeout:     10 * time.Second,
+		MaxIdleConnsPerHost: 10000,
+		TLSClientConfig:     clientTLS,
+		TLSHandshakeTimeout: 10 * time.Second,
+		Protocols:           &protocols,
+	}, nil
+}
+
+// newReverseProxy returns the long-lived reverse proxy of a service. It forwards every request to the target stored in the
+// request context (see WithTarget). The inbound Host header is preserved.
+func newReverseProxy(transport http.RoundTripper) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(TargetFromContext(pr.In.Context()))
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+		},
+		Transport: transport,
+	}
+}
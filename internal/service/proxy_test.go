@@ -0,0 +1,190 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+// newCountingTLSServer starts a TLS server answering every request with a short body. It counts the connections accepted.
+func newCountingTLSServer(tb testing.TB) (*httptest.Server, *atomic.Int64) {
+	tb.Helper()
+
+	conns := new(atomic.Int64)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	tb.Cleanup(server.Close)
+	return server, conns
+}
+
+// servicesTLSFor returns a client TLS configuration trusting the certificate of the test server
+func servicesTLSFor(server *httptest.Server) *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	return &tls.Config{RootCAs: roots}
+}
+
+// proxyRequest sends a single request through the proxy to the target and fails the benchmark on a non-200 answer
+func proxyRequest(tb testing.TB, proxy http.Handler, target *url.URL) {
+	req := httptest.NewRequest("GET", "https://service.example.de/", nil)
+	req = req.WithContext(WithTarget(req.Context(), target))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		tb.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+// BenchmarkProxyConnectionReuse compares the connections opened to a service by its long-lived proxy and transport
+// with those opened if every request gets a new transport, as before the transport was kept per service.
+func BenchmarkProxyConnectionReuse(b *testing.B) {
+	b.Run("shared transport", func(b *testing.B) {
+		server, conns := newCountingTLSServer(b)
+		service, err := NewService("service.example.de", &configs.ServiceConfig{ServiceURL: server.URL}, servicesTLSFor(server),
+			newRetryBudget(&configs.RetryBudgetConfig{}), log.New(io.Discard, "", 0), log.New(io.Discard, "", 0))
+		if err != nil {
+			b.Fatalf("NewService(): %v", err)
+		}
+		defer service.Transport.CloseIdleConnections()
+
+		for b.Loop() {
+			proxyRequest(b, service.Proxy, service.ServiceUrl)
+		}
+		b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+	})
+
+	b.Run("transport per request", func(b *testing.B) {
+		server, conns := newCountingTLSServer(b)
+		servicesTLS := servicesTLSFor(server)
+		target, _ := url.Parse(server.URL)
+
+		for b.Loop() {
+			transport := &http.Transport{
+				IdleConnTimeout:     10 * time.Second,
+				MaxIdleConnsPerHost: 10000,
+				TLSClientConfig:     servicesTLS,
+			}
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			proxy.Transport = transport
+			proxyRequest(b, proxy, target)
+			transport.CloseIdleConnections()
+		}
+		b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+	})
+}
+
+func TestProxyReusesConnections(t *testing.T) {
+	server, conns := newCountingTLSServer(t)
+	service, err := NewService("service.example.de", &configs.ServiceConfig{ServiceURL: server.URL}, servicesTLSFor(server),
+		newRetryBudget(&configs.RetryBudgetConfig{}), log.New(io.Discard, "", 0), log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	defer service.Transport.CloseIdleConnections()
+
+	for range 20 {
+		proxyRequest(t, service.Proxy, service.ServiceUrl)
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("service accepted %d connections for 20 sequential requests, want 1", n)
+	}
+}
+
+// newProtoServer starts a server answering every request with the protocol it was received with
+func newProtoServer(t *testing.T, useTLS bool, protocols func(*http.Protocols)) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	protocols(server.Config.Protocols)
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	if useTLS {
+		server.EnableHTTP2 = server.Config.Protocols.HTTP2()
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestNewTransportNegotiatesProtocol(t *testing.T) {
+	h1AndH2 := func(p *http.Protocols) { p.SetHTTP1(true); p.SetHTTP2(true) }
+	h1Only := func(p *http.Protocols) { p.SetHTTP1(true) }
+	h2cAndH1 := func(p *http.Protocols) { p.SetHTTP1(true); p.SetUnencryptedHTTP2(true) }
+
+	tests := []struct {
+		name      string
+		useTLS    bool
+		server    func(*http.Protocols)
+		protocol  string
+		wantProto string
+	}{
+		{"auto over TLS", true, h1AndH2, upstreamProtocolAuto, "HTTP/2.0"},
+		{"default over TLS", true, h1AndH2, "", "HTTP/2.0"},
+		{"auto falls back to HTTP/1.1", true, h1Only, upstreamProtocolAuto, "HTTP/1.1"},
+		{"h1 over TLS", true, h1AndH2, upstreamProtocolH1, "HTTP/1.1"},
+		{"h2 over TLS", true, h1AndH2, upstreamProtocolH2, "HTTP/2.0"},
+		{"h2 requires HTTP/2", true, h1Only, upstreamProtocolH2, ""},
+		{"h2c", false, h2cAndH1, upstreamProtocolH2C, "HTTP/2.0"},
+		{"auto without TLS", false, h2cAndH1, upstreamProtocolAuto, "HTTP/1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newProtoServer(t, tt.useTLS, tt.server)
+			servicesTLS := &tls.Config{}
+			if tt.useTLS {
+				servicesTLS = servicesTLSFor(server)
+			}
+			transport, err := NewTransport(servicesTLS, tt.protocol)
+			if err != nil {
+				t.Fatalf("NewTransport(): %v", err)
+			}
+			defer transport.CloseIdleConnections()
+
+			resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+			if tt.wantProto == "" {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("GET succeeded with %s, want error", resp.Proto)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GET: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.Proto != tt.wantProto || string(body) != tt.wantProto {
+				t.Errorf("client spoke %s and server received %s, want %s", resp.Proto, body, tt.wantProto)
+			}
+		})
+	}
+}
+
+func TestNewTransportRejectsUnknownProtocol(t *testing.T) {
+	if _, err := NewTransport(&tls.Config{}, "h3"); err == nil {
+		t.Error("NewTransport() with protocol h3 succeeded, want error")
+	}
+}
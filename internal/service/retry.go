@@ -0,0 +1,320 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/grpcutil"
+)
+
+// Defaults of the retries and the retry budget if the configuration leaves them unset
+const (
+	defaultRetryBaseBackoff = 25 * time.Millisecond
+	defaultRetryMaxBackoff  = 250 * time.Millisecond
+	defaultRetryBodyLimit   = 64 << 10
+
+	defaultRetryBudgetPercent    = 20
+	defaultRetryBudgetMinRetries = 10
+	defaultRetryBudgetWindow     = 10 * time.Second
+)
+
+// requestHashContextKey is the context key of the hash identifying a request in log files
+type requestHashContextKey struct{}
+
+// WithRequestHash returns a copy of ctx carrying the hash of the request, so the transport can refer to it in log messages
+func WithRequestHash(ctx context.Context, hash string) context.Context {
+	return context.WithValue(ctx, requestHashContextKey{}, hash)
+}
+
+func requestHashFromContext(ctx context.Context) string {
+	hash, _ := ctx.Value(requestHashContextKey{}).(string)
+	return hash
+}
+
+// retryBudget limits the retries of all services to a share of the forwarded requests
+type retryBudget struct {
+	percent    float64
+	minRetries int
+	window     time.Duration
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+func newRetryBudget(budgetConf *configs.RetryBudgetConfig) *retryBudget {
+	rb := &retryBudget{
+		percent:     budgetConf.Percent,
+		minRetries:  budgetConf.MinRetries,
+		window:      budgetConf.Window,
+		windowStart: time.Now(),
+	}
+	if rb.percent <= 0 {
+		rb.percent = defaultRetryBudgetPercent
+	}
+	if rb.minRetries <= 0 {
+		rb.minRetries = defaultRetryBudgetMinRetries
+	}
+	if rb.window <= 0 {
+		rb.window = defaultRetryBudgetWindow
+	}
+	return rb
+}
+
+// rotate starts a new window if the current one has elapsed. The caller must hold rb.mu.
+func (rb *retryBudget) rotate(now time.Time) {
+	if now.Sub(rb.windowStart) > rb.window {
+		rb.windowStart = now
+		rb.requests, rb.retries = 0, 0
+	}
+}
+
+// recordRequest counts a forwarded request
+func (rb *retryBudget) recordRequest() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.rotate(time.Now())
+	rb.requests++
+}
+
+// tryRetry reports whether the budget allows another retry and, if so, counts it
+func (rb *retryBudget) tryRetry() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.rotate(time.Now())
+	allowed := int(rb.percent * float64(rb.requests) / 100)
+	if allowed < rb.minRetries {
+		allowed = rb.minRetries
+	}
+	if rb.retries >= allowed {
+		return false
+	}
+	rb.retries++
+	return true
+}
+
+// retryTransport retries failed attempts of a request as configured for a service
+type retryTransport struct {
+	next        http.RoundTripper
+	maxRetries  int
+	retryOn     map[int]bool
+	safeHeader  string
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	failover    bool
+	bodyLimit   int64
+	budget      *retryBudget
+	// DataPlane logger every retry is written to
+	dpLogger *log.Logger
+}
+
+func newRetryTransport(next http.RoundTripper, retryConf *configs.RetryConfig, budget *retryBudget, dataPlaneLogger *log.Logger) *retryTransport {
+	rt := &retryTransport{
+		next:        next,
+		maxRetries:  retryConf.MaxRetries,
+		retryOn:     make(map[int]bool, len(retryConf.RetryOn)),
+		safeHeader:  retryConf.SafeHeader,
+		baseBackoff: retryConf.BaseBackoff,
+		maxBackoff:  retryConf.MaxBackoff,
+		failover:    retryConf.Failover,
+		bodyLimit:   retryConf.BodyLimit,
+		budget:      budget,
+		dpLogger:    dataPlaneLogger,
+	}
+	for _, status := range retryConf.RetryOn {
+		rt.retryOn[status] = true
+	}
+	if rt.baseBackoff <= 0 {
+		rt.baseBackoff = defaultRetryBaseBackoff
+	}
+	if rt.maxBackoff <= 0 {
+		rt.maxBackoff = defaultRetryMaxBackoff
+	}
+	if rt.bodyLimit <= 0 {
+		rt.bodyLimit = defaultRetryBodyLimit
+	}
+	return rt
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.budget.recordRequest()
+	if rt.maxRetries <= 0 || !rt.retryable(req) {
+		return rt.next.RoundTrip(req)
+	}
+
+	body, replayable, err := rt.bufferBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if !replayable {
+		return rt.next.RoundTrip(req)
+	}
+
+	upstream := UpstreamFromContext(req.Context())
+	tried := []*Upstream{upstream}
+	attemptReq := req
+
+	for attempt := 0; ; attempt++ {
+		if body != nil {
+			attemptReq.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := rt.next.RoundTrip(attemptReq)
+
+		reason := rt.retryReason(resp, err)
+		if reason == "" || attempt >= rt.maxRetries {
+			return resp, err
+		}
+		if !rt.budget.tryRetry() {
+			rt.dpLogger.Printf("retry: budget exhausted, not retrying %s request to %s after %s - [Hash:'%s']", req.Method, attemptReq.URL, reason, requestHashFromContext(req.Context()))
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		if err := rt.backoff(req.Context(), attempt); err != nil {
+			return nil, err
+		}
+
+		attemptReq, upstream = rt.nextAttempt(attemptReq, upstream, tried)
+		tried = append(tried, upstream)
+		rt.dpLogger.Printf("retry: attempt %d of %s request to %s after %s - [Hash:'%s']", attempt+2, req.Method, attemptReq.URL, reason, requestHashFromContext(req.Context()))
+	}
+}
+
+// retryable reports whether the request may be sent more than once.
+// gRPC calls are never retried, since buffering their body would break streaming.
+func (rt *retryTransport) retryable(req *http.Request) bool {
+	if grpcutil.IsRequest(req) {
+		return false
+	}
+	if rt.safeHeader != "" && req.Header.Get(rt.safeHeader) != "" {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// bufferBody reads the request body so it can be replayed. Bodies larger than the limit are not buffered;
+// the request is then restored and sent only once.
+func (rt *retryTransport) bufferBody(req *http.Request) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if req.ContentLength > rt.bodyLimit {
+		return nil, false, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, rt.bodyLimit+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("service.retryTransport.bufferBody(): %v", err)
+	}
+	if int64(len(body)) > rt.bodyLimit {
+		// Put the read part in front of the unread rest of the body
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false, nil
+	}
+	req.Body.Close()
+	return body, true, nil
+}
+
+// retryReason returns why the outcome of an attempt should be retried, or "" if it should not.
+// Of the transport errors only connect errors are retried, since the upstream may have processed the request after it was sent.
+// Rejections by an open circuit breaker are only retried if the retry can fail over to another upstream.
+func (rt *retryTransport) retryReason(resp *http.Response, err error) string {
+	var circuitOpen *CircuitOpenError
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return ""
+	case errors.As(err, &circuitOpen):
+		if rt.failover {
+			return "open circuit breaker"
+		}
+		return ""
+	case isConnectError(err):
+		return fmt.Sprintf("connect error '%v'", err)
+	case err != nil:
+		return ""
+	case rt.retryOn[resp.StatusCode]:
+		return fmt.Sprintf("status %d", resp.StatusCode)
+	}
+	return ""
+}
+
+// backoff waits before the retry following the given attempt. The wait grows exponentially and is fully jittered.
+func (rt *retryTransport) backoff(ctx context.Context, attempt int) error {
+	backoff := rt.maxBackoff
+	if attempt < 30 && rt.baseBackoff<<attempt < rt.maxBackoff {
+		backoff = rt.baseBackoff << attempt
+	}
+
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff) + 1)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// nextAttempt returns the request of the next attempt and the upstream it goes to. With failover, requests sent directly
+// to their upstream move to another available upstream of the same pool, preferably one that has not been tried yet.
+func (rt *retryTransport) nextAttempt(req *http.Request, upstream *Upstream, tried []*Upstream) (*http.Request, *Upstream) {
+	if !rt.failover || upstream == nil || upstream.pool == nil || req.URL.Host != upstream.URL.Host {
+		return req, upstream
+	}
+
+	next := upstream.pool.selectExcluding(req, tried)
+	if next == nil {
+		next = upstream.pool.selectExcluding(req, []*Upstream{upstream})
+	}
+	if next == nil {
+		return req, upstream
+	}
+
+	attemptReq := req.Clone(WithUpstream(req.Context(), next))
+	rebaseURL(attemptReq, upstream.URL, next.URL)
+	return attemptReq, next
+}
+
+// rebaseURL moves a request that the reverse proxy rewrote for the upstream URL from to the upstream URL to.
+// The base path and query of from are removed before the request is rewritten for to the same way as by the reverse proxy.
+func rebaseURL(req *http.Request, from, to *url.URL) {
+	escapedPath := strings.TrimPrefix(req.URL.EscapedPath(), strings.TrimSuffix(from.EscapedPath(), "/"))
+	req.URL.Path = strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(from.Path, "/"))
+	req.URL.RawPath = ""
+	if escapedPath != req.URL.EscapedPath() {
+		req.URL.RawPath = escapedPath
+	}
+	if from.RawQuery != "" {
+		req.URL.RawQuery = strings.TrimPrefix(strings.TrimPrefix(req.URL.RawQuery, from.RawQuery), "&")
+	}
+
+	// SetURL clears the outbound Host header, which the reverse proxy sets to the inbound one
+	host := req.Host
+	(&httputil.ProxyRequest{Out: req}).SetURL(to)
+	req.Host = host
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+func TestRetryReason(t *testing.T) {
+	rt := newRetryTransport(nil, &configs.RetryConfig{MaxRetries: 1, RetryOn: []int{503}}, newRetryBudget(&configs.RetryBudgetConfig{}), log.New(io.Discard, "", 0))
+
+	tests := []struct {
+		name     string
+		status   int
+		err      error
+		failover bool
+		want     bool
+	}{
+		{"success", 200, nil, false, false},
+		{"configured status", 503, nil, false, true},
+		{"other status", 500, nil, false, false},
+		{"connection refused", 0, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, false, true},
+		{"reset after the request was sent", 0, &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, false, false},
+		{"response header timeout", 0, errors.New("net/http: timeout awaiting response headers"), false, false},
+		{"canceled by the client", 0, context.Canceled, false, false},
+		{"open breaker without failover", 0, &CircuitOpenError{}, false, false},
+		{"open breaker with failover", 0, &CircuitOpenError{}, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt.failover = tt.failover
+			var resp *http.Response
+			if tt.err == nil {
+				resp = &http.Response{StatusCode: tt.status}
+			}
+			if got := rt.retryReason(resp, tt.err) != ""; got != tt.want {
+				t.Errorf("retryReason() retries = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRebaseURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		inbound  string
+		want     string
+	}{
+		{"no base paths", "http://a.example.de", "http://b.example.de", "/users?id=1", "http://b.example.de/users?id=1"},
+		{"base path added", "http://a.example.de", "http://b.example.de/v2", "/users", "http://b.example.de/v2/users"},
+		{"base path removed", "http://a.example.de/v1", "http://b.example.de", "/users", "http://b.example.de/users"},
+		{"base path replaced", "http://a.example.de/v1/", "https://b.example.de/v2", "/users?id=1", "https://b.example.de/v2/users?id=1"},
+		{"escaped path", "http://a.example.de/v1", "http://b.example.de/v2", "/a%2Fb", "http://b.example.de/v2/a%2Fb"},
+		{"base query replaced", "http://a.example.de/?tenant=a", "http://b.example.de/?tenant=b", "/users?id=1", "http://b.example.de/users?tenant=b&id=1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, _ := url.Parse(tt.from)
+			to, _ := url.Parse(tt.to)
+
+			// Rewrite the request for the first upstream like the reverse proxy does
+			req := httptest.NewRequest("GET", tt.inbound, nil)
+			req = req.WithContext(WithTarget(req.Context(), from))
+			out := req.Clone(req.Context())
+			out.URL.Host, out.URL.Scheme = "", ""
+			newReverseProxy(nil).Rewrite(&httputil.ProxyRequest{In: req, Out: out})
+
+			rebaseURL(out, from, to)
+			if got := out.URL.String(); got != tt.want {
+				t.Errorf("rebaseURL() = %s, want %s", got, tt.want)
+			}
+			if out.Host != req.Host {
+				t.Errorf("Host = %s, want inbound host %s", out.Host, req.Host)
+			}
+		})
+	}
+}
+
+func TestFailoverToUpstreamWithBasePath(t *testing.T) {
+	var gotPath string
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+	}))
+	defer healthy.Close()
+
+	// Address nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): %v", err)
+	}
+	refusing := "http://" + listener.Addr().String() + "/v1"
+	listener.Close()
+
+	pool, err := newUpstreamPool("", []configs.UpstreamConfig{{URL: refusing}, {URL: healthy.URL + "/v2"}}, &poolSettings{breaker: &configs.CircuitBreakerConfig{}, cpLogger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatalf("newUpstreamPool(): %v", err)
+	}
+	rt := newRetryTransport(upstreamTransport{next: http.DefaultTransport}, &configs.RetryConfig{MaxRetries: 1, Failover: true, BaseBackoff: time.Millisecond},
+		newRetryBudget(&configs.RetryBudgetConfig{}), log.New(io.Discard, "", 0))
+	proxy := newReverseProxy(rt)
+
+	first := pool.Upstreams[0]
+	req := httptest.NewRequest("GET", "/users", nil)
+	req = req.WithContext(WithTarget(WithUpstream(req.Context(), first), first.URL))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if gotPath != "/v2/users" {
+		t.Errorf("failover upstream received path %s, want /v2/users", gotPath)
+	}
+}
+
+func TestNoRetryAfterRequestWasSent(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		conn, _, _ := http.NewResponseController(w).Hijack()
+		conn.Close()
+	}))
+	defer server.Close()
+
+	rt := newRetryTransport(http.DefaultTransport, &configs.RetryConfig{MaxRetries: 3, BaseBackoff: time.Millisecond},
+		newRetryBudget(&configs.RetryBudgetConfig{}), log.New(io.Discard, "", 0))
+	req := httptest.NewRequest("PUT", server.URL+"/", nil)
+	req.RequestURI = ""
+	if _, err := rt.RoundTrip(req); err == nil {
+		t.Fatal("RoundTrip() succeeded, want error")
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("upstream received %d attempts, want 1", n)
+	}
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/ratelimit"
+)
+
+// Name of the route built from the service URL that catches all requests matching no configured route
+const defaultRouteName = "default"
+
+// Route sends the requests it matches to its own upstream. All match conditions set on a route must hold.
+type Route struct {
+	Name      string
+	Upstreams *UpstreamPool
+	// Rate limits applying to the requests matching the route
+	RateLimits []*ratelimit.Limiter
+	// Header rules applying to the requests matching the route after those of the service (nil for the default route)
+	HeaderRules *HeaderRules
+	// CORS policy replacing that of the service for the requests matching the route (nil if the route has none)
+	CORS *CORS
+
+	pathPrefix    string
+	path          string
+	pathRegex     *regexp.Regexp
+	methods       []string
+	headers       map[string]string
+	stripPrefix   bool
+	rewritePrefix string
+}
+
+// newRoute creates a route from its configuration. index is the position of the route in the service configuration.
+func newRoute(routeConf *configs.RouteConfig, index int, settings *poolSettings) (*Route, error) {
+	rt := &Route{
+		Name:          routeConf.Name,
+		pathPrefix:    routeConf.PathPrefix,
+		path:          routeConf.Path,
+		stripPrefix:   routeConf.StripPrefix,
+		rewritePrefix: routeConf.RewritePrefix,
+	}
+	if rt.Name == "" {
+		rt.Name = fmt.Sprintf("route-%d", index)
+	}
+
+	var err error
+	rt.Upstreams, err = newUpstreamPool(routeConf.UpstreamURL, routeConf.Upstreams, settings)
+	if err != nil {
+		return nil, fmt.Errorf("service.newRoute(): route '%s': %v", rt.Name, err)
+	}
+
+	rt.RateLimits, err = ratelimit.NewLimiters(routeConf.RateLimits)
+	if err != nil {
+		return nil, fmt.Errorf("service.newRoute(): route '%s': %v", rt.Name, err)
+	}
+
+	rt.HeaderRules, err = newHeaderRules(&routeConf.HeaderRules)
+	if err != nil {
+		return nil, fmt.Errorf("service.newRoute(): route '%s': %v", rt.Name, err)
+	}
+
+	rt.CORS, err = newCORS(&routeConf.CORS)
+	if err != nil {
+		return nil, fmt.Errorf("service.newRoute(): route '%s': %v", rt.Name, err)
+	}
+
+	if routeConf.PathRegex != "" {
+		rt.pathRegex, err = regexp.Compile(routeConf.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("service.newRoute(): route '%s': invalid path_regex: %v", rt.Name, err)
+		}
+	}
+
+	if (rt.stripPrefix || rt.rewritePrefix != "") && rt.pathPrefix == "" {
+		return nil, fmt.Errorf("service.newRoute(): route '%s': strip_prefix and rewrite_prefix require a path_prefix", rt.Name)
+	}
+	if rt.stripPrefix && rt.rewritePrefix != "" {
+		return nil, fmt.Errorf("service.newRoute(): route '%s': strip_prefix and rewrite_prefix are mutually exclusive", rt.Name)
+	}
+
+	for _, method := range routeConf.Methods {
+		rt.methods = append(rt.methods, strings.ToUpper(method))
+	}
+
+	if len(routeConf.Headers) > 0 {
+		rt.headers = make(map[string]string, len(routeConf.Headers))
+		for name, value := range routeConf.Headers {
+			rt.headers[http.CanonicalHeaderKey(name)] = value
+		}
+	}
+
+	return rt, nil
+}
+
+// newDefaultRoute creates the route forwarding all requests to the upstreams of the service
+func newDefaultRoute(upstreams *UpstreamPool) *Route {
+	return &Route{Name: defaultRouteName, Upstreams: upstreams}
+}
+
+// Matches reports whether the request satisfies all match conditions of the route.
+// CORS preflight requests are matched by the method they announce and without header conditions,
+// since browsers send none of the request's own headers in a preflight.
+func (rt *Route) Matches(r *http.Request) bool {
+	method := r.Method
+	preflight := IsPreflight(r)
+	if preflight {
+		method = r.Header.Get("Access-Control-Request-Method")
+	}
+
+	path := r.URL.Path
+	if rt.pathPrefix != "" && !hasPathPrefix(path, rt.pathPrefix) {
+		return false
+	}
+	if rt.path != "" && path != rt.path {
+		return false
+	}
+	if rt.pathRegex != nil && !rt.pathRegex.MatchString(path) {
+		return false
+	}
+
+	if len(rt.methods) > 0 {
+		found := false
+		for _, m := range rt.methods {
+			if m == method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if preflight {
+		return true
+	}
+	for name, value := range rt.headers {
+		values, ok := r.Header[name]
+		if !ok {
+			return false
+		}
+		if value == "" {
+			continue
+		}
+		found := false
+		for _, v := range values {
+			if v == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// RewritePath strips or rewrites the path prefix of the request as configured for the route.
+// It must only be called for requests the route matches.
+func (rt *Route) RewritePath(r *http.Request) {
+	if !rt.stripPrefix && rt.rewritePrefix == "" {
+		return
+	}
+
+	r.URL.Path = rewritePrefix(r.URL.Path, rt.pathPrefix, rt.rewritePrefix)
+	if r.URL.RawPath != "" {
+		r.URL.RawPath = rewritePrefix(r.URL.RawPath, rt.pathPrefix, rt.rewritePrefix)
+	}
+}
+
+// hasPathPrefix reports whether the path lies below the prefix. Prefixes match whole path segments only,
+// so "/api" matches "/api" and "/api/users", but not "/apix".
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// rewritePrefix replaces the path prefix matched by hasPathPrefix with replacement. The result always starts with '/'.
+func rewritePrefix(path, prefix, replacement string) string {
+	rest := strings.TrimPrefix(path, strings.TrimSuffix(prefix, "/"))
+	path = strings.TrimSuffix(replacement, "/") + rest
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestRouteMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   *Route
+		method  string
+		target  string
+		headers map[string]string
+		want    bool
+	}{
+		{"prefix itself", &Route{pathPrefix: "/api"}, "GET", "/api", nil, true},
+		{"below prefix", &Route{pathPrefix: "/api"}, "GET", "/api/users", nil, true},
+		{"prefix is no segment", &Route{pathPrefix: "/api"}, "GET", "/apix", nil, false},
+		{"prefix with trailing slash", &Route{pathPrefix: "/api/"}, "GET", "/api/users", nil, true},
+		{"root prefix", &Route{pathPrefix: "/"}, "GET", "/static/app.js", nil, true},
+		{"exact path", &Route{path: "/health"}, "GET", "/health", nil, true},
+		{"exact path with suffix", &Route{path: "/health"}, "GET", "/health/live", nil, false},
+		{"regex", &Route{pathRegex: regexp.MustCompile(`^/users/[0-9]+$`)}, "GET", "/users/42", nil, true},
+		{"regex mismatch", &Route{pathRegex: regexp.MustCompile(`^/users/[0-9]+$`)}, "GET", "/users/alice", nil, false},
+		{"method", &Route{methods: []string{"GET", "POST"}}, "POST", "/", nil, true},
+		{"other method", &Route{methods: []string{"GET", "POST"}}, "DELETE", "/", nil, false},
+		{"header value", &Route{headers: map[string]string{"X-Version": "2"}}, "GET", "/", map[string]string{"X-Version": "2"}, true},
+		{"other header value", &Route{headers: map[string]string{"X-Version": "2"}}, "GET", "/", map[string]string{"X-Version": "1"}, false},
+		{"header presence", &Route{headers: map[string]string{"X-Debug": ""}}, "GET", "/", map[string]string{"X-Debug": "on"}, true},
+		{"missing header", &Route{headers: map[string]string{"X-Debug": ""}}, "GET", "/", nil, false},
+		{"all conditions", &Route{pathPrefix: "/api", methods: []string{"GET"}, headers: map[string]string{"X-Version": "2"}}, "GET", "/api/users", map[string]string{"X-Version": "2"}, true},
+		{"one condition fails", &Route{pathPrefix: "/api", methods: []string{"GET"}, headers: map[string]string{"X-Version": "2"}}, "POST", "/api/users", map[string]string{"X-Version": "2"}, false},
+		{"preflight by announced method", &Route{methods: []string{"PUT"}, headers: map[string]string{"X-Version": "2"}}, "OPTIONS", "/",
+			map[string]string{"Origin": "https://app.example.de", "Access-Control-Request-Method": "PUT"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			if got := tt.route.Matches(r); got != tt.want {
+				t.Errorf("Matches(%s %s) = %t, want %t", tt.method, tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteRewritePath(t *testing.T) {
+	tests := []struct {
+		name   string
+		route  *Route
+		target string
+		want   string
+	}{
+		{"strip", &Route{pathPrefix: "/api", stripPrefix: true}, "/api/users", "/users"},
+		{"strip the whole path", &Route{pathPrefix: "/api", stripPrefix: true}, "/api", "/"},
+		{"strip prefix with trailing slash", &Route{pathPrefix: "/api/", stripPrefix: true}, "/api/users", "/users"},
+		{"rewrite", &Route{pathPrefix: "/api", rewritePrefix: "/v2"}, "/api/users", "/v2/users"},
+		{"rewrite with trailing slash", &Route{pathPrefix: "/api", rewritePrefix: "/v2/"}, "/api/users", "/v2/users"},
+		{"rewrite root prefix", &Route{pathPrefix: "/", rewritePrefix: "/app"}, "/users", "/app/users"},
+		{"neither strip nor rewrite", &Route{pathPrefix: "/api"}, "/api/users", "/api/users"},
+		{"escaped path", &Route{pathPrefix: "/api", rewritePrefix: "/v2"}, "/api/a%2Fb", "/v2/a/b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			tt.route.RewritePath(r)
+			if r.URL.Path != tt.want {
+				t.Errorf("RewritePath(%s) = %s, want %s", tt.target, r.URL.Path, tt.want)
+			}
+		})
+	}
+
+	// The escaped form of the path must be rewritten alike, so that the upstream receives the original encoding
+	r := httptest.NewRequest(http.MethodGet, "/api/a%2Fb", nil)
+	(&Route{pathPrefix: "/api", rewritePrefix: "/v2"}).RewritePath(r)
+	if escaped := r.URL.EscapedPath(); escaped != "/v2/a%2Fb" {
+		t.Errorf("EscapedPath() = %s, want /v2/a%%2Fb", escaped)
+	}
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+const (
+	// The header replaces the value set by the service
+	securityHeaderModeOverride = "override"
+	// The header is only added if the service did not set it
+	securityHeaderModeIfAbsent = "if_absent"
+
+	// HSTS max-age if none is configured (two years)
+	defaultHSTSMaxAge = 63072000 * time.Second
+	// Smallest max-age accepted by the browsers' HSTS preload lists (one year)
+	minHSTSPreloadMaxAge = 31536000 * time.Second
+)
+
+type securityHeader struct {
+	name     string
+	value    string
+	ifAbsent bool
+}
+
+// SecurityHeaders are the security headers added to all responses of a service
+type SecurityHeaders struct {
+	headers []securityHeader
+}
+
+func newSecurityHeaders(headersConf *configs.SecurityHeadersConfig) (*SecurityHeaders, error) {
+	h := new(SecurityHeaders)
+
+	if !headersConf.HSTS.Disabled {
+		hsts, err := newHSTSHeader(&headersConf.HSTS)
+		if err != nil {
+			return nil, fmt.Errorf("security headers: %v", err)
+		}
+		h.headers = append(h.headers, hsts)
+	}
+
+	for _, header := range []struct {
+		name string
+		conf *configs.SecurityHeaderConfig
+	}{
+		{"Content-Security-Policy", &headersConf.ContentSecurityPolicy},
+		{"X-Frame-Options", &headersConf.XFrameOptions},
+		{"X-Content-Type-Options", &headersConf.XContentTypeOptions},
+		{"Referrer-Policy", &headersConf.ReferrerPolicy},
+		{"Permissions-Policy", &headersConf.PermissionsPolicy},
+		{"Cross-Origin-Opener-Policy", &headersConf.CrossOriginOpenerPolicy},
+		{"Cross-Origin-Embedder-Policy", &headersConf.CrossOriginEmbedderPolicy},
+		{"Cross-Origin-Resource-Policy", &headersConf.CrossOriginResourcePolicy},
+	} {
+		if header.conf.Value == "" {
+			continue
+		}
+		ifAbsent, err := parseSecurityHeaderMode(header.conf.Mode)
+		if err != nil {
+			return nil, fmt.Errorf("security headers: %s: %v", header.name, err)
+		}
+		h.headers = append(h.headers, securityHeader{name: header.name, value: header.conf.Value, ifAbsent: ifAbsent})
+	}
+
+	return h, nil
+}
+
+// newHSTSHeader builds the Strict-Transport-Security header, e.g., "max-age=63072000; includeSubDomains; preload"
+func newHSTSHeader(hstsConf *configs.HSTSConfig) (securityHeader, error) {
+	maxAge := hstsConf.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultHSTSMaxAge
+	}
+	if maxAge < 0 {
+		return securityHeader{}, fmt.Errorf("Strict-Transport-Security: max_age must not be negative")
+	}
+	includeSubDomains := hstsConf.IncludeSubDomains == nil || *hstsConf.IncludeSubDomains
+
+	if hstsConf.Preload && (!includeSubDomains || maxAge < minHSTSPreloadMaxAge) {
+		return securityHeader{}, fmt.Errorf("Strict-Transport-Security: preload requires include_subdomains and a max_age of at least %s", minHSTSPreloadMaxAge)
+	}
+
+	ifAbsent, err := parseSecurityHeaderMode(hstsConf.Mode)
+	if err != nil {
+		return securityHeader{}, fmt.Errorf("Strict-Transport-Security: %v", err)
+	}
+
+	value := "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	if includeSubDomains {
+		value += "; includeSubDomains"
+	}
+	if hstsConf.Preload {
+		value += "; preload"
+	}
+	return securityHeader{name: "Strict-Transport-Security", value: value, ifAbsent: ifAbsent}, nil
+}
+
+func parseSecurityHeaderMode(mode string) (bool, error) {
+	switch mode {
+	case "", securityHeaderModeOverride:
+		return false, nil
+	case securityHeaderModeIfAbsent:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unsupported mode '%s'", mode)
+	}
+}
+
+// Apply adds the security headers to a response of the service.
+// Headers in if_absent mode keep the value set by the service.
+func (h *SecurityHeaders) Apply(resp *http.Response) {
+	if h == nil {
+		return
+	}
+	for _, header := range h.headers {
+		if header.ifAbsent && resp.Header.Get(header.name) != "" {
+			continue
+		}
+		resp.Header.Set(header.name, header.value)
+	}
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+func TestHSTSHeader(t *testing.T) {
+	no := false
+
+	tests := []struct {
+		name     string
+		hstsConf configs.HSTSConfig
+		want     string
+		wantErr  string
+	}{
+		{"default", configs.HSTSConfig{}, "max-age=63072000; includeSubDomains", ""},
+		{"custom max age", configs.HSTSConfig{MaxAge: 24 * time.Hour}, "max-age=86400; includeSubDomains", ""},
+		{"without subdomains", configs.HSTSConfig{IncludeSubDomains: &no}, "max-age=63072000", ""},
+		{"preload", configs.HSTSConfig{Preload: true}, "max-age=63072000; includeSubDomains; preload", ""},
+		{"preload at minimum max age", configs.HSTSConfig{Preload: true, MaxAge: minHSTSPreloadMaxAge}, "max-age=31536000; includeSubDomains; preload", ""},
+		{"preload with short max age", configs.HSTSConfig{Preload: true, MaxAge: 30 * 24 * time.Hour}, "", "preload requires"},
+		{"preload without subdomains", configs.HSTSConfig{Preload: true, IncludeSubDomains: &no}, "", "preload requires"},
+		{"negative max age", configs.HSTSConfig{MaxAge: -time.Second}, "", "must not be negative"},
+		{"unknown mode", configs.HSTSConfig{Mode: "append"}, "", "unsupported mode 'append'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := newHSTSHeader(&tt.hstsConf)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("newHSTSHeader() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newHSTSHeader(): %v", err)
+			}
+			if header.name != "Strict-Transport-Security" || header.value != tt.want {
+				t.Errorf("newHSTSHeader() = %s: %s, want Strict-Transport-Security: %s", header.name, header.value, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecurityHeadersApply(t *testing.T) {
+	h, err := newSecurityHeaders(&configs.SecurityHeadersConfig{
+		HSTS:                configs.HSTSConfig{Mode: securityHeaderModeIfAbsent},
+		XFrameOptions:       configs.SecurityHeaderConfig{Value: "DENY"},
+		XContentTypeOptions: configs.SecurityHeaderConfig{Value: "nosniff", Mode: securityHeaderModeOverride},
+		ReferrerPolicy:      configs.SecurityHeaderConfig{Value: "no-referrer", Mode: securityHeaderModeIfAbsent},
+	})
+	if err != nil {
+		t.Fatalf("newSecurityHeaders(): %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		service http.Header
+		want    http.Header
+	}{
+		{"service sets none", http.Header{}, http.Header{
+			"Strict-Transport-Security": {"max-age=63072000; includeSubDomains"},
+			"X-Frame-Options":           {"DENY"},
+			"X-Content-Type-Options":    {"nosniff"},
+			"Referrer-Policy":           {"no-referrer"},
+		}},
+		{"service sets all", http.Header{
+			"Strict-Transport-Security": {"max-age=60"},
+			"X-Frame-Options":           {"SAMEORIGIN"},
+			"X-Content-Type-Options":    {"sniff"},
+			"Referrer-Policy":           {"origin"},
+		}, http.Header{
+			"Strict-Transport-Security": {"max-age=60"}, // if_absent keeps the value of the service
+			"X-Frame-Options":           {"DENY"},       // override is the default mode
+			"X-Content-Type-Options":    {"nosniff"},
+			"Referrer-Policy":           {"origin"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: tt.service}
+			h.Apply(resp)
+			for name, want := range tt.want {
+				if got := resp.Header.Values(name); len(got) != 1 || got[0] != want[0] {
+					t.Errorf("%s = %v, want %v", name, got, want)
+				}
+			}
+			if len(resp.Header) != len(tt.want) {
+				t.Errorf("headers = %v, want %v", resp.Header, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSecurityHeaders(t *testing.T) {
+	// Only HSTS is added without configuration
+	h, err := newSecurityHeaders(&configs.SecurityHeadersConfig{})
+	if err != nil {
+		t.Fatalf("newSecurityHeaders(): %v", err)
+	}
+	if len(h.headers) != 1 || h.headers[0].name != "Strict-Transport-Security" {
+		t.Errorf("default headers = %v, want only Strict-Transport-Security", h.headers)
+	}
+
+	h, err = newSecurityHeaders(&configs.SecurityHeadersConfig{HSTS: configs.HSTSConfig{Disabled: true}})
+	if err != nil {
+		t.Fatalf("newSecurityHeaders(): %v", err)
+	}
+	if len(h.headers) != 0 {
+		t.Errorf("headers with disabled HSTS = %v, want none", h.headers)
+	}
+
+	_, err = newSecurityHeaders(&configs.SecurityHeadersConfig{ContentSecurityPolicy: configs.SecurityHeaderConfig{Value: "default-src 'self'", Mode: "merge"}})
+	if err == nil || !strings.Contains(err.Error(), "Content-Security-Policy: unsupported mode 'merge'") {
+		t.Errorf("newSecurityHeaders() error = %v, want unsupported mode of Content-Security-Policy", err)
+	}
+
+	// Responses of services without security headers stay unchanged
+	var none *SecurityHeaders
+	none.Apply(&http.Response{Header: http.Header{}})
+}
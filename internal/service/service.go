@@ -1,22 +1,182 @@
 package service
 
 import (
+	"crypto/tls"
 	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
 	"net/url"
 
+	"github.com/leobrada/ztsfc_proxy/internal/celexpr"
 	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/ratelimit"
+	"github.com/leobrada/ztsfc_proxy/internal/sfc"
+	"github.com/leobrada/ztsfc_proxy/internal/waf"
 )
 
 type Service struct {
+	// URL requests matching no route are forwarded to (nil if the service has no service_url)
 	ServiceUrl *url.URL
+	// Routes in the order they are matched. If the service has upstreams of its own, the last route forwards all requests to them
+	Routes []*Route
+	// Long-lived reverse proxy forwarding all requests to the service. Built once, so backend connections are reused
+	Proxy *httputil.ReverseProxy
+	// Transport of Proxy holding the pool of connections to the service
+	Transport *http.Transport
+	// Compiled CEL expression every request to the service must satisfy (nil if none is configured)
+	AccessExpression *celexpr.Expression
+	// In-process service functions the PEP runs in order on every request to the service
+	Functions []*sfc.Function
+	// Rate limits applying to all requests to the service
+	RateLimits []*ratelimit.Limiter
+	// Header passing the verified client certificate on to the service
+	ClientCertHeader *ClientCertHeader
+	// Header rules applying to all requests to the service and their responses
+	HeaderRules *HeaderRules
+	// Security headers added to all responses of the service
+	SecurityHeaders *SecurityHeaders
+	// CORS policy of the service (nil if the service has none)
+	CORS *CORS
+	// Limits of WebSocket tunnels to the service (nil if the service does not allow upgrades)
+	Upgrade *Upgrade
+
+	// Health checker of the upstreams (nil if health checking is not configured)
+	health *healthChecker
 }
 
-func NewService(serviceConf *configs.ServiceConfig) (*Service, error) {
-	serviceURL, err := url.Parse(serviceConf.ServiceURL)
+func NewService(sni string, serviceConf *configs.ServiceConfig, servicesTLS *tls.Config, budget *retryBudget, dataPlaneLogger, controlPlaneLogger *log.Logger) (*Service, error) {
+	if serviceConf.ServiceURL == "" && len(serviceConf.Upstreams) == 0 && len(serviceConf.Routes) == 0 {
+		return nil, fmt.Errorf("service.NewService(): neither service_url, upstreams nor routes are configured")
+	}
+
+	transport, err := NewTransport(servicesTLS, serviceConf.UpstreamProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("service.NewService(): %v", err)
+	}
+	health := newHealthChecker(sni, &serviceConf.HealthCheck, transport, controlPlaneLogger)
+	settings := &poolSettings{
+		sni:      sni,
+		policy:   serviceConf.LoadBalancing,
+		health:   health,
+		breaker:  &serviceConf.CircuitBreaker,
+		cpLogger: controlPlaneLogger,
+	}
+
+	routes := make([]*Route, 0, len(serviceConf.Routes)+1)
+	for i := range serviceConf.Routes {
+		route, err := newRoute(&serviceConf.Routes[i], i, settings)
+		if err != nil {
+			return nil, fmt.Errorf("service.NewService(): %v", err)
+		}
+		routes = append(routes, route)
+	}
+
+	var serviceURL *url.URL
+	if serviceConf.ServiceURL != "" || len(serviceConf.Upstreams) > 0 {
+		upstreams, err := newUpstreamPool(serviceConf.ServiceURL, serviceConf.Upstreams, settings)
+		if err != nil {
+			return nil, fmt.Errorf("service.NewService(): %v", err)
+		}
+		if serviceConf.ServiceURL != "" {
+			serviceURL = upstreams.Upstreams[0].URL
+		}
+		routes = append(routes, newDefaultRoute(upstreams))
+	}
+
+	// HTTP/2 without TLS is only spoken with prior knowledge (h2c)
+	if serviceConf.UpstreamProtocol == upstreamProtocolH2 {
+		for _, route := range routes {
+			for _, upstream := range route.Upstreams.Upstreams {
+				if upstream.URL.Scheme != "https" {
+					return nil, fmt.Errorf("service.NewService(): upstream %s of route '%s' does not use https as required by upstream protocol h2, use h2c instead", upstream.URL, route.Name)
+				}
+			}
+		}
+	}
+
+	var accessExpression *celexpr.Expression
+	if serviceConf.AccessExpression != "" {
+		accessExpression, err = celexpr.Compile(serviceConf.AccessExpression)
+		if err != nil {
+			return nil, fmt.Errorf("service.NewService(): %v", err)
+		}
+	}
+
+	rateLimits, err := ratelimit.NewLimiters(serviceConf.RateLimits)
+	if err != nil {
+		return nil, fmt.Errorf("service.NewService(): %v", err)
+	}
+
+	headerRules, err := newHeaderRules(&serviceConf.HeaderRules)
+	if err != nil {
+		return nil, fmt.Errorf("service.NewService(): %v", err)
+	}
+
+	securityHeaders, err := newSecurityHeaders(&serviceConf.SecurityHeaders)
 	if err != nil {
 		return nil, fmt.Errorf("service.NewService(): %v", err)
 	}
-	return &Service{ServiceUrl: serviceURL}, nil
+
+	cors, err := newCORS(&serviceConf.CORS)
+	if err != nil {
+		return nil, fmt.Errorf("service.NewService(): %v", err)
+	}
+
+	upgrade, err := newUpgrade(&serviceConf.Upgrade, serviceConf.UpstreamProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("service.NewService(): %v", err)
+	}
+
+	functions, err := sfc.NewFunctions(serviceConf.Functions)
+	if err != nil {
+		return nil, fmt.Errorf("service.NewService(): %v", err)
+	}
+
+	// The WAF inspects requests before all other service functions
+	if serviceConf.WAF.Enabled {
+		firewall, err := waf.New(&serviceConf.WAF)
+		if err != nil {
+			return nil, fmt.Errorf("service.NewService(): %v", err)
+		}
+		functions = append([]*sfc.Function{{Name: "waf", ServiceFunction: firewall}}, functions...)
+	}
+
+	return &Service{
+		ServiceUrl:       serviceURL,
+		Routes:           routes,
+		Proxy:            newReverseProxy(newRetryTransport(upstreamTransport{next: transport}, &serviceConf.Retry, budget, dataPlaneLogger)),
+		Transport:        transport,
+		AccessExpression: accessExpression,
+		Functions:        functions,
+		RateLimits:       rateLimits,
+		ClientCertHeader: newClientCertHeader(&serviceConf.ClientCertHeader),
+		HeaderRules:      headerRules,
+		SecurityHeaders:  securityHeaders,
+		CORS:             cors,
+		Upgrade:          upgrade,
+		health:           health,
+	}, nil
+}
+
+// startHealthChecks begins probing the upstreams of all routes if active health checks are configured
+func (s *Service) startHealthChecks() {
+	if s.health == nil {
+		return
+	}
+	for _, route := range s.Routes {
+		s.health.start(route.Upstreams.Upstreams)
+	}
+}
+
+// Route returns the first route matching the request, or nil if no route matches
+func (s *Service) Route(r *http.Request) *Route {
+	for _, route := range s.Routes {
+		if route.Matches(r) {
+			return route
+		}
+	}
+	return nil
 }
 
 /*
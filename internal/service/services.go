@@ -3,9 +3,12 @@ package service
 import (
 	"crypto/tls"
 	"fmt"
+	"log"
 
 	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/ratelimit"
 	"github.com/leobrada/ztsfc_proxy/internal/security/tlsutil"
+	"github.com/leobrada/ztsfc_proxy/internal/sfc"
 )
 
 type Services struct {
@@ -13,25 +16,49 @@ type Services struct {
 	// Key for the ServicePool Map is the target's service SNI (extracted from http.Request.TLS.ServerName in pep.ServeHTTP).
 	// Used to choose the correct Service (URL) for the ReverseProxy.
 	ServicePool map[string]*Service
+	// Service functions requests can be chained through, indexed by their name
+	ServiceFunctions map[string]*sfc.RemoteFunction
+	// Rate limits applying to the requests to all services
+	RateLimits []*ratelimit.Limiter
 }
 
-func NewServices(servicesConfig *configs.ServicesConfig) (*Services, error) {
+func NewServices(servicesConfig *configs.ServicesConfig, dataPlaneLogger, controlPlaneLogger *log.Logger) (*Services, error) {
 	servicesTLS, err := tlsutil.NewClientTLS(&servicesConfig.TLS)
 	if err != nil {
 		return nil, fmt.Errorf("service.NewServices(): %v", err)
 	}
 
+	// The retry budget is shared by all services
+	budget := newRetryBudget(&servicesConfig.RetryBudget)
+
 	servicePool := make(map[string]*Service)
 	for sni, serviceConf := range servicesConfig.ServicePool {
-		service, err := NewService(&serviceConf)
+		service, err := NewService(sni, &serviceConf, servicesTLS, budget, dataPlaneLogger, controlPlaneLogger)
 		if err != nil {
-			return nil, fmt.Errorf("service.NewServices(): %v", err)
+			return nil, fmt.Errorf("service.NewServices(): service '%s': %v", sni, err)
 		}
 		servicePool[sni] = service
 	}
 
+	serviceFunctions, err := sfc.NewRemoteFunctions(servicesConfig.ServiceFunctions)
+	if err != nil {
+		return nil, fmt.Errorf("service.NewServices(): %v", err)
+	}
+
+	rateLimits, err := ratelimit.NewLimiters(servicesConfig.RateLimits)
+	if err != nil {
+		return nil, fmt.Errorf("service.NewServices(): %v", err)
+	}
+
+	// Probing starts only after all services are valid, so a failed start leaves no probes running
+	for _, service := range servicePool {
+		service.startHealthChecks()
+	}
+
 	return &Services{
-		ServicesTLS: servicesTLS,
-		ServicePool: servicePool,
+		ServicesTLS:      servicesTLS,
+		ServicePool:      servicePool,
+		ServiceFunctions: serviceFunctions,
+		RateLimits:       rateLimits,
 	}, nil
 }
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// upstreamTransport sends a single attempt of a request and keeps the state of the upstream selected for it up to date.
+// It counts the attempt as outstanding until the response body is closed. For requests sent directly to their upstream,
+// i.e., not chained through service functions, it also passes the attempt through the upstream's circuit breaker
+// and feeds its outcome into the passive health check.
+type upstreamTransport struct {
+	next http.RoundTripper
+}
+
+func (t upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	upstream := UpstreamFromContext(req.Context())
+	if upstream == nil {
+		return t.next.RoundTrip(req)
+	}
+	direct := req.URL.Host == upstream.URL.Host
+
+	if direct && upstream.breaker != nil {
+		if err := upstream.breaker.allow(); err != nil {
+			return nil, err
+		}
+	}
+
+	upstream.outstanding.Add(1)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	latency := time.Since(start)
+
+	if err != nil {
+		upstream.outstanding.Add(-1)
+	} else {
+		resp.Body = newOutstandingBody(resp.Body, upstream)
+	}
+
+	if !direct {
+		return resp, err
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		// Requests canceled by the client say nothing about the upstream
+		if upstream.breaker != nil {
+			upstream.breaker.release()
+		}
+	case err != nil:
+		if upstream.breaker != nil {
+			upstream.breaker.record(true, latency)
+		}
+		upstream.observeError(err)
+	default:
+		if upstream.breaker != nil {
+			upstream.breaker.record(resp.StatusCode >= http.StatusInternalServerError, latency)
+		}
+		upstream.observeResponse(resp.StatusCode)
+	}
+	return resp, err
+}
+
+// outstandingBody ends the outstanding request of the upstream when the response body is closed
+type outstandingBody struct {
+	io.ReadCloser
+	upstream *Upstream
+	once     sync.Once
+}
+
+func (b *outstandingBody) Close() error {
+	b.once.Do(func() { b.upstream.outstanding.Add(-1) })
+	return b.ReadCloser.Close()
+}
+
+// writableOutstandingBody keeps the body of a protocol switch (101) writable, since the reverse proxy relays upgraded
+// connections through it
+type writableOutstandingBody struct {
+	*outstandingBody
+	io.Writer
+}
+
+func newOutstandingBody(body io.ReadCloser, upstream *Upstream) io.ReadCloser {
+	ob := &outstandingBody{ReadCloser: body, upstream: upstream}
+	if w, ok := body.(io.ReadWriteCloser); ok {
+		return writableOutstandingBody{outstandingBody: ob, Writer: w}
+	}
+	return ob
+}
+
+// isConnectError reports whether the error occurred while connecting to the upstream, i.e., while dialing or during the
+// TLS handshake, so the request has not been sent. Errors after that point, like response header timeouts or connections
+// reset while the response is read, are no connect errors.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return true
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &verifyErr):
+		return true
+	}
+	// The transport's handshake timeout error is not exported
+	return err != nil && err.Error() == "net/http: TLS handshake timeout"
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+const (
+	defaultTunnelIdleTimeout         = 5 * time.Minute
+	defaultTunnelMaxLifetime         = time.Hour
+	defaultTunnelReauthorizeInterval = time.Minute
+)
+
+// Upgrade holds the limits of the WebSocket tunnels to a service. A zero limit is disabled.
+type Upgrade struct {
+	// Period without traffic in either direction after which a tunnel is closed
+	IdleTimeout time.Duration
+	// Period after which a tunnel is closed regardless of its traffic
+	MaxLifetime time.Duration
+	// Period the PDP is asked again whether a tunnel may stay open
+	ReauthorizeInterval time.Duration
+}
+
+// newUpgrade creates the tunnel limits of a service. It returns nil if the service does not allow upgrades.
+// Tunnels are opened to the service with the HTTP/1.1 Upgrade handshake, so its upstream protocol must allow HTTP/1.1.
+func newUpgrade(upgradeConf *configs.UpgradeConfig, upstreamProtocol string) (*Upgrade, error) {
+	if !upgradeConf.Enabled {
+		return nil, nil
+	}
+	if upstreamProtocol == upstreamProtocolH2 || upstreamProtocol == upstreamProtocolH2C {
+		return nil, fmt.Errorf("upgrade: WebSocket tunnels require HTTP/1.1 to the service, but its upstream protocol is %s", upstreamProtocol)
+	}
+
+	u := new(Upgrade)
+	limits := []struct {
+		name     string
+		value    time.Duration
+		fallback time.Duration
+		limit    *time.Duration
+	}{
+		{"idle_timeout", upgradeConf.IdleTimeout, defaultTunnelIdleTimeout, &u.IdleTimeout},
+		{"max_lifetime", upgradeConf.MaxLifetime, defaultTunnelMaxLifetime, &u.MaxLifetime},
+		{"reauthorize_interval", upgradeConf.ReauthorizeInterval, defaultTunnelReauthorizeInterval, &u.ReauthorizeInterval},
+	}
+	for _, l := range limits {
+		switch {
+		case l.value == 0:
+			*l.limit = l.fallback
+		case l.value == -1:
+			*l.limit = 0
+		case l.value < 0:
+			return nil, fmt.Errorf("upgrade: %s must be positive or -1", l.name)
+		default:
+			*l.limit = l.value
+		}
+	}
+	return u, nil
+}
@@ -0,0 +1,182 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+// Upstream is a single instance of a backend
+type Upstream struct {
+	URL    *url.URL
+	Weight int
+
+	// Number of requests currently forwarded to the instance
+	outstanding atomic.Int64
+
+	// Health checker of the service (nil if health checking is not configured)
+	health *healthChecker
+	// Set while active probes consider the instance unhealthy
+	probeDown atomic.Bool
+	// Set while the passive health check has ejected the instance
+	ejected atomic.Bool
+	// Circuit breaker protecting the instance (nil if not configured)
+	breaker *circuitBreaker
+	// Pool the instance belongs to, used to fail over to another instance
+	pool *UpstreamPool
+
+	// Protects the counters below
+	mu                       sync.Mutex
+	probeSuccesses           int
+	probeFailures            int
+	consecutive5xx           int
+	consecutiveConnectErrors int
+}
+
+// Available reports whether the upstream may be selected, i.e., it passes the active and passive health checks
+func (u *Upstream) Available() bool {
+	return !u.probeDown.Load() && !u.ejected.Load()
+}
+
+// Outstanding returns the number of requests currently forwarded to the upstream
+func (u *Upstream) Outstanding() int64 {
+	return u.outstanding.Load()
+}
+
+// UpstreamPool balances requests across the instances of a backend
+type UpstreamPool struct {
+	Upstreams []*Upstream
+	balancer  balancer
+}
+
+// poolSettings holds the settings of a service shared by the upstream pools of the service and all its routes
+type poolSettings struct {
+	// SNI of the service, used in log messages
+	sni string
+	// Load balancing policy
+	policy string
+	// Health checker of the service (nil if none)
+	health *healthChecker
+	// Configuration of the circuit breaker every upstream gets
+	breaker *configs.CircuitBreakerConfig
+	// ControlPlane logger for state changes of the upstreams
+	cpLogger *log.Logger
+}
+
+// newUpstreamPool creates the pool of a service or route. Either a single URL or a list of weighted upstreams is configured.
+func newUpstreamPool(rawURL string, upstreamConfs []configs.UpstreamConfig, settings *poolSettings) (*UpstreamPool, error) {
+	if rawURL != "" && len(upstreamConfs) > 0 {
+		return nil, fmt.Errorf("a single url and a list of upstreams are mutually exclusive")
+	}
+	if rawURL != "" {
+		upstreamConfs = []configs.UpstreamConfig{{URL: rawURL}}
+	}
+	if len(upstreamConfs) == 0 {
+		return nil, fmt.Errorf("no upstream is configured")
+	}
+
+	upstreams := make([]*Upstream, 0, len(upstreamConfs))
+	for _, upstreamConf := range upstreamConfs {
+		upstreamURL, err := parseUpstreamURL(upstreamConf.URL)
+		if err != nil {
+			return nil, fmt.Errorf("upstream '%s': %v", upstreamConf.URL, err)
+		}
+		if upstreamConf.Weight < 0 {
+			return nil, fmt.Errorf("upstream '%s': negative weight %d", upstreamConf.URL, upstreamConf.Weight)
+		}
+		weight := upstreamConf.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		upstreams = append(upstreams, &Upstream{
+			URL:     upstreamURL,
+			Weight:  weight,
+			health:  settings.health,
+			breaker: newCircuitBreaker(settings.sni, upstreamURL, settings.breaker, settings.cpLogger),
+		})
+	}
+
+	balancer, err := newBalancer(settings.policy, upstreams)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &UpstreamPool{Upstreams: upstreams, balancer: balancer}
+	for _, upstream := range upstreams {
+		upstream.pool = pool
+	}
+	return pool, nil
+}
+
+// parseUpstreamURL parses the URL of an upstream and checks that the proxy supports its scheme
+func parseUpstreamURL(rawURL string) (*url.URL, error) {
+	upstreamURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme '%s'", upstreamURL.Scheme)
+	}
+	return upstreamURL, nil
+}
+
+// Select returns the upstream the request is forwarded to according to the load balancing policy of the pool.
+// Unhealthy upstreams are skipped, as are upstreams whose circuit breaker is open as long as another upstream is left.
+// If no upstream is available, nil is returned.
+func (p *UpstreamPool) Select(r *http.Request) *Upstream {
+	return p.selectExcluding(r, nil)
+}
+
+// selectExcluding works like Select, but never returns one of the excluded upstreams
+func (p *UpstreamPool) selectExcluding(r *http.Request, excluded []*Upstream) *Upstream {
+	candidates := p.candidates(excluded, true)
+	if len(candidates) == 0 {
+		// All healthy upstreams are rejected by their circuit breaker. One of them is still selected, so the
+		// request is answered with the time until its breaker lets requests through again.
+		candidates = p.candidates(excluded, false)
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+	return p.balancer.pick(r, candidates)
+}
+
+// candidates returns the upstreams that can be selected. If admittedOnly is set, upstreams whose circuit breaker would
+// reject the request are left out.
+func (p *UpstreamPool) candidates(excluded []*Upstream, admittedOnly bool) []*Upstream {
+	for i, upstream := range p.Upstreams {
+		if p.selectable(upstream, excluded, admittedOnly) {
+			continue
+		}
+		// Only copy the upstreams if any of them cannot be selected
+		candidates := append(make([]*Upstream, 0, len(p.Upstreams)), p.Upstreams[:i]...)
+		for _, upstream := range p.Upstreams[i+1:] {
+			if p.selectable(upstream, excluded, admittedOnly) {
+				candidates = append(candidates, upstream)
+			}
+		}
+		return candidates
+	}
+	return p.Upstreams
+}
+
+func (p *UpstreamPool) selectable(upstream *Upstream, excluded []*Upstream, admittedOnly bool) bool {
+	for _, e := range excluded {
+		if upstream == e {
+			return false
+		}
+	}
+	if admittedOnly && upstream.breaker != nil && !upstream.breaker.admits() {
+		return false
+	}
+	return upstream.Available()
+}
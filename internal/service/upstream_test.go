@@ -0,0 +1,110 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+// newTestPool creates a round robin pool of the given number of upstreams, each with a circuit breaker opening after a single failure
+func newTestPool(t *testing.T, n int) *UpstreamPool {
+	t.Helper()
+
+	upstreamConfs := make([]configs.UpstreamConfig, 0, n)
+	for i := range n {
+		upstreamConfs = append(upstreamConfs, configs.UpstreamConfig{URL: fmt.Sprintf("http://upstream%d.example.de", i)})
+	}
+	pool, err := newUpstreamPool("", upstreamConfs, &poolSettings{
+		sni:      "service.example.de",
+		policy:   lbRoundRobin,
+		breaker:  &configs.CircuitBreakerConfig{ErrorRateThreshold: 50, MinRequests: 1, OpenDuration: time.Minute, HalfOpenRequests: 1},
+		cpLogger: log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("newUpstreamPool(): %v", err)
+	}
+	return pool
+}
+
+// openBreaker makes the circuit breaker of the upstream open
+func openBreaker(t *testing.T, upstream *Upstream) {
+	t.Helper()
+	if err := upstream.breaker.allow(); err != nil {
+		t.Fatalf("allow(): %v", err)
+	}
+	upstream.breaker.record(true, 0)
+}
+
+func TestSelectSkipsOpenBreakers(t *testing.T) {
+	pool := newTestPool(t, 3)
+	open := pool.Upstreams[1]
+	openBreaker(t, open)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	for range 30 {
+		if upstream := pool.Select(r); upstream == open {
+			t.Fatalf("Select() returned %s, whose breaker is open", upstream.URL)
+		}
+	}
+}
+
+func TestSelectAdmitsHalfOpenBreakers(t *testing.T) {
+	pool := newTestPool(t, 2)
+	halfOpen := pool.Upstreams[0]
+	openBreaker(t, halfOpen)
+	// Let the open duration elapse
+	halfOpen.breaker.openedAt = time.Now().Add(-time.Hour)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	selected := false
+	for range 4 {
+		if pool.Select(r) == halfOpen {
+			selected = true
+		}
+	}
+	if !selected {
+		t.Fatal("Select() never returned the upstream whose open duration elapsed")
+	}
+
+	// The single trial slot is taken by an in-flight request
+	if err := halfOpen.breaker.allow(); err != nil {
+		t.Fatalf("allow(): %v", err)
+	}
+	for range 4 {
+		if pool.Select(r) == halfOpen {
+			t.Fatal("Select() returned the half-open upstream without free trial slots")
+		}
+	}
+}
+
+func TestSelectAllBreakersOpen(t *testing.T) {
+	pool := newTestPool(t, 2)
+	for _, upstream := range pool.Upstreams {
+		openBreaker(t, upstream)
+	}
+
+	upstream := pool.Select(httptest.NewRequest("GET", "/", nil))
+	if upstream == nil {
+		t.Fatal("Select() = nil, want an upstream whose breaker tells when to retry")
+	}
+	var circuitOpen *CircuitOpenError
+	if err := upstream.breaker.allow(); !errors.As(err, &circuitOpen) || circuitOpen.RetryAfter <= 0 {
+		t.Errorf("allow() = %v, want CircuitOpenError with positive RetryAfter", err)
+	}
+}
+
+func TestSelectSkipsUnavailable(t *testing.T) {
+	pool := newTestPool(t, 2)
+	pool.Upstreams[0].ejected.Store(true)
+	pool.Upstreams[1].probeDown.Store(true)
+
+	if upstream := pool.Select(httptest.NewRequest("GET", "/", nil)); upstream != nil {
+		t.Errorf("Select() = %s, want nil if no upstream is healthy", upstream.URL)
+	}
+}
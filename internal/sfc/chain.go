@@ -0,0 +1,131 @@
+// Package sfc implements the service function chaining (SFC) of the ZTSFC proxy. A PDP decision may name an ordered
+// chain of service functions, e.g., an IDS or a DLP inspector, a request must pass before it reaches the service.
+package sfc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+const (
+	// HeaderPrefix starts the names of all headers the proxy sets itself. Clients must never set them.
+	HeaderPrefix = "X-Ztsfc-"
+	// HeaderServiceFunctionPath holds the comma separated URLs of all hops that follow the receiving service function.
+	// The last entry is always the URL of the requested service.
+	HeaderServiceFunctionPath = "X-Ztsfc-Sfp"
+	// HeaderMetadata holds the base64url encoded JSON Metadata of the request's decision context
+	HeaderMetadata = "X-Ztsfc-Metadata"
+)
+
+// RemoteFunction is a service function reachable via HTTP(S) that requests can be chained through
+type RemoteFunction struct {
+	Name string
+	URL  *url.URL
+}
+
+// NewRemoteFunctions creates the remote service functions defined in the configuration, indexed by their name.
+// Parameters:
+//   - functionConfigs: The service function configurations indexed by name.
+//
+// Returns:
+//   - map[string]*RemoteFunction: The created service functions indexed by name.
+//   - error: An error if a service function has an invalid URL.
+func NewRemoteFunctions(functionConfigs map[string]configs.ServiceFunctionConfig) (map[string]*RemoteFunction, error) {
+	functions := make(map[string]*RemoteFunction, len(functionConfigs))
+	for name, functionConfig := range functionConfigs {
+		functionURL, err := url.Parse(functionConfig.URL)
+		if err != nil {
+			return nil, fmt.Errorf("sfc.NewRemoteFunctions(): service function '%s' has invalid url: %v", name, err)
+		}
+		if functionURL.Scheme != "http" && functionURL.Scheme != "https" {
+			return nil, fmt.Errorf("sfc.NewRemoteFunctions(): service function '%s' has unsupported scheme '%s'", name, functionURL.Scheme)
+		}
+		functions[name] = &RemoteFunction{Name: name, URL: functionURL}
+	}
+	return functions, nil
+}
+
+// Metadata is the decision context passed along the chain so every hop knows why and for whom the request was permitted
+type Metadata struct {
+	RequestHash       string   `json:"request_hash"`
+	SNI               string   `json:"sni"`
+	RuleID            string   `json:"rule_id,omitempty"`
+	TrustScore        int      `json:"trust_score"`
+	ClientCN          string   `json:"client_cn,omitempty"`
+	ClientFingerprint string   `json:"client_fingerprint,omitempty"`
+	Chain             []string `json:"chain"`
+}
+
+// Chain is a resolved, ordered list of service functions followed by the requested service
+type Chain struct {
+	Hops    []*RemoteFunction
+	Backend *url.URL
+}
+
+// NewChain resolves the named service functions. An error is returned if a name is unknown.
+func NewChain(names []string, functions map[string]*RemoteFunction, backend *url.URL) (*Chain, error) {
+	chain := &Chain{Backend: backend}
+	for _, name := range names {
+		function, ok := functions[name]
+		if !ok {
+			return nil, fmt.Errorf("sfc.NewChain(): unknown service function '%s'", name)
+		}
+		chain.Hops = append(chain.Hops, function)
+	}
+	return chain, nil
+}
+
+// Names returns the names of all service functions of the chain
+func (c *Chain) Names() []string {
+	names := make([]string, 0, len(c.Hops))
+	for _, hop := range c.Hops {
+		names = append(names, hop.Name)
+	}
+	return names
+}
+
+// FirstHop returns the URL the PEP forwards the request to, i.e., the first service function or the backend if the chain is empty
+func (c *Chain) FirstHop() *url.URL {
+	if len(c.Hops) == 0 {
+		return c.Backend
+	}
+	return c.Hops[0].URL
+}
+
+// Apply sets the service function path and the metadata headers on the request.
+// It does nothing for an empty chain.
+func (c *Chain) Apply(r *http.Request, md Metadata) error {
+	if len(c.Hops) == 0 {
+		return nil
+	}
+
+	path := make([]string, 0, len(c.Hops))
+	for _, hop := range c.Hops[1:] {
+		path = append(path, hop.URL.String())
+	}
+	path = append(path, c.Backend.String())
+	r.Header.Set(HeaderServiceFunctionPath, strings.Join(path, ","))
+
+	md.Chain = c.Names()
+	encoded, err := json.Marshal(md)
+	if err != nil {
+		return fmt.Errorf("sfc.Chain.Apply(): could not encode metadata: %v", err)
+	}
+	r.Header.Set(HeaderMetadata, base64.RawURLEncoding.EncodeToString(encoded))
+	return nil
+}
+
+// StripHeaders removes all headers starting with HeaderPrefix from a request received from a client, so they cannot be spoofed
+func StripHeaders(r *http.Request) {
+	for name := range r.Header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), HeaderPrefix) {
+			delete(r.Header, name)
+		}
+	}
+}
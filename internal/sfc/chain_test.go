@@ -0,0 +1,127 @@
+package sfc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func mustURL(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("url.Parse(): %v", err)
+	}
+	return u
+}
+
+func testFunctions(t *testing.T) map[string]*RemoteFunction {
+	return map[string]*RemoteFunction{
+		"ids": {Name: "ids", URL: mustURL(t, "https://ids.example.de:8443")},
+		"dlp": {Name: "dlp", URL: mustURL(t, "http://dlp.example.de")},
+	}
+}
+
+func TestNewChain(t *testing.T) {
+	backend := mustURL(t, "https://backend.example.de")
+
+	tests := []struct {
+		name      string
+		names     []string
+		wantHops  []string
+		wantFirst string
+		wantErr   bool
+	}{
+		{"empty chain goes to the backend", nil, []string{}, "https://backend.example.de", false},
+		{"single function", []string{"dlp"}, []string{"dlp"}, "http://dlp.example.de", false},
+		{"order of the decision", []string{"dlp", "ids"}, []string{"dlp", "ids"}, "http://dlp.example.de", false},
+		{"unknown function", []string{"ids", "av"}, nil, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain, err := NewChain(tt.names, testFunctions(t), backend)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("NewChain(%v) = %v, want error", tt.names, chain.Names())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewChain(%v): %v", tt.names, err)
+			}
+			if names := chain.Names(); !reflect.DeepEqual(names, tt.wantHops) {
+				t.Errorf("Names() = %v, want %v", names, tt.wantHops)
+			}
+			if first := chain.FirstHop().String(); first != tt.wantFirst {
+				t.Errorf("FirstHop() = %s, want %s", first, tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestChainApply(t *testing.T) {
+	backend := mustURL(t, "https://backend.example.de")
+	chain, err := NewChain([]string{"ids", "dlp"}, testFunctions(t), backend)
+	if err != nil {
+		t.Fatalf("NewChain(): %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	md := Metadata{RequestHash: "hash", SNI: "service.example.de", RuleID: "permit-all", TrustScore: 42, ClientCN: "alice"}
+	if err := chain.Apply(r, md); err != nil {
+		t.Fatalf("Apply(): %v", err)
+	}
+
+	// The first hop receives the request, so the path lists only the hops after it
+	if sfp := r.Header.Get(HeaderServiceFunctionPath); sfp != "http://dlp.example.de,https://backend.example.de" {
+		t.Errorf("%s = %q, want the remaining hops and the backend", HeaderServiceFunctionPath, sfp)
+	}
+
+	encoded, err := base64.RawURLEncoding.DecodeString(r.Header.Get(HeaderMetadata))
+	if err != nil {
+		t.Fatalf("%s is not base64url encoded: %v", HeaderMetadata, err)
+	}
+	var got Metadata
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		t.Fatalf("%s is not JSON: %v", HeaderMetadata, err)
+	}
+	md.Chain = []string{"ids", "dlp"}
+	if !reflect.DeepEqual(got, md) {
+		t.Errorf("%s = %+v, want %+v", HeaderMetadata, got, md)
+	}
+}
+
+func TestChainApplyWithoutHops(t *testing.T) {
+	chain, err := NewChain(nil, testFunctions(t), mustURL(t, "https://backend.example.de"))
+	if err != nil {
+		t.Fatalf("NewChain(): %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := chain.Apply(r, Metadata{RequestHash: "hash"}); err != nil {
+		t.Fatalf("Apply(): %v", err)
+	}
+	if len(r.Header) != 0 {
+		t.Errorf("Apply() of an empty chain set headers %v, want none", r.Header)
+	}
+}
+
+func TestStripHeaders(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(HeaderServiceFunctionPath, "https://attacker.example.de")
+	r.Header.Set(HeaderMetadata, "e30")
+	r.Header.Set("X-Ztsfc-Assertion", "forged")
+	r.Header["x-ztsfc-lowercase"] = []string{"forged"}
+	r.Header.Set("X-Request-Id", "1")
+
+	StripHeaders(r)
+
+	if len(r.Header) != 1 || r.Header.Get("X-Request-Id") != "1" {
+		t.Errorf("headers after StripHeaders() = %v, want only X-Request-Id", r.Header)
+	}
+}
@@ -0,0 +1,136 @@
+package sfc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+// Action is the outcome of an in-process service function's inspection of a request
+type Action int
+
+const (
+	// Pass lets the request continue to the next function or the service
+	Pass Action = iota
+	// Block stops the request. The client receives a 403 page
+	Block
+)
+
+// String returns "pass" or "block"
+func (a Action) String() string {
+	if a == Block {
+		return "block"
+	}
+	return "pass"
+}
+
+// Verdict is the result of a ServiceFunction's inspection of a request
+type Verdict struct {
+	Action Action
+	// Reason explains the verdict in the data plane log, e.g., the ID of a matching rule
+	Reason string
+}
+
+// ServiceFunction is implemented by in-process service functions compiled into the proxy.
+// Functions must be safe for concurrent use, since one instance serves all requests of a service.
+type ServiceFunction interface {
+	// Inspect is called before the request is forwarded. An error fails the request.
+	Inspect(r *http.Request) (Verdict, error)
+	// InspectResponse is called before the response is returned to the client. An error fails the response.
+	InspectResponse(resp *http.Response) error
+}
+
+// Factory creates a ServiceFunction from the parameters configured for a service
+type Factory func(params map[string]string) (ServiceFunction, error)
+
+// Function is an instantiated in-process service function of a service
+type Function struct {
+	Name string
+	ServiceFunction
+}
+
+var (
+	factoriesMu sync.RWMutex
+	// Registered service function factories, indexed by the name functions are referred to in the configuration
+	factories = make(map[string]Factory)
+)
+
+// Register makes a service function available under the given name. It is meant to be called from an init() function
+// and panics if the name is already taken, so two implementations can never silently replace each other.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("sfc.Register(): service function '%s' is already registered", name))
+	}
+	factories[name] = factory
+}
+
+// Registered returns the sorted names of all registered service functions
+func Registered() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewFunctions instantiates the configured service functions in the configured order.
+// Parameters:
+//   - functionConfigs: The functions configured for a service.
+//
+// Returns:
+//   - []*Function: The instantiated functions.
+//   - error: An error if a function is not registered or cannot be created from its parameters.
+func NewFunctions(functionConfigs []configs.FunctionConfig) ([]*Function, error) {
+	functions := make([]*Function, 0, len(functionConfigs))
+	for _, functionConfig := range functionConfigs {
+		factoriesMu.RLock()
+		factory, ok := factories[functionConfig.Name]
+		factoriesMu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("sfc.NewFunctions(): service function '%s' is not registered (registered: %v)", functionConfig.Name, Registered())
+		}
+
+		serviceFunction, err := factory(functionConfig.Params)
+		if err != nil {
+			return nil, fmt.Errorf("sfc.NewFunctions(): could not create service function '%s': %v", functionConfig.Name, err)
+		}
+		functions = append(functions, &Function{Name: functionConfig.Name, ServiceFunction: serviceFunction})
+	}
+	return functions, nil
+}
+
+// ReadBody returns up to limit bytes of the request body and restores the body, so it can still be forwarded.
+// A limit <= 0 reads the whole body.
+func ReadBody(r *http.Request, limit int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+
+	var reader io.Reader = r.Body
+	if limit > 0 {
+		reader = io.LimitReader(r.Body, limit)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("sfc.ReadBody(): %v", err)
+	}
+
+	// Put the read part in front of the unread rest of the body
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	return body, nil
+}
@@ -0,0 +1,125 @@
+package sfc
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+)
+
+// passFunction passes every request and records the parameters it was created with
+type passFunction struct {
+	params map[string]string
+}
+
+func (pf *passFunction) Inspect(r *http.Request) (Verdict, error) {
+	return Verdict{Action: Pass}, nil
+}
+
+func (pf *passFunction) InspectResponse(resp *http.Response) error {
+	return nil
+}
+
+func init() {
+	Register("test_pass", func(params map[string]string) (ServiceFunction, error) {
+		if params["fail"] != "" {
+			return nil, fmt.Errorf("invalid parameters")
+		}
+		return &passFunction{params: params}, nil
+	})
+}
+
+func TestRegisterPanicsOnDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Register() replaced the require_headers function, want panic")
+		}
+	}()
+	Register("require_headers", newRequireHeaders)
+}
+
+func TestNewFunctions(t *testing.T) {
+	functions, err := NewFunctions([]configs.FunctionConfig{
+		{Name: "require_headers", Params: map[string]string{"names": "X-Request-Id"}},
+		{Name: "test_pass", Params: map[string]string{"mode": "strict"}},
+	})
+	if err != nil {
+		t.Fatalf("NewFunctions(): %v", err)
+	}
+
+	if len(functions) != 2 || functions[0].Name != "require_headers" || functions[1].Name != "test_pass" {
+		t.Fatalf("NewFunctions() = %v, want require_headers and test_pass in the configured order", functions)
+	}
+	if pf, ok := functions[1].ServiceFunction.(*passFunction); !ok || pf.params["mode"] != "strict" {
+		t.Errorf("test_pass = %#v, want the configured parameters", functions[1].ServiceFunction)
+	}
+}
+
+func TestNewFunctionsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  configs.FunctionConfig
+		wantErr string
+	}{
+		{"unknown name", configs.FunctionConfig{Name: "antivirus"}, "'antivirus' is not registered (registered: [require_headers test_pass])"},
+		{"invalid parameters", configs.FunctionConfig{Name: "test_pass", Params: map[string]string{"fail": "yes"}}, "could not create service function 'test_pass'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewFunctions([]configs.FunctionConfig{tt.config})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewFunctions() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadBody(t *testing.T) {
+	const body = "hello service function"
+
+	tests := []struct {
+		name  string
+		limit int64
+		want  string
+	}{
+		{"whole body", 0, body},
+		{"limited", 5, "hello"},
+		{"limit above length", 1024, body},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			read, err := ReadBody(r, tt.limit)
+			if err != nil {
+				t.Fatalf("ReadBody(): %v", err)
+			}
+			if string(read) != tt.want {
+				t.Errorf("ReadBody() = %q, want %q", read, tt.want)
+			}
+
+			// A second function and finally the service must still receive the whole body
+			if again, err := ReadBody(r, tt.limit); err != nil || string(again) != tt.want {
+				t.Errorf("second ReadBody() = %q, %v, want %q", again, err, tt.want)
+			}
+			if forwarded, _ := io.ReadAll(r.Body); string(forwarded) != body {
+				t.Errorf("body after ReadBody() = %q, want %q", forwarded, body)
+			}
+		})
+	}
+}
+
+func TestReadBodyWithoutBody(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if body, err := ReadBody(r, 0); body != nil || err != nil {
+		t.Errorf("ReadBody() = %q, %v, want nil", body, err)
+	}
+	if r.Body != http.NoBody {
+		t.Errorf("ReadBody() replaced the empty body")
+	}
+}
@@ -0,0 +1,43 @@
+package sfc
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+func init() {
+	Register("require_headers", newRequireHeaders)
+}
+
+// requireHeaders blocks requests that lack any of the configured headers
+type requireHeaders struct {
+	names []string
+}
+
+// newRequireHeaders creates the function from the comma separated header names in the parameter "names"
+func newRequireHeaders(params map[string]string) (ServiceFunction, error) {
+	rh := new(requireHeaders)
+	for _, name := range strings.Split(params["names"], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			rh.names = append(rh.names, http.CanonicalHeaderKey(name))
+		}
+	}
+	if len(rh.names) == 0 {
+		return nil, fmt.Errorf("sfc.newRequireHeaders(): parameter 'names' is empty")
+	}
+	return rh, nil
+}
+
+func (rh *requireHeaders) Inspect(r *http.Request) (Verdict, error) {
+	for _, name := range rh.names {
+		if r.Header.Get(name) == "" {
+			return Verdict{Action: Block, Reason: fmt.Sprintf("missing header '%s'", name)}, nil
+		}
+	}
+	return Verdict{Action: Pass}, nil
+}
+
+func (rh *requireHeaders) InspectResponse(resp *http.Response) error {
+	return nil
+}
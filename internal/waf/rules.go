@@ -0,0 +1,265 @@
+package waf
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Variables a rule can inspect. They follow the names of the ModSecurity collections.
+const (
+	varArgs           = "ARGS"            // values of all query and url-encoded form parameters
+	varArgsNames      = "ARGS_NAMES"      // names of all query and url-encoded form parameters
+	varQueryString    = "QUERY_STRING"    // raw query string
+	varRequestURI     = "REQUEST_URI"     // raw path and query
+	varRequestHeaders = "REQUEST_HEADERS" // values of all request headers
+	varRequestBody    = "REQUEST_BODY"    // raw request body up to the configured limit
+)
+
+var knownVariables = map[string]bool{
+	varArgs: true, varArgsNames: true, varQueryString: true, varRequestURI: true, varRequestHeaders: true, varRequestBody: true,
+}
+
+// rule is a single parsed SecRule directive
+type rule struct {
+	id         string
+	msg        string
+	variables  []string
+	negate     bool
+	match      func(value string) bool
+	transforms []func(string) string
+}
+
+// parseRules reads SecRule directives from the reader. The supported subset of the ModSecurity rule language is:
+//
+//	SecRule VARIABLES "[!]@OPERATOR ARGUMENT" "id:ID,msg:'MESSAGE',t:TRANSFORMATION,..."
+//
+// VARIABLES are separated by '|'. Supported operators are @rx (default), @contains, @pm, @streq and @beginsWith.
+// Supported transformations are none, lowercase, urlDecode, urlDecodeUni, htmlEntityDecode, compressWhitespace and removeNulls.
+// All other actions like phase or block are accepted and ignored, since the WAF mode decides whether to block.
+// Lines starting with '#' are comments, a trailing '\' continues a directive on the next line.
+func parseRules(r io.Reader) ([]*rule, error) {
+	var rules []*rule
+	ids := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	lineNumber, directive := 0, ""
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if directive == "" && (line == "" || strings.HasPrefix(line, "#")) {
+			continue
+		}
+		if strings.HasSuffix(line, "\\") {
+			directive += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		directive += line
+
+		rule, err := parseRule(directive)
+		if err != nil {
+			return nil, fmt.Errorf("waf.parseRules(): line %d: %v", lineNumber, err)
+		}
+		if ids[rule.id] {
+			return nil, fmt.Errorf("waf.parseRules(): line %d: duplicate rule id %s", lineNumber, rule.id)
+		}
+		ids[rule.id] = true
+		rules = append(rules, rule)
+		directive = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("waf.parseRules(): %v", err)
+	}
+	if directive != "" {
+		return nil, fmt.Errorf("waf.parseRules(): unterminated directive at end of file")
+	}
+
+	return rules, nil
+}
+
+func parseRule(directive string) (*rule, error) {
+	tokens, err := tokenize(directive)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) != 4 || tokens[0] != "SecRule" {
+		return nil, fmt.Errorf("expected 'SecRule VARIABLES \"OPERATOR\" \"ACTIONS\"'")
+	}
+
+	r := new(rule)
+	for _, variable := range strings.Split(tokens[1], "|") {
+		if !knownVariables[variable] {
+			return nil, fmt.Errorf("unsupported variable '%s'", variable)
+		}
+		r.variables = append(r.variables, variable)
+	}
+
+	if err = r.parseOperator(tokens[2]); err != nil {
+		return nil, err
+	}
+	if err = r.parseActions(tokens[3]); err != nil {
+		return nil, err
+	}
+	if r.id == "" {
+		return nil, fmt.Errorf("rule has no id action")
+	}
+	return r, nil
+}
+
+// tokenize splits a directive at whitespace. Double quoted parts form a single token, '\"' escapes a quote inside them.
+func tokenize(directive string) ([]string, error) {
+	var tokens []string
+	var current strings.Builder
+	inQuotes, inToken := false, false
+
+	for i := 0; i < len(directive); i++ {
+		c := directive[i]
+		switch {
+		case inQuotes && c == '\\' && i+1 < len(directive) && directive[i+1] == '"':
+			current.WriteByte('"')
+			i++
+		case c == '"':
+			inQuotes = !inQuotes
+			inToken = true
+		case !inQuotes && (c == ' ' || c == '\t'):
+			if inToken {
+				tokens = append(tokens, current.String())
+				current.Reset()
+				inToken = false
+			}
+		default:
+			current.WriteByte(c)
+			inToken = true
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inToken {
+		tokens = append(tokens, current.String())
+	}
+	return tokens, nil
+}
+
+func (r *rule) parseOperator(operator string) error {
+	if strings.HasPrefix(operator, "!") {
+		r.negate = true
+		operator = operator[1:]
+	}
+	if !strings.HasPrefix(operator, "@") {
+		operator = "@rx " + operator
+	}
+
+	name, argument, _ := strings.Cut(operator, " ")
+	argument = strings.TrimSpace(argument)
+	if argument == "" {
+		return fmt.Errorf("operator %s has no argument", name)
+	}
+
+	switch name {
+	case "@rx":
+		re, err := regexp.Compile(argument)
+		if err != nil {
+			return fmt.Errorf("invalid regular expression: %v", err)
+		}
+		r.match = re.MatchString
+	case "@contains":
+		r.match = func(value string) bool { return strings.Contains(value, argument) }
+	case "@streq":
+		r.match = func(value string) bool { return value == argument }
+	case "@beginsWith":
+		r.match = func(value string) bool { return strings.HasPrefix(value, argument) }
+	case "@pm":
+		phrases := strings.Fields(strings.ToLower(argument))
+		r.match = func(value string) bool {
+			value = strings.ToLower(value)
+			for _, phrase := range phrases {
+				if strings.Contains(value, phrase) {
+					return true
+				}
+			}
+			return false
+		}
+	default:
+		return fmt.Errorf("unsupported operator %s", name)
+	}
+	return nil
+}
+
+func (r *rule) parseActions(actions string) error {
+	for _, action := range splitActions(actions) {
+		key, value, _ := strings.Cut(action, ":")
+		value = strings.Trim(value, "'")
+
+		switch strings.TrimSpace(key) {
+		case "id":
+			r.id = value
+		case "msg":
+			r.msg = value
+		case "t":
+			transform, ok := transformations[value]
+			if !ok {
+				return fmt.Errorf("unsupported transformation '%s'", value)
+			}
+			if transform == nil {
+				// t:none resets all previous transformations
+				r.transforms = nil
+				continue
+			}
+			r.transforms = append(r.transforms, transform)
+		}
+	}
+	return nil
+}
+
+// splitActions splits the action list at commas that are not inside single quotes
+func splitActions(actions string) []string {
+	var parts []string
+	inQuotes, start := false, 0
+	for i := 0; i < len(actions); i++ {
+		switch actions[i] {
+		case '\'':
+			inQuotes = !inQuotes
+		case ',':
+			if !inQuotes {
+				parts = append(parts, strings.TrimSpace(actions[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.TrimSpace(actions[start:]))
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+// transformations maps the supported transformation names to their implementation. t:none is represented by nil.
+var transformations = map[string]func(string) string{
+	"none":      nil,
+	"lowercase": strings.ToLower,
+	"urlDecode": urlDecode,
+	// Go's decoder does not know the %uXXXX notation, so urlDecodeUni behaves like urlDecode
+	"urlDecodeUni":       urlDecode,
+	"htmlEntityDecode":   html.UnescapeString,
+	"compressWhitespace": func(s string) string { return whitespace.ReplaceAllString(s, " ") },
+	"removeNulls":        func(s string) string { return strings.ReplaceAll(s, "\x00", "") },
+}
+
+func urlDecode(s string) string {
+	decoded, err := url.QueryUnescape(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+// matches applies the rule's transformations to the value and reports whether the operator matches
+func (r *rule) matches(value string) bool {
+	for _, transform := range r.transforms {
+		value = transform(value)
+	}
+	return r.match(value) != r.negate
+}
@@ -0,0 +1,129 @@
+package waf
+
+import (
+	"strings"
+	"testing"
+)
+
+func mustParseRule(t *testing.T, directive string) *rule {
+	t.Helper()
+	r, err := parseRule(directive)
+	if err != nil {
+		t.Fatalf("parseRule(%q): %v", directive, err)
+	}
+	return r
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(`
+# comment
+SecRule ARGS|REQUEST_HEADERS "@contains evil" \
+    "id:1,phase:2,block,msg:'Evil, really evil',t:lowercase"
+
+SecRule REQUEST_URI "^/admin" "id:2"
+`))
+	if err != nil {
+		t.Fatalf("parseRules(): %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("parseRules() returned %d rules, want 2", len(rules))
+	}
+
+	first := rules[0]
+	if first.id != "1" || first.msg != "Evil, really evil" || len(first.transforms) != 1 {
+		t.Errorf("first rule = id %s, msg %q, %d transformations, want id 1, msg with comma and 1 transformation", first.id, first.msg, len(first.transforms))
+	}
+	if len(first.variables) != 2 || first.variables[0] != varArgs || first.variables[1] != varRequestHeaders {
+		t.Errorf("first rule variables = %v, want [ARGS REQUEST_HEADERS]", first.variables)
+	}
+	// An operator without '@' is a regular expression
+	if !rules[1].matches("/admin/users") || rules[1].matches("/public/admin") {
+		t.Error("second rule does not behave like @rx ^/admin")
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+	}{
+		{"unknown directive", `SecAction "id:1"`},
+		{"missing actions", `SecRule ARGS "@rx a"`},
+		{"unknown variable", `SecRule REQUEST_COOKIES "@rx a" "id:1"`},
+		{"unsupported operator", `SecRule ARGS "@detectSQLi" "id:1"`},
+		{"operator without argument", `SecRule ARGS "@contains" "id:1"`},
+		{"invalid regular expression", `SecRule ARGS "@rx (a" "id:1"`},
+		{"unsupported transformation", `SecRule ARGS "@rx a" "id:1,t:base64Decode"`},
+		{"missing id", `SecRule ARGS "@rx a" "msg:'no id'"`},
+		{"duplicate id", "SecRule ARGS \"@rx a\" \"id:1\"\nSecRule ARGS \"@rx b\" \"id:1\""},
+		{"unterminated quote", `SecRule ARGS "@rx a "id:1"`},
+		{"unterminated directive", `SecRule ARGS "@rx a" \`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseRules(strings.NewReader(tt.rules)); err == nil {
+				t.Errorf("parseRules(%q) succeeded, want error", tt.rules)
+			}
+		})
+	}
+}
+
+func TestOperators(t *testing.T) {
+	tests := []struct {
+		operator string
+		value    string
+		want     bool
+	}{
+		{`@rx ^a+b$`, "aaab", true},
+		{`@rx ^a+b$`, "aaabc", false},
+		{`@contains passwd`, "/etc/passwd", true},
+		{`@contains passwd`, "/etc/shadow", false},
+		{`@streq admin`, "admin", true},
+		{`@streq admin`, "administrator", false},
+		{`@beginsWith /api`, "/api/users", true},
+		{`@beginsWith /api`, "/v1/api", false},
+		{`@pm select union`, "UNION all", true},
+		{`@pm select union`, "insert", false},
+		{`!@contains safe`, "unsafe", false},
+		{`!@contains safe`, "evil", true},
+	}
+
+	for _, tt := range tests {
+		r := mustParseRule(t, `SecRule ARGS "`+tt.operator+`" "id:1"`)
+		if got := r.matches(tt.value); got != tt.want {
+			t.Errorf("%s matches %q = %t, want %t", tt.operator, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestTransformations(t *testing.T) {
+	tests := []struct {
+		name       string
+		transforms string
+		operator   string
+		value      string
+		want       bool
+	}{
+		{"lowercase", "t:lowercase", "@streq <script>", "<SCRIPT>", true},
+		{"without lowercase", "t:none", "@streq <script>", "<SCRIPT>", false},
+		{"urlDecode", "t:urlDecode", "@contains ../", "%2e%2e%2f", true},
+		{"double urlDecodeUni", "t:urlDecodeUni,t:urlDecodeUni", "@contains ../", "%252e%252e%252f", true},
+		{"single urlDecodeUni misses double encoding", "t:urlDecodeUni", "@contains ../", "%252e%252e%252f", false},
+		{"invalid encoding is kept", "t:urlDecode", "@streq %zz", "%zz", true},
+		{"htmlEntityDecode", "t:htmlEntityDecode", "@contains <script", "&lt;script&gt;", true},
+		{"compressWhitespace", "t:compressWhitespace", "@contains union select", "union \t\n  select", true},
+		{"removeNulls", "t:removeNulls", "@contains javascript:", "java\x00script:", true},
+		{"none resets previous transformations", "t:lowercase,t:none", "@streq abc", "ABC", false},
+		{"order matters", "t:urlDecode,t:lowercase", "@streq <a>", "%3CA%3E", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mustParseRule(t, `SecRule ARGS "`+tt.operator+`" "id:1,`+tt.transforms+`"`)
+			if got := r.matches(tt.value); got != tt.want {
+				t.Errorf("matches(%q) = %t, want %t", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Package waf implements the built-in web application firewall (WAF) service function of the ZTSFC proxy.
+// It inspects query strings, headers and bodies for SQL injection, XSS, path traversal and command injection patterns.
+package waf
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/grpcutil"
+	"github.com/leobrada/ztsfc_proxy/internal/sfc"
+)
+
+const (
+	// Matches are logged, requests pass
+	modeDetect = "detect"
+	// Matching requests are blocked
+	modeBlock = "block"
+
+	// Number of body bytes inspected if no limit is configured
+	defaultBodyLimit = 128 << 10
+)
+
+// Rule set used if no rule file is configured
+//
+//go:embed default_rules.conf
+var defaultRules string
+
+// WAF is a ServiceFunction matching requests against a set of SecRule directives
+type WAF struct {
+	block     bool
+	bodyLimit int64
+	rules     []*rule
+}
+
+// New creates the WAF of a service from its configuration.
+// Parameters:
+//   - wafConfig: A pointer to the WAF configuration of the service.
+//
+// Returns:
+//   - *WAF: A pointer to the created WAF.
+//   - error: An error if the mode is unknown or the rule file cannot be loaded.
+func New(wafConfig *configs.WAFConfig) (*WAF, error) {
+	w := &WAF{bodyLimit: wafConfig.BodyLimit}
+
+	switch wafConfig.Mode {
+	case "", modeDetect:
+	case modeBlock:
+		w.block = true
+	default:
+		return nil, fmt.Errorf("waf.New(): unsupported mode '%s'", wafConfig.Mode)
+	}
+
+	if w.bodyLimit == 0 {
+		w.bodyLimit = defaultBodyLimit
+	}
+
+	var err error
+	if wafConfig.RuleFile == "" {
+		w.rules, err = parseRules(strings.NewReader(defaultRules))
+		if err != nil {
+			return nil, fmt.Errorf("waf.New(): invalid built-in rule set: %v", err)
+		}
+		return w, nil
+	}
+
+	ruleFile, err := os.Open(wafConfig.RuleFile)
+	if err != nil {
+		return nil, fmt.Errorf("waf.New(): could not open rule file: %v", err)
+	}
+	defer ruleFile.Close()
+
+	w.rules, err = parseRules(ruleFile)
+	if err != nil {
+		return nil, fmt.Errorf("waf.New(): invalid rule file '%s': %v", wafConfig.RuleFile, err)
+	}
+	return w, nil
+}
+
+// Inspect matches the request against all rules. The first matching rule determines the verdict.
+// In detect mode the request passes, but the verdict names the matching rule so it shows up in the data plane log.
+func (w *WAF) Inspect(r *http.Request) (sfc.Verdict, error) {
+	targets, err := w.collectTargets(r)
+	if err != nil {
+		return sfc.Verdict{}, fmt.Errorf("waf.WAF.Inspect(): %v", err)
+	}
+
+	for _, rule := range w.rules {
+		for _, variable := range rule.variables {
+			for _, value := range targets[variable] {
+				if !rule.matches(value) {
+					continue
+				}
+				reason := fmt.Sprintf("rule %s matched %s: %s", rule.id, variable, rule.msg)
+				if w.block {
+					return sfc.Verdict{Action: sfc.Block, Reason: reason}, nil
+				}
+				return sfc.Verdict{Action: sfc.Pass, Reason: "detect only, " + reason}, nil
+			}
+		}
+	}
+	return sfc.Verdict{Action: sfc.Pass, Reason: "no rule matched"}, nil
+}
+
+// InspectResponse does nothing, since the WAF only inspects requests
+func (w *WAF) InspectResponse(resp *http.Response) error {
+	return nil
+}
+
+// collectTargets extracts the values of all supported variables from the request
+func (w *WAF) collectTargets(r *http.Request) (map[string][]string, error) {
+	targets := map[string][]string{
+		varQueryString: {r.URL.RawQuery},
+		varRequestURI:  {r.URL.RequestURI()},
+	}
+
+	for _, values := range r.Header {
+		targets[varRequestHeaders] = append(targets[varRequestHeaders], values...)
+	}
+
+	args, _ := url.ParseQuery(r.URL.RawQuery)
+
+	// Bodies of gRPC calls are binary message streams, reading them would hold back streaming calls
+	if w.bodyLimit > 0 && !grpcutil.IsRequest(r) {
+		body, err := sfc.ReadBody(r, w.bodyLimit)
+		if err != nil {
+			return nil, err
+		}
+		targets[varRequestBody] = []string{string(body)}
+
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			formArgs, _ := url.ParseQuery(string(body))
+			for name, values := range formArgs {
+				args[name] = append(args[name], values...)
+			}
+		}
+	}
+
+	for name, values := range args {
+		targets[varArgsNames] = append(targets[varArgsNames], name)
+		targets[varArgs] = append(targets[varArgs], values...)
+	}
+
+	return targets, nil
+}
@@ -0,0 +1,100 @@
+package waf
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/leobrada/ztsfc_proxy/internal/configs"
+	"github.com/leobrada/ztsfc_proxy/internal/sfc"
+)
+
+func TestDefaultRules(t *testing.T) {
+	w, err := New(&configs.WAFConfig{Mode: modeBlock})
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		header  map[string]string
+		body    string
+		blocked bool
+	}{
+		{"benign request", "/api/users?page=2", nil, "", false},
+		{"path traversal in path", "/static/%2e%2e/%2e%2e/etc/hosts", nil, "", true},
+		{"path traversal in argument", "/download?file=..%2F..%2Fsecret", nil, "", true},
+		{"relative URL in Referer", "/docs", map[string]string{"Referer": "https://app.example.de/docs/../index.html"}, "", false},
+		{"OS file access", "/view?file=/etc/passwd", nil, "", true},
+		{"SQL injection", "/search?q=1'%20OR%201=1", nil, "", true},
+		{"UNION SELECT", "/search?q=1%20union%20all%20select%20password", nil, "", true},
+		{"XSS in form body", "/comment", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, "text=%3Cscript%3Ealert(1)%3C/script%3E", true},
+		{"command injection", "/ping?host=127.0.0.1;cat%20/etc/hosts", nil, "", true},
+		{"Shellshock in header", "/", map[string]string{"User-Agent": "() { :; }; echo vulnerable"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "GET"
+			if tt.body != "" {
+				method = "POST"
+			}
+			r := httptest.NewRequest(method, tt.target, strings.NewReader(tt.body))
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+
+			verdict, err := w.Inspect(r)
+			if err != nil {
+				t.Fatalf("Inspect(): %v", err)
+			}
+			if blocked := verdict.Action == sfc.Block; blocked != tt.blocked {
+				t.Errorf("Inspect() = %s (%s), want blocked %t", verdict.Action, verdict.Reason, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestDetectModePasses(t *testing.T) {
+	w, err := New(&configs.WAFConfig{Mode: modeDetect})
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+
+	verdict, err := w.Inspect(httptest.NewRequest("GET", "/view?file=/etc/passwd", nil))
+	if err != nil {
+		t.Fatalf("Inspect(): %v", err)
+	}
+	if verdict.Action != sfc.Pass || !strings.Contains(verdict.Reason, "930120") {
+		t.Errorf("Inspect() = %s (%s), want pass naming rule 930120", verdict.Action, verdict.Reason)
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	w, err := New(&configs.WAFConfig{Mode: modeBlock, BodyLimit: 16})
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+
+	// The attack starts after the inspected part of the body
+	body := strings.Repeat("a", 32) + "<script>alert(1)</script>"
+	r := httptest.NewRequest("POST", "/comment", strings.NewReader(body))
+	verdict, err := w.Inspect(r)
+	if err != nil {
+		t.Fatalf("Inspect(): %v", err)
+	}
+	if verdict.Action != sfc.Pass {
+		t.Errorf("Inspect() = %s (%s), want pass beyond the body limit", verdict.Action, verdict.Reason)
+	}
+
+	// The inspected part must still be forwarded
+	forwarded, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatalf("reading body after inspection: %v", err)
+	}
+	if string(forwarded) != body {
+		t.Errorf("body after inspection = %q, want %q", forwarded, body)
+	}
+}
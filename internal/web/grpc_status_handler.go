@@ -0,0 +1,21 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/leobrada/ztsfc_proxy/internal/grpcutil"
+)
+
+// HandleGRPCError answers a gRPC call with a trailers-only response carrying the status code and message,
+// since gRPC clients cannot read HTML error pages.
+func HandleGRPCError(w http.ResponseWriter, code grpcutil.Code, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(code)))
+	if message != "" {
+		// grpc-message is percent-encoded, see the gRPC over HTTP/2 protocol specification
+		w.Header().Set("Grpc-Message", url.PathEscape(message))
+	}
+	w.WriteHeader(http.StatusOK)
+}
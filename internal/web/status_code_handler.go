@@ -3,8 +3,17 @@ package web
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+func Handle403(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	responseMessage := "<html><body><h1>403 Forbidden</h1><p>You are not authorized to access the requested resource.</p></body></html>"
+	fmt.Fprint(w, responseMessage)
+}
+
 func Handle404(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusNotFound)
@@ -12,6 +21,22 @@ func Handle404(w http.ResponseWriter) {
 	fmt.Fprint(w, responseMessage)
 }
 
+func Handle413(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	responseMessage := "<html><body><h1>413 Content Too Large</h1><p>The request body exceeds the size allowed for the requested resource.</p></body></html>"
+	fmt.Fprint(w, responseMessage)
+}
+
+// Handle429 answers with a 429 page. A positive retryAfter is sent in the Retry-After header, rounded up to full seconds.
+func Handle429(w http.ResponseWriter, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusTooManyRequests)
+	responseMessage := "<html><body><h1>429 Too Many Requests</h1><p>You have sent too many requests. Please try again later.</p></body></html>"
+	fmt.Fprint(w, responseMessage)
+}
+
 func Handle500(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusInternalServerError)
@@ -25,3 +50,25 @@ func Handle501(w http.ResponseWriter) {
 	responseMessage := "<html><body><h1>501 Not Implemented</h1><p>Sorry, the requested functionality is not supported.</p></body></html>"
 	fmt.Fprint(w, responseMessage)
 }
+
+func Handle502(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusBadGateway)
+	responseMessage := "<html><body><h1>502 Bad Gateway</h1><p>The requested service could not be reached.</p></body></html>"
+	fmt.Fprint(w, responseMessage)
+}
+
+// Handle503 answers with a 503 page. A positive retryAfter is sent in the Retry-After header, rounded up to full seconds.
+func Handle503(w http.ResponseWriter, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	responseMessage := "<html><body><h1>503 Service Unavailable</h1><p>The requested service is temporarily unavailable. Please try again later.</p></body></html>"
+	fmt.Fprint(w, responseMessage)
+}
+
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	}
+}
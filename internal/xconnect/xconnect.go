@@ -0,0 +1,30 @@
+// Package xconnect enables extended CONNECT (RFC 8441) in Go's HTTP/2 server, which carries WebSocket tunnels over HTTP/2.
+// The server only accepts it if GODEBUG contains http2xconnect=1 when net/http is initialized, and the setting is not
+// known to //go:debug directives. The package therefore adds it to GODEBUG in its init function. Since Go initializes
+// packages in the order of their import paths as far as their imports allow, it runs before the one of net/http, so
+// importing the package is enough. An operator setting http2xconnect explicitly, e.g., to 0, keeps the own value.
+//
+// This relies on the import order: the package's import path must sort before "net/http" and the package must not
+// import net/http or any package importing it, directly or indirectly. Otherwise net/http is initialized first and
+// extended CONNECT stays disabled without any error. TestServerAdvertisesExtendedConnect and the frontend's tests
+// fail if this happens.
+package xconnect
+
+import (
+	"os"
+	"strings"
+)
+
+// Setting of GODEBUG enabling extended CONNECT
+const setting = "http2xconnect=1"
+
+func init() {
+	godebug := os.Getenv("GODEBUG")
+	if strings.Contains(godebug, "http2xconnect=") {
+		return
+	}
+	if godebug != "" {
+		godebug += ","
+	}
+	os.Setenv("GODEBUG", godebug+setting)
+}
@@ -0,0 +1,57 @@
+// The test lives in its own package, since net/http must not be an import of package xconnect
+package xconnect_test
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	_ "github.com/leobrada/ztsfc_proxy/internal/xconnect"
+)
+
+// Identifier of SETTINGS_ENABLE_CONNECT_PROTOCOL (RFC 8441)
+const settingsEnableConnectProtocol = 0x8
+
+// TestServerAdvertisesExtendedConnect checks that net/http is initialized after this package, so its HTTP/2 server
+// announces extended CONNECT in its first SETTINGS frame
+func TestServerAdvertisesExtendedConnect(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatalf("tls.Dial(): %v", err)
+	}
+	defer conn.Close()
+
+	// Client preface followed by an empty SETTINGS frame
+	conn.Write([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"))
+	conn.Write([]byte{0, 0, 0, 0x4, 0, 0, 0, 0, 0})
+
+	// The server starts with its SETTINGS frame
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("reading frame header: %v", err)
+	}
+	if header[3] != 0x4 {
+		t.Fatalf("first frame has type %d, want SETTINGS", header[3])
+	}
+	payload := make([]byte, int(header[0])<<16|int(header[1])<<8|int(header[2]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		t.Fatalf("reading SETTINGS frame: %v", err)
+	}
+
+	for i := 0; i+6 <= len(payload); i += 6 {
+		if binary.BigEndian.Uint16(payload[i:]) == settingsEnableConnectProtocol && binary.BigEndian.Uint32(payload[i+2:]) == 1 {
+			return
+		}
+	}
+	t.Error("server does not announce SETTINGS_ENABLE_CONNECT_PROTOCOL")
+}